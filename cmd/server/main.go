@@ -2,14 +2,20 @@ package main
 
 import (
 	"database/sql"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	// Recipient timezones must resolve on systems without a zoneinfo database
+	_ "time/tzdata"
 
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
 
+	"outreach-generator/internal/secrets"
 	"outreach-generator/internal/server"
+	"outreach-generator/internal/settings"
 )
 
 func main() {
@@ -18,8 +24,20 @@ func main() {
 		log.Printf("Warning: .env file not found")
 	}
 
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	flag.Parse()
+
+	// Resolve defaults, the config file and the environment
+	layers, err := settings.Load(*configFile)
+	if err != nil {
+		log.Fatal("Error loading configuration:", err)
+	}
+	if layers.File != "" {
+		log.Printf("Loaded config file %s", layers.File)
+	}
+
 	// Initialize database
-	db, err := sql.Open("sqlite3", "local.db")
+	db, err := sql.Open("sqlite3", layers.Get("db_path"))
 	if err != nil {
 		log.Fatal("Error opening database:", err)
 	}
@@ -44,17 +62,19 @@ func main() {
 		log.Fatal("Error initializing database:", err)
 	}
 
+	// Load the master key used to encrypt secrets at rest
+	keys, err := secrets.Load(layers.Get("master_key"), layers.Get("master_key_previous"), layers.Get("master_key_file"))
+	if err != nil {
+		log.Fatal("Error loading master key:", err)
+	}
+
 	// Create server instance
-	srv := server.New(db)
+	srv := server.New(db, keys, layers)
 
 	// Start the server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	log.Printf("Server starting on http://localhost:%s", port)
-	if err := http.ListenAndServe(":"+port, srv.Routes()); err != nil {
+	addr := layers.Get("listen_addr")
+	log.Printf("Server starting on %s", addr)
+	if err := http.ListenAndServe(addr, srv.Routes()); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -64,8 +84,229 @@ func initDB(db *sql.DB) error {
 	CREATE TABLE IF NOT EXISTS config (
 		key TEXT PRIMARY KEY,
 		value TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS website_cache (
+		website TEXT PRIMARY KEY,
+		content TEXT NOT NULL,
+		fetched_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS contacts (
+		id TEXT PRIMARY KEY,
+		source TEXT NOT NULL,
+		fullname TEXT NOT NULL DEFAULT '',
+		company_name TEXT NOT NULL DEFAULT '',
+		business_segment TEXT NOT NULL DEFAULT '',
+		website TEXT NOT NULL DEFAULT '',
+		phone TEXT NOT NULL DEFAULT '',
+		city TEXT NOT NULL DEFAULT '',
+		country TEXT NOT NULL DEFAULT '',
+		email TEXT NOT NULL DEFAULT '',
+		language TEXT NOT NULL DEFAULT '',
+		outreach_text TEXT NOT NULL DEFAULT '',
+		outreach_status TEXT NOT NULL DEFAULT '',
+		outreach_model TEXT NOT NULL DEFAULT '',
+		outreach_generated_at TEXT NOT NULL DEFAULT '',
+		outreach_language TEXT NOT NULL DEFAULT '',
+		language_reason TEXT NOT NULL DEFAULT '',
+		website_status TEXT NOT NULL DEFAULT '',
+		website_detail TEXT NOT NULL DEFAULT '',
+		created_time TEXT NOT NULL DEFAULT '',
+		synced_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS contacts_source ON contacts (source, created_time);
+
+	CREATE TABLE IF NOT EXISTS sync_state (
+		source TEXT PRIMARY KEY,
+		last_sync_at DATETIME,
+		last_full_sync_at DATETIME,
+		records INTEGER NOT NULL DEFAULT 0,
+		changed INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE IF NOT EXISTS imports (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		format TEXT NOT NULL,
+		delimiter TEXT NOT NULL DEFAULT '',
+		sheet TEXT NOT NULL DEFAULT '',
+		header TEXT NOT NULL,
+		mapping TEXT NOT NULL DEFAULT '{}',
+		dedupe TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		rows INTEGER NOT NULL DEFAULT 0,
+		imported INTEGER NOT NULL DEFAULT 0,
+		skipped INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS import_rows (
+		import_id TEXT NOT NULL,
+		row_number INTEGER NOT NULL,
+		cells TEXT NOT NULL,
+		contact_id TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (import_id, row_number)
+	);
+
+	CREATE TABLE IF NOT EXISTS sends (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		contact_id TEXT NOT NULL,
+		step INTEGER NOT NULL DEFAULT 0,
+		sender TEXT NOT NULL DEFAULT '',
+		recipient TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		message_id TEXT NOT NULL DEFAULT '',
+		response TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		sent_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS sends_contact ON sends (contact_id);
+
+	CREATE INDEX IF NOT EXISTS sends_message_id ON sends (message_id);
+
+	CREATE TABLE IF NOT EXISTS send_queue (
+		contact_id TEXT PRIMARY KEY,
+		step INTEGER NOT NULL DEFAULT 0,
+		queued_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS mailbox_state (
+		mailbox TEXT PRIMARY KEY,
+		paused INTEGER NOT NULL DEFAULT 0,
+		next_send_at DATETIME,
+		error TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE IF NOT EXISTS sequences (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS sequence_steps (
+		sequence_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		delay_days INTEGER NOT NULL,
+		prompt TEXT NOT NULL,
+		PRIMARY KEY (sequence_id, position)
+	);
+
+	CREATE TABLE IF NOT EXISTS enrollments (
+		contact_id TEXT PRIMARY KEY,
+		sequence_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		stop_reason TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		retry_at DATETIME,
+		step_offset INTEGER NOT NULL DEFAULT 0,
+		enrolled_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS sequence_messages (
+		contact_id TEXT NOT NULL,
+		step INTEGER NOT NULL,
+		body TEXT NOT NULL,
+		generated_at DATETIME NOT NULL,
+		PRIMARY KEY (contact_id, step)
+	);
+
+	CREATE TABLE IF NOT EXISTS inbound_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		contact_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		sender TEXT NOT NULL DEFAULT '',
+		subject TEXT NOT NULL DEFAULT '',
+		message_id TEXT UNIQUE,
+		detail TEXT NOT NULL DEFAULT '',
+		received_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS inbound_messages_contact ON inbound_messages (contact_id);
+
+	CREATE TABLE IF NOT EXISTS inbox_state (
+		mailbox TEXT PRIMARY KEY,
+		uid_validity INTEGER NOT NULL DEFAULT 0,
+		last_uid INTEGER NOT NULL DEFAULT 0,
+		checked_at DATETIME,
+		error TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE IF NOT EXISTS sender_profiles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT '',
+		company TEXT NOT NULL DEFAULT '',
+		value_proposition TEXT NOT NULL DEFAULT '',
+		case_studies TEXT NOT NULL DEFAULT '',
+		proof_points TEXT NOT NULL DEFAULT '',
+		calendar_link TEXT NOT NULL DEFAULT '',
+		is_default INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS campaigns (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		source TEXT NOT NULL,
+		view TEXT NOT NULL DEFAULT '',
+		prompt TEXT NOT NULL DEFAULT '',
+		profile_id INTEGER NOT NULL DEFAULT 0,
+		language TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL DEFAULT '',
+		max_tokens INTEGER NOT NULL DEFAULT 0,
+		send_hours TEXT NOT NULL DEFAULT '',
+		send_days TEXT NOT NULL DEFAULT '',
+		paused INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS knowledge_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL,
+		content TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
 	);`
 
-	_, err := db.Exec(schema)
-	return err
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	return addColumns(db)
+}
+
+// addedColumns are columns added to existing tables after their first
+// release. CREATE TABLE IF NOT EXISTS does not add them to older databases.
+var addedColumns = []struct{ table, column, definition string }{
+	{"contacts", "outreach_model", "TEXT NOT NULL DEFAULT ''"},
+	{"contacts", "outreach_generated_at", "TEXT NOT NULL DEFAULT ''"},
+	{"contacts", "language", "TEXT NOT NULL DEFAULT ''"},
+	{"contacts", "outreach_language", "TEXT NOT NULL DEFAULT ''"},
+	{"contacts", "language_reason", "TEXT NOT NULL DEFAULT ''"},
+	{"sends", "sender", "TEXT NOT NULL DEFAULT ''"},
+	{"sends", "step", "INTEGER NOT NULL DEFAULT 0"},
+	{"sends", "body", "TEXT NOT NULL DEFAULT ''"},
+	{"send_queue", "step", "INTEGER NOT NULL DEFAULT 0"},
+	{"enrollments", "step_offset", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+func addColumns(db *sql.DB) error {
+	for _, c := range addedColumns {
+		var exists bool
+		err := db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?", c.table, c.column).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return fmt.Errorf("adding %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return nil
 }
@@ -1,8 +1,280 @@
 package components
 
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"outreach-generator/internal/settings"
+	"outreach-generator/internal/types"
+)
+
 func cond(condition bool, trueVal, falseVal string) string {
 	if condition {
 		return trueVal
 	}
 	return falseVal
 }
+
+// intValue renders zero as an empty string so inputs fall back to their placeholder.
+func intValue(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+// effectiveValue shows the resolved value of a setting, which handlers have
+// already masked for secrets.
+func effectiveValue(v settings.Value) string {
+	if v.Value == "" {
+		return "not set"
+	}
+	return v.Value
+}
+
+// sourceLabel explains which layer a setting's value came from.
+func sourceLabel(v settings.Value) string {
+	switch v.Source {
+	case settings.SourceFile:
+		return "config file " + v.Origin
+	case settings.SourceEnv:
+		return "environment " + v.Origin
+	case settings.SourceDatabase:
+		return "saved on this page"
+	}
+	return "default"
+}
+
+func sourceClass(source settings.Source) string {
+	switch source {
+	case settings.SourceFile:
+		return "bg-blue-100 text-blue-800"
+	case settings.SourceEnv:
+		return "bg-purple-100 text-purple-800"
+	case settings.SourceDatabase:
+		return "bg-green-100 text-green-800"
+	}
+	return "bg-gray-100 text-gray-700"
+}
+
+func missingOutputFields(fields []types.OutputField) bool {
+	for _, f := range fields {
+		if !f.Exists {
+			return true
+		}
+	}
+	return false
+}
+
+func outreachStatusClass(status string) string {
+	switch status {
+	case types.OutreachGenerated, types.OutreachApproved:
+		return "bg-blue-100 text-blue-800"
+	case types.OutreachSent, types.OutreachReplied:
+		return "bg-green-100 text-green-800"
+	case types.OutreachBounced, types.OutreachError:
+		return "bg-red-100 text-red-800"
+	}
+	return "bg-gray-100 text-gray-700"
+}
+
+func checkStatusClass(status string) string {
+	switch status {
+	case types.CheckPass:
+		return "bg-green-100 text-green-800"
+	case types.CheckFail:
+		return "bg-red-100 text-red-800"
+	}
+	return "bg-gray-100 text-gray-700"
+}
+
+func websiteStatusLabel(status string) string {
+	switch status {
+	case types.WebsiteOK:
+		return "OK"
+	case types.WebsiteRedirected:
+		return "Redirects to another domain"
+	case types.WebsiteDNSFailure:
+		return "DNS failure"
+	case types.WebsiteTLSError:
+		return "TLS error"
+	case types.WebsiteTimeout:
+		return "Timeout"
+	case types.WebsiteBotProtection:
+		return "Bot protection"
+	case types.WebsiteParked:
+		return "Parked domain"
+	case types.WebsiteEmpty:
+		return "Empty content"
+	case types.WebsiteHTTPError:
+		return "HTTP error"
+	case types.WebsiteUnreachable:
+		return "Unreachable"
+	case types.WebsiteRobots:
+		return "Disallowed by robots.txt"
+	case types.WebsiteBlocked:
+		return "Blocked destination"
+	}
+	return status
+}
+
+func websiteStatusClass(status string) string {
+	switch status {
+	case types.WebsiteOK:
+		return "bg-green-100 text-green-800"
+	case types.WebsiteRedirected, types.WebsiteRobots:
+		return "bg-amber-100 text-amber-800"
+	case types.WebsiteBotProtection, types.WebsiteParked, types.WebsiteEmpty:
+		return "bg-orange-100 text-orange-800"
+	}
+	return "bg-red-100 text-red-800"
+}
+
+// syncTime shows when a sync happened in the server's local time.
+func syncTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// isMapped reports whether an import maps a contact field to a column.
+func isMapped(imp types.Import, field string) bool {
+	_, ok := imp.Mapping[field]
+	return ok
+}
+
+// mappedTo reports whether an import maps a contact field to the column.
+func mappedTo(imp types.Import, field string, column int) bool {
+	c, ok := imp.Mapping[field]
+	return ok && c == column
+}
+
+func sequenceURL(seq types.Sequence) string {
+	return "/api/sequences/" + strconv.FormatInt(seq.ID, 10)
+}
+
+// sequenceDelays lists when each follow-up of a sequence is sent.
+func sequenceDelays(seq types.Sequence) string {
+	delays := make([]string, len(seq.Steps))
+	for i, step := range seq.Steps {
+		delays[i] = "+" + strconv.Itoa(step.DelayDays) + "d"
+	}
+	return strings.Join(delays, ", ")
+}
+
+// formSteps is the steps a sequence form starts with; a new sequence gets
+// one empty step.
+func formSteps(seq types.Sequence) []types.SequenceStep {
+	if len(seq.Steps) == 0 {
+		return []types.SequenceStep{{}}
+	}
+	return seq.Steps
+}
+
+// sequenceStatusLabel describes where a contact stands in their sequence.
+func sequenceStatusLabel(p types.SequenceProgress) string {
+	switch p.Status {
+	case types.SequenceCompleted:
+		return "completed"
+	case types.SequenceStopped:
+		return "stopped: " + p.StopReason
+	}
+	if p.NextDueAt.IsZero() {
+		return "starts after the initial outreach is sent"
+	}
+	return "follow-up " + strconv.Itoa(p.Sent+1) + " due " + p.NextDueAt.Local().Format("2006-01-02 15:04")
+}
+
+// sendStepLabel names the message a send was for.
+func sendStepLabel(step int) string {
+	if step == 0 {
+		return "outreach"
+	}
+	return "follow-up " + strconv.Itoa(step)
+}
+
+func inboundKindLabel(kind string) string {
+	switch kind {
+	case types.InboundReply:
+		return "Reply"
+	case types.InboundAutoReply:
+		return "Automatic reply"
+	case types.InboundBounce:
+		return "Bounce"
+	}
+	return kind
+}
+
+func inboundClass(kind string) string {
+	switch kind {
+	case types.InboundReply:
+		return "bg-green-50 text-green-800 border-green-200"
+	case types.InboundBounce:
+		return "bg-red-50 text-red-700 border-red-200"
+	}
+	return "bg-gray-50 text-gray-700 border-gray-200"
+}
+
+func profileURL(p types.SenderProfile) string {
+	return "/api/profiles/" + strconv.FormatInt(p.ID, 10)
+}
+
+func knowledgeURL(entry types.KnowledgeEntry) string {
+	return "/api/knowledge/" + strconv.FormatInt(entry.ID, 10)
+}
+
+func campaignURL(c types.Campaign) string {
+	return "/api/campaigns/" + strconv.FormatInt(c.ID, 10)
+}
+
+func campaignPageURL(c types.Campaign) string {
+	return "/campaigns/" + strconv.FormatInt(c.ID, 10)
+}
+
+// recordVals names the contact a card's button acts on. The server reads
+// the rest of the contact from the mirror.
+func recordVals(contact types.Contact) string {
+	vals, _ := json.Marshal(map[string]string{"recordId": contact.ID})
+	return string(vals)
+}
+
+// campaignVals makes a button act on a campaign's contacts, as the source
+// picker does on the home page.
+func campaignVals(c types.Campaign) string {
+	return `{"source": "` + c.Key + `"}`
+}
+
+// truncate shortens text to at most n characters for a list.
+func truncate(text string, n int) string {
+	r := []rune(strings.Join(strings.Fields(text), " "))
+	if len(r) <= n {
+		return string(r)
+	}
+	return strings.TrimSpace(string(r[:n])) + "…"
+}
+
+// profileLabel names a sender profile in the home page selector.
+func profileLabel(p types.SenderProfile) string {
+	if p.Company == "" {
+		return p.Name
+	}
+	return p.Name + " (" + p.Company + ")"
+}
+
+// languageReasonLabel says why a contact's outreach is in its language.
+func languageReasonLabel(contact types.Contact) string {
+	switch contact.LanguageReason {
+	case types.LanguageFromField:
+		return "set in the contact's language field"
+	case types.LanguageFromWebsite:
+		return "detected on the website"
+	case types.LanguageFromCountry:
+		return "from the country " + contact.Country
+	case types.LanguageFromDefault:
+		return "the default language"
+	}
+	return contact.LanguageReason
+}
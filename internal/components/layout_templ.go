@@ -42,7 +42,7 @@ func Layout(title string) templ.Component {
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</title><script src=\"https://unpkg.com/htmx.org@1.9.10\"></script><script src=\"https://cdn.tailwindcss.com\"></script></head><body class=\"min-h-screen bg-gray-50\"><nav class=\"bg-gray-800 text-white mb-4\"><div class=\"container mx-auto px-4 py-2 flex justify-between items-center\"><a href=\"/\" class=\"text-lg font-semibold\">AI Outreach Generator</a> <a href=\"/config\" class=\"text-sm hover:text-gray-300\">Configuration</a></div></nav><main class=\"container mx-auto px-4\">")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</title><script src=\"https://unpkg.com/htmx.org@1.9.10\"></script><script src=\"https://cdn.tailwindcss.com\"></script></head><body class=\"min-h-screen bg-gray-50\"><nav class=\"bg-gray-800 text-white mb-4\"><div class=\"container mx-auto px-4 py-2 flex justify-between items-center\"><a href=\"/\" class=\"text-lg font-semibold\">AI Outreach Generator</a><div class=\"flex gap-4\"><a href=\"/import\" class=\"text-sm hover:text-gray-300\">Import</a> <a href=\"/campaigns\" class=\"text-sm hover:text-gray-300\">Campaigns</a> <a href=\"/sequences\" class=\"text-sm hover:text-gray-300\">Sequences</a> <a href=\"/profiles\" class=\"text-sm hover:text-gray-300\">Profiles</a> <a href=\"/config\" class=\"text-sm hover:text-gray-300\">Configuration</a></div></div></nav><main class=\"container mx-auto px-4\">")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
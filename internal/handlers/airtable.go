@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+const (
+	// airtableBatchSize is the most records a multi-record request accepts
+	airtableBatchSize = 10
+	// Airtable allows 5 requests per second per base and asks clients to
+	// wait 30 seconds after a 429
+	airtableRequestInterval = time.Second / 5
+	airtableRateLimitWait   = 30 * time.Second
+	airtableMaxRetries      = 2
+)
+
+// airtableLimiter spaces out every Airtable request made by the process.
+var airtableLimiter = &rateLimiter{interval: airtableRequestInterval}
+
+// rateLimiter hands out evenly spaced request slots.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// airtableRequest sends a JSON request to Airtable within the rate limit and
+// decodes the response into out when it is not nil. Rate limited requests
+// are retried after the wait Airtable asks for.
+func airtableRequest(config types.Config, method, endpoint string, payload, out interface{}) error {
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+config.AirtableAccessToken)
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		airtableLimiter.wait()
+		err = doJSON(req, out)
+
+		var apiErr *apiError
+		if attempt < airtableMaxRetries && errors.As(err, &apiErr) && apiErr.Status == http.StatusTooManyRequests {
+			log.Printf("Airtable rate limit hit, retrying in %s", airtableRateLimitWait)
+			time.Sleep(airtableRateLimitWait)
+			continue
+		}
+		return err
+	}
+}
+
+// writeOutreach writes updates with multi-record PATCH requests of up to ten
+// records. Airtable rejects a whole request when one record is invalid, so a
+// failed batch is retried record by record to find the ones at fault. The
+// result holds an error for every record that could not be written.
+func (h *Handlers) writeOutreach(config types.Config, updates []types.OutreachUpdate) map[string]error {
+	errs := map[string]error{}
+
+	var records []patchRecord
+	for _, u := range updates {
+		if fields := outreachFields(config, u); len(fields) > 0 {
+			records = append(records, patchRecord{ID: u.RecordID, Fields: fields})
+		}
+	}
+
+	for start := 0; start < len(records); start += airtableBatchSize {
+		batch := records[start:min(start+airtableBatchSize, len(records))]
+		err := patchRecords(config, batch)
+		if err == nil {
+			continue
+		}
+		if len(batch) == 1 {
+			errs[batch[0].ID] = err
+			continue
+		}
+
+		log.Printf("Airtable batch of %d records failed, retrying one by one: %v", len(batch), err)
+		for _, record := range batch {
+			if err := patchRecords(config, []patchRecord{record}); err != nil {
+				errs[record.ID] = err
+			}
+		}
+	}
+
+	// Keep the local mirror in line with what Airtable accepted
+	for _, u := range updates {
+		if _, failed := errs[u.RecordID]; failed {
+			continue
+		}
+		if err := h.applyOutreachUpdate(u); err != nil {
+			log.Printf("Warning: Failed to update mirrored contact %s: %v", u.RecordID, err)
+		}
+	}
+
+	return errs
+}
+
+type patchRecord struct {
+	ID     string                 `json:"id"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// patchRecords updates up to ten records in one request. typecast lets
+// Airtable add status choices it does not know yet.
+func patchRecords(config types.Config, records []patchRecord) error {
+	endpoint := fmt.Sprintf("%s/%s/%s", airtableAPI,
+		config.AirtableBaseID,
+		url.PathEscape(config.AirtableTableName))
+
+	payload := map[string]interface{}{
+		"records":  records,
+		"typecast": true,
+	}
+	return airtableRequest(config, "PATCH", endpoint, payload, nil)
+}
@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+// HandleCampaignsPage lists the campaigns with the form to start one.
+func (h *Handlers) HandleCampaignsPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		campaigns, err := h.listCampaigns()
+		if err != nil {
+			http.Error(w, "Failed to load campaigns", http.StatusInternalServerError)
+			return
+		}
+		profiles, err := h.listProfiles()
+		if err != nil {
+			log.Printf("Warning: Failed to load sender profiles: %v", err)
+		}
+		components.CampaignsPage(campaigns, h.listSources(), profiles, languageOptions("")).Render(r.Context(), w)
+	}
+}
+
+// HandleCampaignPage shows a campaign with its contacts and history.
+func (h *Handlers) HandleCampaignPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := h.loadCampaign(urlID(r))
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load campaign", http.StatusInternalServerError)
+			return
+		}
+		contacts, err := h.listContacts(campaignKey(c.ID))
+		if err != nil {
+			http.Error(w, "Failed to load the campaign's contacts", http.StatusInternalServerError)
+			return
+		}
+		history, err := h.campaignHistory(c.ID)
+		if err != nil {
+			http.Error(w, "Failed to load the campaign's history", http.StatusInternalServerError)
+			return
+		}
+		sequences, err := h.listSequences()
+		if err != nil {
+			log.Printf("Warning: Failed to load sequences: %v", err)
+		}
+		components.CampaignPage(c, contacts, history, sequences).Render(r.Context(), w)
+	}
+}
+
+// HandleListCampaigns returns the list of campaigns.
+func (h *Handlers) HandleListCampaigns() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.renderCampaignList(w, r)
+	}
+}
+
+// HandleEditCampaign shows the form of an existing campaign.
+func (h *Handlers) HandleEditCampaign() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := h.loadCampaign(urlID(r))
+		if err == sql.ErrNoRows {
+			h.renderCampaignForm(w, r, types.Campaign{}, "This campaign no longer exists.")
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading campaign: %v", err)
+			h.renderCampaignForm(w, r, types.Campaign{}, "Failed to load the campaign.")
+			return
+		}
+		h.renderCampaignForm(w, r, c, "")
+	}
+}
+
+// HandleSaveCampaign creates or updates a campaign from its form. A new
+// campaign gets the contacts of its source that are in its view, and the
+// page moves on to it.
+func (h *Handlers) HandleSaveCampaign() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			h.renderCampaignForm(w, r, types.Campaign{}, "Failed to parse the campaign.")
+			return
+		}
+
+		c := types.Campaign{
+			Name:      strings.TrimSpace(r.FormValue("name")),
+			Source:    r.FormValue("source"),
+			View:      strings.TrimSpace(r.FormValue("view")),
+			Prompt:    strings.TrimSpace(r.FormValue("prompt")),
+			Language:  r.FormValue("language"),
+			Model:     strings.TrimSpace(r.FormValue("model")),
+			SendHours: strings.TrimSpace(r.FormValue("send_hours")),
+			SendDays:  strings.TrimSpace(r.FormValue("send_days")),
+		}
+		var err error
+		if v := r.FormValue("profile"); v != "" {
+			if c.ProfileID, err = strconv.ParseInt(v, 10, 64); err != nil {
+				h.renderCampaignForm(w, r, c, "Invalid sender profile.")
+				return
+			}
+		}
+		if v := strings.TrimSpace(r.FormValue("max_tokens")); v != "" {
+			if c.MaxTokens, err = strconv.Atoi(v); err != nil || c.MaxTokens <= 0 {
+				h.renderCampaignForm(w, r, c, "Max tokens must be a positive number.")
+				return
+			}
+		}
+		if id := r.FormValue("id"); id != "" {
+			if c.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				h.renderCampaignForm(w, r, types.Campaign{}, "Invalid campaign.")
+				return
+			}
+			// The source and pause state are not part of the form once it exists
+			stored, err := h.loadCampaign(c.ID)
+			if err == sql.ErrNoRows {
+				h.renderCampaignForm(w, r, types.Campaign{}, "This campaign no longer exists.")
+				return
+			}
+			if err != nil {
+				log.Printf("Error loading campaign %d: %v", c.ID, err)
+				h.renderCampaignForm(w, r, c, "Failed to save the campaign.")
+				return
+			}
+			c.Source = stored.Source
+			c.Paused = stored.Paused
+		}
+		if err := h.validateCampaign(c); err != nil {
+			h.renderCampaignForm(w, r, c, err.Error())
+			return
+		}
+
+		isNew := c.ID == 0
+		c, err = h.saveCampaign(c)
+		if err == sql.ErrNoRows {
+			h.renderCampaignForm(w, r, types.Campaign{}, "This campaign no longer exists.")
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving campaign %s: %v", c.Name, err)
+			h.renderCampaignForm(w, r, c, "Failed to save the campaign.")
+			return
+		}
+		if isNew {
+			added, err := h.addCampaignContacts(c)
+			if err != nil {
+				// The campaign exists; its page offers to add the contacts again
+				log.Printf("Error adding contacts to campaign %s: %v", c.Name, err)
+			} else {
+				log.Printf("Added %d contacts to campaign %s", added, c.Name)
+			}
+		}
+		log.Printf("Saved campaign %s", c.Name)
+		w.Header().Set("HX-Redirect", "/campaigns/"+strconv.FormatInt(c.ID, 10))
+	}
+}
+
+// HandleDeleteCampaign removes a campaign and its contacts and returns the
+// updated list.
+func (h *Handlers) HandleDeleteCampaign() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := urlID(r)
+		if id == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if err := h.deleteCampaign(id); err != nil {
+			http.Error(w, "Failed to delete campaign", http.StatusInternalServerError)
+			return
+		}
+		h.renderCampaignList(w, r)
+	}
+}
+
+// HandleAddCampaignContacts copies the contacts added to the campaign's
+// source since it started and returns its contacts list.
+func (h *Handlers) HandleAddCampaignContacts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := h.loadCampaign(urlID(r))
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Campaign not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		added, err := h.addCampaignContacts(c)
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, fmt.Sprintf("Failed to add contacts: %v", err))
+			return
+		}
+		log.Printf("Added %d contacts to campaign %s", added, c.Name)
+
+		contacts, err := h.listContacts(campaignKey(c.ID))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		components.ContactsList(contacts).Render(r.Context(), w)
+	}
+}
+
+// HandleCampaignSummary returns the counts and settings of a campaign.
+func (h *Handlers) HandleCampaignSummary() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.renderCampaignSummary(w, r, urlID(r))
+	}
+}
+
+// HandlePauseCampaign stops sending the campaign's queued messages.
+func (h *Handlers) HandlePauseCampaign() http.HandlerFunc {
+	return h.handleSetCampaignPaused(true)
+}
+
+// HandleResumeCampaign sends the campaign's queued messages again.
+func (h *Handlers) HandleResumeCampaign() http.HandlerFunc {
+	return h.handleSetCampaignPaused(false)
+}
+
+func (h *Handlers) handleSetCampaignPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := urlID(r)
+		err := h.setCampaignPaused(id, paused)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Campaign not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("HX-Trigger", "sendQueueChanged")
+		h.renderCampaignSummary(w, r, id)
+	}
+}
+
+// renderCampaignForm shows the campaign form with the sources, sender
+// profiles and languages to pick from.
+func (h *Handlers) renderCampaignForm(w http.ResponseWriter, r *http.Request, c types.Campaign, message string) {
+	profiles, err := h.listProfiles()
+	if err != nil {
+		log.Printf("Warning: Failed to load sender profiles: %v", err)
+	}
+	components.CampaignForm(c, message, h.listSources(), profiles, languageOptions(c.Language)).Render(r.Context(), w)
+}
+
+// renderCampaignSummary shows a campaign's counts and the settings its
+// outreach is written and sent with.
+func (h *Handlers) renderCampaignSummary(w http.ResponseWriter, r *http.Request, id int64) {
+	c, err := h.loadCampaign(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load campaign", http.StatusInternalServerError)
+		return
+	}
+	config, err := h.loadConfig()
+	if err != nil {
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+
+	sourceName := c.Source
+	if source, err := h.contactSource(c.Source); err == nil {
+		sourceName = source.Name()
+	}
+	profileName := "none"
+	if pc, err := h.loadPromptContext(c.ProfileID); err == nil && pc.Profile != nil {
+		profileName = pc.Profile.Name
+		if c.ProfileID == 0 {
+			profileName += " (the default profile)"
+		}
+	}
+	components.CampaignSummary(c, applyCampaign(config, c), sourceName, profileName).Render(r.Context(), w)
+}
+
+func (h *Handlers) renderCampaignList(w http.ResponseWriter, r *http.Request) {
+	campaigns, err := h.listCampaigns()
+	if err != nil {
+		http.Error(w, "Failed to load campaigns", http.StatusInternalServerError)
+		return
+	}
+	components.CampaignList(campaigns).Render(r.Context(), w)
+}
@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+// campaignPrefix starts the source key of a campaign and the IDs of its
+// contacts, which are copies of the source's contacts: "cmp3-rec123" is
+// record rec123 in campaign 3. Each campaign has its own outreach, sends and
+// sequences for the same person.
+const campaignPrefix = "cmp"
+
+// historyLimit is how many sends the campaign page lists.
+const historyLimit = 50
+
+func campaignKey(id int64) string {
+	return campaignPrefix + strconv.FormatInt(id, 10)
+}
+
+// campaignID reads the campaign ID of a source key.
+func campaignID(key string) (int64, bool) {
+	if !strings.HasPrefix(key, campaignPrefix) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(key, campaignPrefix), 10, 64)
+	return id, err == nil
+}
+
+// campaignSource is the contact list of a campaign. Its outreach is only
+// stored locally, so campaigns over the same source never overwrite each
+// other's.
+type campaignSource struct {
+	h        *Handlers
+	campaign types.Campaign
+}
+
+func (s campaignSource) Key() string                     { return campaignKey(s.campaign.ID) }
+func (s campaignSource) Name() string                    { return s.campaign.Name }
+func (s campaignSource) Check(config types.Config) error { return nil }
+
+func (s campaignSource) Contacts() ([]types.Contact, error) {
+	return s.h.listContacts(s.Key())
+}
+
+func (s campaignSource) WriteOutreach(config types.Config, updates []types.OutreachUpdate) map[string]error {
+	return s.h.writeLocalOutreach(updates)
+}
+
+func (s campaignSource) Refresh(config types.Config, id string) error { return nil }
+
+// applyCampaign overrides the configuration with the settings a campaign
+// sets.
+func applyCampaign(config types.Config, c types.Campaign) types.Config {
+	if c.Prompt != "" {
+		config.OutreachPrompt = c.Prompt
+	}
+	if c.Language != "" {
+		config.DefaultLanguage = c.Language
+	}
+	if c.Model != "" {
+		config.AnthropicModel = c.Model
+	}
+	if c.MaxTokens > 0 {
+		config.MaxTokens = c.MaxTokens
+	}
+	if c.SendHours != "" {
+		config.SendHours = c.SendHours
+	}
+	if c.SendDays != "" {
+		config.SendDays = c.SendDays
+	}
+	return config
+}
+
+// applySelection fills in the prompt template and language a generation
+// request left empty with those saved for its source, which the
+// configuration already has. A campaign's contacts are always written on
+// behalf of the campaign's sender profile.
+func applySelection(source ContactSource, config types.Config, req *outreachRequest) {
+	if req.Prompt == "" {
+		req.Prompt = config.OutreachPrompt
+	}
+	if req.Language == "" {
+		req.Language = config.DefaultLanguage
+	}
+	if c, ok := source.(campaignSource); ok {
+		req.Profile = ""
+		if c.campaign.ProfileID != 0 {
+			req.Profile = strconv.FormatInt(c.campaign.ProfileID, 10)
+		}
+	}
+}
+
+// contactCampaign returns the campaign a contact belongs to, or nil for a
+// contact of Airtable or an import.
+func (h *Handlers) contactCampaign(contact types.Contact) (*types.Campaign, error) {
+	id, ok := campaignID(contact.Source)
+	if !ok {
+		return nil, nil
+	}
+	c, err := h.loadCampaign(id)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// inView reports whether a contact's segment, city or country contains one
+// of the comma separated terms of a view. An empty view has every contact.
+func inView(view string, contact types.Contact) bool {
+	terms := splitList(strings.ToLower(view))
+	if len(terms) == 0 {
+		return true
+	}
+	fields := strings.ToLower(strings.Join([]string{contact.BusinessSegment, contact.City, contact.Country}, "\n"))
+	for _, term := range terms {
+		if strings.Contains(fields, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCampaign checks a campaign before it is saved.
+func (h *Handlers) validateCampaign(c types.Campaign) error {
+	if c.Name == "" {
+		return errors.New("Give the campaign a name.")
+	}
+	if _, ok := campaignID(c.Source); ok {
+		return errors.New("Pick Airtable or an imported list as the source.")
+	}
+	if _, err := h.contactSource(c.Source); err != nil {
+		return fmt.Errorf("Unknown contact source: %v.", err)
+	}
+	if c.Language != "" && !knownLanguage(c.Language) {
+		return fmt.Errorf("Unknown language %q.", c.Language)
+	}
+	if c.MaxTokens < 0 {
+		return errors.New("Max tokens must be a positive number.")
+	}
+	if c.SendHours != "" {
+		if _, _, err := parseSendHours(c.SendHours); err != nil {
+			return fmt.Errorf("Business hours: %v.", err)
+		}
+	}
+	if c.SendDays != "" {
+		if _, err := parseSendDays(c.SendDays); err != nil {
+			return fmt.Errorf("Business days: %v.", err)
+		}
+	}
+
+	pc, err := h.loadPromptContext(c.ProfileID)
+	if err != nil {
+		return fmt.Errorf("Sender profile: %v.", err)
+	}
+	if _, err := pc.expand(c.Prompt); err != nil {
+		return fmt.Errorf("Prompt template: %v.", err)
+	}
+	return nil
+}
+
+// saveCampaign creates or updates a campaign. The source of an existing
+// campaign never changes, since its contacts were copied from it.
+func (h *Handlers) saveCampaign(c types.Campaign) (types.Campaign, error) {
+	if c.ID == 0 {
+		c.CreatedAt = time.Now().UTC()
+		res, err := h.db.Exec(`INSERT INTO campaigns (name, source, view, prompt, profile_id, language, model,
+				max_tokens, send_hours, send_days, paused, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			c.Name, c.Source, c.View, c.Prompt, c.ProfileID, c.Language, c.Model, c.MaxTokens, c.SendHours, c.SendDays,
+			c.Paused, c.CreatedAt)
+		if err != nil {
+			return c, err
+		}
+		c.ID, err = res.LastInsertId()
+		c.Key = campaignKey(c.ID)
+		return c, err
+	}
+
+	res, err := h.db.Exec(`UPDATE campaigns SET name = ?, view = ?, prompt = ?, profile_id = ?, language = ?, model = ?,
+			max_tokens = ?, send_hours = ?, send_days = ?, paused = ? WHERE id = ?`,
+		c.Name, c.View, c.Prompt, c.ProfileID, c.Language, c.Model, c.MaxTokens, c.SendHours, c.SendDays, c.Paused, c.ID)
+	if err != nil {
+		return c, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+const campaignColumns = `id, name, source, view, prompt, profile_id, language, model, max_tokens, send_hours,
+	send_days, paused, created_at`
+
+func scanCampaign(row interface{ Scan(...interface{}) error }) (types.Campaign, error) {
+	var c types.Campaign
+	err := row.Scan(&c.ID, &c.Name, &c.Source, &c.View, &c.Prompt, &c.ProfileID, &c.Language, &c.Model,
+		&c.MaxTokens, &c.SendHours, &c.SendDays, &c.Paused, &c.CreatedAt)
+	c.Key = campaignKey(c.ID)
+	return c, err
+}
+
+// listCampaigns returns every campaign with its counts, newest first.
+func (h *Handlers) listCampaigns() ([]types.Campaign, error) {
+	rows, err := h.db.Query("SELECT " + campaignColumns + " FROM campaigns ORDER BY created_at DESC, id DESC")
+	if err != nil {
+		return nil, err
+	}
+	var campaigns []types.Campaign
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range campaigns {
+		if campaigns[i].Counts, err = h.campaignCounts(campaigns[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return campaigns, nil
+}
+
+// loadCampaign returns a campaign with its counts.
+func (h *Handlers) loadCampaign(id int64) (types.Campaign, error) {
+	c, err := scanCampaign(h.db.QueryRow("SELECT "+campaignColumns+" FROM campaigns WHERE id = ?", id))
+	if err != nil {
+		return c, err
+	}
+	c.Counts, err = h.campaignCounts(id)
+	return c, err
+}
+
+// campaignCounts counts a campaign's contacts by outreach status and those
+// waiting in the send queue.
+func (h *Handlers) campaignCounts(id int64) (types.CampaignCounts, error) {
+	var counts types.CampaignCounts
+	key := campaignKey(id)
+	rows, err := h.db.Query("SELECT outreach_status, COUNT(*) FROM contacts WHERE source = ? GROUP BY outreach_status", key)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return counts, err
+		}
+		counts.Contacts += n
+		switch status {
+		case types.OutreachGenerated:
+			counts.Generated = n
+		case types.OutreachApproved:
+			counts.Approved = n
+		case types.OutreachSent:
+			counts.Sent = n
+		case types.OutreachReplied:
+			counts.Replied = n
+		case types.OutreachBounced:
+			counts.Bounced = n
+		case types.OutreachError:
+			counts.Errors = n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return counts, err
+	}
+
+	err = h.db.QueryRow("SELECT COUNT(*) FROM send_queue WHERE contact_id IN (SELECT id FROM contacts WHERE source = ?)",
+		key).Scan(&counts.Queued)
+	return counts, err
+}
+
+// addCampaignContacts copies the contacts of the campaign's source that are
+// in its view and not in the campaign yet, and refreshes the details of
+// those already in it. It returns how many were added.
+func (h *Handlers) addCampaignContacts(c types.Campaign) (int, error) {
+	source, err := h.contactSource(c.Source)
+	if err != nil {
+		return 0, err
+	}
+	contacts, err := source.Contacts()
+	if err != nil {
+		return 0, err
+	}
+
+	key := campaignKey(c.ID)
+	before, err := h.countContacts(key)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO contacts (id, source, fullname, company_name, business_segment,
+			website, phone, city, country, email, language, website_status, website_detail, created_time, synced_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			fullname = excluded.fullname,
+			company_name = excluded.company_name,
+			business_segment = excluded.business_segment,
+			website = excluded.website,
+			phone = excluded.phone,
+			city = excluded.city,
+			country = excluded.country,
+			email = excluded.email,
+			language = excluded.language,
+			synced_at = excluded.synced_at,
+			website_status = CASE WHEN contacts.website = excluded.website THEN contacts.website_status ELSE excluded.website_status END,
+			website_detail = CASE WHEN contacts.website = excluded.website THEN contacts.website_detail ELSE excluded.website_detail END`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	for _, contact := range contacts {
+		if !inView(c.View, contact) {
+			continue
+		}
+		if _, err := stmt.Exec(key+"-"+contact.ID, key, contact.Fullname, contact.CompanyName, contact.BusinessSegment,
+			contact.Website, contact.Phone, contact.City, contact.Country, contact.Email, contact.Language, contact.WebsiteStatus,
+			contact.WebsiteDetail, contact.CreatedTime, now); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	after, err := h.countContacts(key)
+	return after - before, err
+}
+
+// deleteCampaign removes a campaign with its contacts, their place in the
+// send queue and their sequences. Their sends stay, since they count toward
+// the daily cap.
+func (h *Handlers) deleteCampaign(id int64) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	key := campaignKey(id)
+	for _, query := range []string{
+		"DELETE FROM send_queue WHERE contact_id IN (SELECT id FROM contacts WHERE source = ?)",
+		"DELETE FROM enrollments WHERE contact_id IN (SELECT id FROM contacts WHERE source = ?)",
+		"DELETE FROM contacts WHERE source = ?",
+	} {
+		if _, err := tx.Exec(query, key); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM campaigns WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (h *Handlers) setCampaignPaused(id int64, paused bool) error {
+	return h.updateCampaign(id, "paused", paused)
+}
+
+// setCampaignPrompt saves the prompt template edited on the home page while
+// the campaign is selected.
+func (h *Handlers) setCampaignPrompt(id int64, prompt string) error {
+	return h.updateCampaign(id, "prompt", prompt)
+}
+
+// setCampaignLanguage saves the language picked on the home page while the
+// campaign is selected.
+func (h *Handlers) setCampaignLanguage(id int64, language string) error {
+	return h.updateCampaign(id, "language", language)
+}
+
+// updateCampaign sets one column of a campaign. The column is always a
+// constant of the caller.
+func (h *Handlers) updateCampaign(id int64, column string, value interface{}) error {
+	res, err := h.db.Exec("UPDATE campaigns SET "+column+" = ? WHERE id = ?", value, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// campaignHistory returns the latest send attempts to a campaign's
+// contacts, newest first.
+func (h *Handlers) campaignHistory(id int64) ([]types.SendResult, error) {
+	rows, err := h.db.Query(`SELECT `+sendColumns+` FROM sends
+		WHERE contact_id IN (SELECT id FROM contacts WHERE source = ?) ORDER BY id DESC LIMIT ?`,
+		campaignKey(id), historyLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sends []types.SendResult
+	for rows.Next() {
+		r, err := scanSend(rows)
+		if err != nil {
+			return nil, err
+		}
+		sends = append(sends, r)
+	}
+	return sends, rows.Err()
+}
@@ -2,10 +2,18 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
 
 	"outreach-generator/internal/components"
+	"outreach-generator/internal/secrets"
+	"outreach-generator/internal/settings"
 	"outreach-generator/internal/types"
 )
 
@@ -16,6 +24,16 @@ func (h *Handlers) HandleConfig() http.HandlerFunc {
 			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
 			return
 		}
+		values, err := h.loadSettings()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+		overrides, err := h.loadOverrides()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
 
 		var schema *types.TableSchema
 		if config.AirtableAccessToken != "" && config.AirtableBaseID != "" && config.AirtableTableName != "" {
@@ -25,7 +43,8 @@ func (h *Handlers) HandleConfig() http.HandlerFunc {
 			}
 		}
 
-		component := components.Config(config, schema)
+		maskSettings(values, overrides)
+		component := components.Config(values, overrides, h.settings.File, schema, h.keys.CurrentKeyID())
 		component.Render(r.Context(), w)
 	}
 }
@@ -39,7 +58,7 @@ func (h *Handlers) HandleGetConfig() http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(config)
+		json.NewEncoder(w).Encode(config.Masked())
 	}
 }
 
@@ -50,15 +69,35 @@ func (h *Handlers) HandleSaveConfig() http.HandlerFunc {
 			return
 		}
 
-		config := types.Config{
-			AnthropicAPIKey:     r.FormValue("anthropic_api_key"),
-			AirtableAccessToken: r.FormValue("airtable_access_token"),
-			AirtableBaseID:      r.FormValue("airtable_base_id"),
-			AirtableTableName:   r.FormValue("airtable_table_name"),
-			DefaultLanguage:     r.FormValue("default_language"),
+		overrides := map[string]string{}
+		for _, setting := range settings.All {
+			if setting.Runtime {
+				continue
+			}
+
+			value := strings.TrimSpace(r.PostForm.Get(setting.Key))
+			if setting.Secret {
+				// Secrets are never sent to the browser, so an empty or masked
+				// value means "keep the saved one"
+				if r.PostForm.Get("clear_"+setting.Key) != "" {
+					overrides[setting.Key] = ""
+				} else if value != "" && !secrets.IsMasked(value) {
+					overrides[setting.Key] = value
+				}
+				continue
+			}
+
+			if _, ok := r.PostForm[setting.Key]; !ok {
+				continue
+			}
+			if err := validateSetting(setting.Key, value); err != nil {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", setting.Label, err))
+				return
+			}
+			overrides[setting.Key] = value
 		}
 
-		if err := h.saveConfig(config); err != nil {
+		if err := h.saveConfig(overrides); err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Failed to save configuration")
 			return
 		}
@@ -69,3 +108,117 @@ func (h *Handlers) HandleSaveConfig() http.HandlerFunc {
 		})
 	}
 }
+
+// HandleRotateKey replaces the master key in the keyfile and re-encrypts
+// every stored secret with it.
+func (h *Handlers) HandleRotateKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h.keys.BeginRotation(); err != nil {
+			if errors.Is(err, secrets.ErrEnvKey) {
+				respondWithError(w, http.StatusConflict, "The master key is set directly (master_key or OUTREACH_MASTER_KEY). Set a new key there, move the old one to master_key_previous and restart.")
+				return
+			}
+			log.Printf("Error rotating master key: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to rotate master key")
+			return
+		}
+
+		n, err := h.reencryptSecrets()
+		if err != nil {
+			// The keyfile still holds the old key, so nothing is lost
+			log.Printf("Error re-encrypting secrets: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to re-encrypt secrets")
+			return
+		}
+
+		if err := h.keys.FinishRotation(); err != nil {
+			log.Printf("Error finishing key rotation: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Secrets were re-encrypted but the old key could not be removed from the key file")
+			return
+		}
+
+		log.Printf("Rotated master key to %s, re-encrypted %d secrets", h.keys.CurrentKeyID(), n)
+		respondWithJSON(w, http.StatusOK, map[string]string{
+			"message": fmt.Sprintf("Master key rotated, %d secrets re-encrypted", n),
+		})
+	}
+}
+
+// validateSetting rejects values the config loader would silently ignore.
+func validateSetting(key, value string) error {
+	if value == "" {
+		return nil
+	}
+	switch key {
+	case "crawl_delay_ms", "crawl_concurrency", "sync_interval_minutes", "send_min_gap_seconds", "send_max_gap_seconds",
+		"imap_poll_minutes":
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return errors.New("must be a whole number of zero or more")
+		}
+	case "smtp_port", "imap_port":
+		if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+			return errors.New("must be a port number")
+		}
+	case "default_language":
+		if !knownLanguage(value) {
+			return fmt.Errorf("unknown language %q", value)
+		}
+	case "smtp_security", "imap_security":
+		switch value {
+		case types.SMTPStartTLS, types.SMTPTLS, types.SMTPNone:
+		default:
+			return fmt.Errorf("unknown mode %q", value)
+		}
+	case "smtp_from":
+		if _, err := mail.ParseAddress(value); err != nil {
+			return fmt.Errorf("invalid address: %v", err)
+		}
+	case "email_format":
+		if value != types.EmailHTML && value != types.EmailText {
+			return fmt.Errorf("unknown format %q, use html or text", value)
+		}
+	case "send_daily_cap", "max_tokens":
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			return errors.New("must be a whole number of one or more")
+		}
+	case "send_hours":
+		if _, _, err := parseSendHours(value); err != nil {
+			return err
+		}
+	case "send_days":
+		if _, err := parseSendDays(value); err != nil {
+			return err
+		}
+	case "send_default_timezone":
+		if _, err := time.LoadLocation(value); err != nil {
+			return fmt.Errorf("unknown timezone %q, use a name like Europe/Warsaw", value)
+		}
+	case "export_columns":
+		if _, err := parseExportColumns(value); err != nil {
+			return err
+		}
+	case "fallback_mode":
+		switch value {
+		case types.FallbackOff, types.FallbackCached, types.FallbackContactData:
+		default:
+			return fmt.Errorf("unknown mode %q", value)
+		}
+	}
+	return nil
+}
+
+// maskSettings replaces secret values with their masks before they are
+// rendered.
+func maskSettings(values map[string]settings.Value, overrides map[string]string) {
+	for key, v := range values {
+		if v.Secret {
+			v.Value = secrets.Mask(v.Value)
+			values[key] = v
+		}
+	}
+	for key, value := range overrides {
+		if s, ok := settings.Lookup(key); ok && s.Secret {
+			overrides[key] = secrets.Mask(value)
+		}
+	}
+}
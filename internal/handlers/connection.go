@@ -0,0 +1,405 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+// requiredAirtableScopes are the token scopes the generator relies on.
+var requiredAirtableScopes = []string{
+	"data.records:read",
+	"data.records:write",
+	"schema.bases:read",
+}
+
+// computedFieldTypes are Airtable field types that cannot be written through
+// the API.
+var computedFieldTypes = map[string]bool{
+	"formula":              true,
+	"rollup":               true,
+	"count":                true,
+	"lookup":               true,
+	"multipleLookupValues": true,
+	"autoNumber":           true,
+	"createdTime":          true,
+	"lastModifiedTime":     true,
+	"createdBy":            true,
+	"lastModifiedBy":       true,
+	"button":               true,
+	"aiText":               true,
+}
+
+// connectionChecks collects results in order. Once a check fails, the ones
+// that depend on it are recorded as skipped.
+type connectionChecks struct {
+	checks []types.ConnectionCheck
+	failed string
+}
+
+func (c *connectionChecks) pass(name, detail string) {
+	c.add(name, types.CheckPass, detail)
+}
+
+func (c *connectionChecks) fail(name, detail string) {
+	c.add(name, types.CheckFail, detail)
+	if c.failed == "" {
+		c.failed = name
+	}
+}
+
+// skipped records name as skipped and returns true if an earlier check failed.
+func (c *connectionChecks) skipped(name string) bool {
+	if c.failed == "" {
+		return false
+	}
+	c.add(name, types.CheckSkip, fmt.Sprintf("Skipped because %q failed", c.failed))
+	return true
+}
+
+func (c *connectionChecks) add(name, status, detail string) {
+	c.checks = append(c.checks, types.ConnectionCheck{Name: name, Status: status, Detail: detail})
+}
+
+// HandleTestAnthropic validates the saved Anthropic key with free model
+// listing calls instead of a generation.
+func (h *Handlers) HandleTestAnthropic() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+
+		checks := h.testAnthropic(config)
+		components.ConnectionResults("Anthropic", checks).Render(r.Context(), w)
+	}
+}
+
+// HandleTestAirtable verifies the saved Airtable token, its scopes, access
+// to the base and table, and that the outreach field can be written, without
+// writing to any record.
+func (h *Handlers) HandleTestAirtable() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+
+		checks := h.testAirtable(config)
+		components.ConnectionResults("Airtable", checks).Render(r.Context(), w)
+	}
+}
+
+// HandleTestSMTP connects to the saved SMTP server and logs in without
+// sending anything.
+func (h *Handlers) HandleTestSMTP() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+
+		checks := testSMTP(config)
+		components.ConnectionResults("SMTP", checks).Render(r.Context(), w)
+	}
+}
+
+// HandleTestIMAP logs in to the saved IMAP server and opens the mailbox
+// checked for replies, without reading any message.
+func (h *Handlers) HandleTestIMAP() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+
+		checks := testIMAP(config)
+		components.ConnectionResults("IMAP", checks).Render(r.Context(), w)
+	}
+}
+
+func (h *Handlers) testAnthropic(config types.Config) []types.ConnectionCheck {
+	var c connectionChecks
+
+	if config.AnthropicAPIKey == "" {
+		c.fail("API key", "No Anthropic API key is configured")
+	} else if err := anthropicGet(config, "/models?limit=1", nil); err != nil {
+		c.fail("API key", describeAPIError(err, "The key was rejected"))
+	} else {
+		c.pass("API key", "The key is valid")
+	}
+
+	name := "Model " + config.AnthropicModel
+	if !c.skipped(name) {
+		var model struct {
+			DisplayName string `json:"display_name"`
+		}
+		if err := anthropicGet(config, "/models/"+url.PathEscape(config.AnthropicModel), &model); err != nil {
+			c.fail(name, describeAPIError(err, "The model is not available to this key, so generation will fail"))
+		} else {
+			c.pass(name, fmt.Sprintf("Available (%s)", model.DisplayName))
+		}
+	}
+
+	return c.checks
+}
+
+func (h *Handlers) testAirtable(config types.Config) []types.ConnectionCheck {
+	var c connectionChecks
+
+	// Token and scopes
+	var scopes []string
+	if config.AirtableAccessToken == "" {
+		c.fail("Access token", "No Airtable access token is configured")
+	} else if id, granted, err := airtableWhoami(config); err != nil {
+		c.fail("Access token", describeAPIError(err, "The token was rejected"))
+	} else {
+		scopes = granted
+		c.pass("Access token", fmt.Sprintf("Authenticated as %s", id))
+	}
+
+	if !c.skipped("Scopes") {
+		switch missing := missingScopes(scopes); {
+		case scopes == nil:
+			c.add("Scopes", types.CheckSkip, "Airtable did not report the token's scopes")
+		case len(missing) > 0:
+			c.fail("Scopes", fmt.Sprintf("Missing %s. Add them to the token at airtable.com/create/tokens", strings.Join(missing, ", ")))
+		case !hasScope(scopes, schemaWriteScope):
+			c.pass("Scopes", fmt.Sprintf("%s. Without %s, missing output fields must be created by hand", strings.Join(scopes, ", "), schemaWriteScope))
+		default:
+			c.pass("Scopes", strings.Join(scopes, ", "))
+		}
+	}
+
+	// Base and table
+	var tables []types.TableSchema
+	if !c.skipped("Base access") {
+		var err error
+		if config.AirtableBaseID == "" {
+			c.fail("Base access", "No Airtable base ID is configured")
+		} else if tables, err = h.fetchAirtableTables(config); err != nil {
+			c.fail("Base access", describeAPIError(err, fmt.Sprintf("The token cannot access base %s. Add the base to the token's access list", config.AirtableBaseID)))
+		} else {
+			c.pass("Base access", fmt.Sprintf("Base %s has %d tables", config.AirtableBaseID, len(tables)))
+		}
+	}
+
+	var schema *types.TableSchema
+	if !c.skipped("Table") {
+		if schema = findTable(tables, config.AirtableTableName); schema == nil {
+			names := make([]string, len(tables))
+			for i, t := range tables {
+				names[i] = t.Name
+			}
+			c.fail("Table", fmt.Sprintf("Table %q not found. Available: %s", config.AirtableTableName, strings.Join(names, ", ")))
+		} else {
+			c.pass("Table", fmt.Sprintf("Found %q with %d fields", schema.Name, len(schema.Fields)))
+		}
+	}
+
+	if !c.skipped("Outreach field") {
+		field, ok := schema.Field(config.AirtableBodyField)
+		switch {
+		case !ok:
+			c.fail("Outreach field", fmt.Sprintf("Field %q does not exist. Use \"Create Missing Fields\" below or create it as a long text field", config.AirtableBodyField))
+		case computedFieldTypes[field.Type]:
+			c.fail("Outreach field", fmt.Sprintf("Field %q is a %s field, which cannot be written", config.AirtableBodyField, field.Type))
+		default:
+			c.pass("Outreach field", fmt.Sprintf("Field %q exists (%s)", config.AirtableBodyField, field.Type))
+		}
+	}
+
+	// Records
+	if !c.skipped("Read records") {
+		listURL := fmt.Sprintf("%s/%s/%s?maxRecords=1&fields%%5B%%5D=%s", airtableAPI,
+			url.PathEscape(config.AirtableBaseID), url.PathEscape(schema.ID), url.QueryEscape(config.AirtableBodyField))
+		if err := airtableRequest(config, "GET", listURL, nil, nil); err != nil {
+			c.fail("Read records", describeAPIError(err, "Records could not be read"))
+		} else {
+			c.pass("Read records", "Records can be read")
+		}
+	}
+
+	// A test write would modify a real record, so writing is judged by the
+	// token's scopes and the field's type, both checked above
+	if !c.skipped("Write outreach field") {
+		field, _ := schema.Field(config.AirtableBodyField)
+		if scopes == nil {
+			c.add("Write outreach field", types.CheckSkip, "Airtable did not report the token's scopes, so write access is unknown")
+		} else {
+			c.pass("Write outreach field", fmt.Sprintf("The token may write records and %q is a writable %s field", field.Name, field.Type))
+		}
+	}
+
+	return c.checks
+}
+
+func testSMTP(config types.Config) []types.ConnectionCheck {
+	var c connectionChecks
+
+	from, fromErr := mail.ParseAddress(config.SMTPFrom)
+	if config.SMTPHost == "" || config.SMTPFrom == "" {
+		c.fail("Configuration", "Set the SMTP host and from address")
+	} else if fromErr != nil {
+		c.fail("Configuration", fmt.Sprintf("Invalid from address: %v", fromErr))
+	} else {
+		c.pass("Configuration", fmt.Sprintf("Sending as %s through %s:%d (%s)",
+			config.SMTPFrom, config.SMTPHost, config.SMTPPort, config.SMTPSecurity))
+	}
+
+	name := "Connection"
+	if config.SMTPSecurity != types.SMTPNone {
+		name = "Connection and TLS"
+	}
+	var client *smtp.Client
+	if !c.skipped(name) {
+		var err error
+		if client, err = dialSMTP(config); err != nil {
+			c.fail(name, err.Error())
+		} else {
+			defer client.Close()
+			c.pass(name, "Connected")
+		}
+	}
+
+	if !c.skipped("Authentication") {
+		if config.SMTPUsername == "" {
+			c.pass("Authentication", "No username configured, sending without logging in")
+		} else if err := authenticateSMTP(client, config); err != nil {
+			c.fail("Authentication", err.Error())
+		} else {
+			c.pass("Authentication", "Logged in as "+config.SMTPUsername)
+		}
+	}
+
+	if !c.skipped("Sender") {
+		if err := client.Mail(from.Address); err != nil {
+			c.fail("Sender", fmt.Sprintf("The server does not accept %s as the sender: %v", from.Address, err))
+		} else {
+			c.pass("Sender", "The server accepts "+from.Address)
+			client.Reset()
+		}
+		client.Quit()
+	}
+	return c.checks
+}
+
+func testIMAP(config types.Config) []types.ConnectionCheck {
+	var c connectionChecks
+
+	if config.IMAPHost == "" || config.IMAPUsername == "" {
+		c.fail("Configuration", "Set the IMAP host and username")
+	} else {
+		c.pass("Configuration", fmt.Sprintf("Checking %s for %s on %s:%d (%s)",
+			imapMailbox(config), config.IMAPUsername, config.IMAPHost, config.IMAPPort, config.IMAPSecurity))
+	}
+
+	name := "Connection"
+	if config.IMAPSecurity != types.SMTPNone {
+		name = "Connection and TLS"
+	}
+	var conn *client.Client
+	if !c.skipped(name) {
+		var err error
+		if conn, err = dialIMAP(config); err != nil {
+			c.fail(name, err.Error())
+		} else {
+			defer conn.Logout()
+			c.pass(name, "Connected")
+		}
+	}
+
+	if !c.skipped("Authentication") {
+		if err := loginIMAP(conn, config); err != nil {
+			c.fail("Authentication", err.Error())
+		} else {
+			c.pass("Authentication", "Logged in as "+config.IMAPUsername)
+		}
+	}
+
+	if !c.skipped("Mailbox") {
+		if mbox, err := conn.Select(imapMailbox(config), true); err != nil {
+			c.fail("Mailbox", fmt.Sprintf("Cannot open %s: %v", imapMailbox(config), err))
+		} else {
+			c.pass("Mailbox", fmt.Sprintf("%s holds %d messages", mbox.Name, mbox.Messages))
+		}
+	}
+	return c.checks
+}
+
+func anthropicGet(config types.Config, path string, out interface{}) error {
+	req, err := http.NewRequest("GET", anthropicAPI+path, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("x-api-key", config.AnthropicAPIKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+
+	return doJSON(req, out)
+}
+
+func doJSON(req *http.Request, out interface{}) error {
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return parseAPIError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+	return nil
+}
+
+// describeAPIError explains authorization failures with hint and keeps the
+// service's own message for everything else.
+func describeAPIError(err error, hint string) string {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.Status {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return fmt.Sprintf("%s (%v)", hint, err)
+		}
+	}
+	return err.Error()
+}
+
+func missingScopes(scopes []string) []string {
+	var missing []string
+	for _, s := range requiredAirtableScopes {
+		if !hasScope(scopes, s) {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// findTable matches the configured table by name or by table ID.
+func findTable(tables []types.TableSchema, nameOrID string) *types.TableSchema {
+	for i := range tables {
+		if tables[i].Name == nameOrID || tables[i].ID == nameOrID {
+			return &tables[i]
+		}
+	}
+	return nil
+}
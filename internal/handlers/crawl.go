@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/temoto/robotstxt"
+
+	"outreach-generator/internal/types"
+)
+
+const (
+	crawlerProduct      = "OutreachGenerator"
+	crawlerVersion      = "1.0"
+	defaultCrawlContact = "https://github.com/lysy-vlc/go-anthropic-warm-outreach"
+	defaultCrawlDelay   = 2 * time.Second
+	robotsCacheTTL      = time.Hour
+)
+
+var ErrRobotsDisallowed = errors.New("disallowed by robots.txt")
+
+// crawlPolicy describes how politely we fetch a single host. It is built from
+// the saved configuration on every request so changes apply immediately.
+type crawlPolicy struct {
+	UserAgent   string
+	Delay       time.Duration
+	Concurrency int
+}
+
+func crawlPolicyFromConfig(config types.Config) crawlPolicy {
+	contact := strings.TrimSpace(config.CrawlContact)
+	if contact == "" {
+		contact = defaultCrawlContact
+	}
+
+	policy := crawlPolicy{
+		UserAgent:   fmt.Sprintf("%s/%s (+%s)", crawlerProduct, crawlerVersion, contact),
+		Delay:       time.Duration(config.CrawlDelayMs) * time.Millisecond,
+		Concurrency: config.CrawlConcurrency,
+	}
+	// An unset delay resolves to the setting's default, so only a negative
+	// one from the environment or config file is replaced
+	if config.CrawlDelayMs < 0 {
+		policy.Delay = defaultCrawlDelay
+	}
+	if policy.Concurrency <= 0 {
+		policy.Concurrency = 1
+	}
+	return policy
+}
+
+// crawler holds the state shared by every fetch: the guarded transport,
+// per-host rate limiting and the robots.txt cache.
+type crawler struct {
+	base   http.RoundTripper
+	fetch  *fetchPolicy
+	hosts  *hostLimiter
+	mu     sync.Mutex
+	robots map[string]robotsEntry
+}
+
+type robotsEntry struct {
+	data    *robotstxt.RobotsData
+	fetched time.Time
+}
+
+func newCrawler(fetch *fetchPolicy) *crawler {
+	return &crawler{
+		base:   fetch.transport(),
+		fetch:  fetch,
+		hosts:  &hostLimiter{hosts: map[string]*hostSlot{}},
+		robots: map[string]robotsEntry{},
+	}
+}
+
+// transport returns a RoundTripper that identifies us honestly, enforces
+// robots.txt and respects the per-host limits of the policy.
+func (c *crawler) transport(policy crawlPolicy) http.RoundTripper {
+	return &politeTransport{crawler: c, policy: policy}
+}
+
+func (c *crawler) client(policy crawlPolicy, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     c.transport(policy),
+		CheckRedirect: c.fetch.checkRedirect,
+	}
+}
+
+// checkRobots fetches (or reuses) robots.txt for the URL's origin and tests
+// the path against the group matching our product token.
+func (c *crawler) checkRobots(ctx context.Context, policy crawlPolicy, u *url.URL) error {
+	origin := u.Scheme + "://" + u.Host
+
+	c.mu.Lock()
+	entry, ok := c.robots[origin]
+	c.mu.Unlock()
+
+	if !ok || time.Since(entry.fetched) > robotsCacheTTL {
+		data, err := c.fetchRobots(ctx, policy, origin)
+		if err != nil {
+			return err
+		}
+		entry = robotsEntry{data: data, fetched: time.Now()}
+
+		c.mu.Lock()
+		c.robots[origin] = entry
+		c.mu.Unlock()
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	if !entry.data.TestAgent(path, crawlerProduct) {
+		return fmt.Errorf("%w: %s", ErrRobotsDisallowed, u.String())
+	}
+	return nil
+}
+
+func (c *crawler) fetchRobots(ctx context.Context, policy crawlPolicy, origin string) (*robotstxt.RobotsData, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", origin+"/robots.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := c.client(policy, 10*time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching robots.txt: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Cap the body so a hostile server cannot make us buffer gigabytes
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 512*1024))
+	if err != nil {
+		return nil, fmt.Errorf("error reading robots.txt: %w", err)
+	}
+
+	return robotstxt.FromStatusAndBytes(resp.StatusCode, body)
+}
+
+type politeTransport struct {
+	crawler *crawler
+	policy  crawlPolicy
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.policy.UserAgent)
+
+	if req.URL.Path != "/robots.txt" {
+		if err := t.crawler.checkRobots(req.Context(), t.policy, req.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	release, err := t.crawler.hosts.acquire(req.Context(), strings.ToLower(req.URL.Hostname()), t.policy)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.crawler.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// Hold the host slot until the body has been consumed
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// hostLimiter enforces a concurrency cap and a minimum gap between the start
+// of consecutive requests to the same host.
+type hostLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]*hostSlot
+}
+
+type hostSlot struct {
+	sem  chan struct{}
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (l *hostLimiter) acquire(ctx context.Context, host string, policy crawlPolicy) (func(), error) {
+	l.mu.Lock()
+	slot, ok := l.hosts[host]
+	if !ok || cap(slot.sem) != policy.Concurrency {
+		slot = &hostSlot{sem: make(chan struct{}, policy.Concurrency)}
+		l.hosts[host] = slot
+	}
+	l.mu.Unlock()
+
+	select {
+	case slot.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-slot.sem }
+
+	slot.mu.Lock()
+	now := time.Now()
+	start := slot.next
+	if start.Before(now) {
+		start = now
+	}
+	slot.next = start.Add(policy.Delay)
+	slot.mu.Unlock()
+
+	if wait := time.Until(start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+
+	return release, nil
+}
@@ -1,38 +1,167 @@
 package handlers
 
 import (
+	"database/sql"
+	"fmt"
 	"log"
+	"outreach-generator/internal/settings"
 	"outreach-generator/internal/types"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func (h *Handlers) loadConfig() (types.Config, error) {
-	log.Printf("Loading config")
-	var config types.Config
+// secretConfigKeys are encrypted at rest with the master key. The set is
+// built from the settings marked secret so new credentials are covered.
+var secretConfigKeys = func() map[string]bool {
+	keys := map[string]bool{}
+	for _, s := range settings.All {
+		if s.Secret {
+			keys[s.Key] = true
+		}
+	}
+	return keys
+}()
 
-	// Load basic config
+// loadOverrides reads the values saved from the /config page, with secrets
+// decrypted.
+func (h *Handlers) loadOverrides() (map[string]string, error) {
 	rows, err := h.db.Query("SELECT key, value FROM config")
 	if err != nil {
-		return config, err
+		return nil, err
 	}
 	defer rows.Close()
 
+	overrides := map[string]string{}
 	for rows.Next() {
 		var key, value string
 		if err := rows.Scan(&key, &value); err != nil {
-			return config, err
+			return nil, err
+		}
+
+		if secretConfigKeys[key] {
+			plain, err := h.keys.Decrypt(value)
+			if err != nil {
+				// Leave the secret empty so it can be re-entered on /config
+				log.Printf("Warning: Failed to decrypt %s: %v", key, err)
+			}
+			value = plain
 		}
+		overrides[key] = value
+	}
+	return overrides, rows.Err()
+}
+
+// loadSettings resolves every setting from defaults, the config file, the
+// environment and the database, in that order.
+func (h *Handlers) loadSettings() (map[string]settings.Value, error) {
+	overrides, err := h.loadOverrides()
+	if err != nil {
+		return nil, err
+	}
+	return h.settings.Merge(overrides), nil
+}
+
+func (h *Handlers) loadConfig() (types.Config, error) {
+	log.Printf("Loading config")
+	var config types.Config
+
+	values, err := h.loadSettings()
+	if err != nil {
+		return config, err
+	}
 
+	for key, v := range values {
+		value := v.Value
 		switch key {
 		case "anthropic_api_key":
 			config.AnthropicAPIKey = value
+		case "anthropic_model":
+			config.AnthropicModel = value
+		case "max_tokens":
+			config.MaxTokens, _ = strconv.Atoi(value)
 		case "airtable_access_token":
 			config.AirtableAccessToken = value
 		case "airtable_base_id":
 			config.AirtableBaseID = value
 		case "airtable_table_name":
 			config.AirtableTableName = value
+		case "airtable_language_field":
+			config.AirtableLanguageField = value
 		case "default_language":
 			config.DefaultLanguage = value
+		case "outreach_prompt":
+			config.OutreachPrompt = value
+		case "crawl_contact":
+			config.CrawlContact = value
+		case "crawl_delay_ms":
+			config.CrawlDelayMs, _ = strconv.Atoi(value)
+		case "crawl_concurrency":
+			config.CrawlConcurrency, _ = strconv.Atoi(value)
+		case "fallback_mode":
+			config.FallbackMode = value
+		case "airtable_body_field":
+			config.AirtableBodyField = value
+		case "airtable_subject_field":
+			config.AirtableSubjectField = value
+		case "airtable_status_field":
+			config.AirtableStatusField = value
+		case "airtable_generated_at_field":
+			config.AirtableGeneratedAtField = value
+		case "airtable_model_field":
+			config.AirtableModelField = value
+		case "airtable_template_field":
+			config.AirtableTemplateField = value
+		case "airtable_error_field":
+			config.AirtableErrorField = value
+		case "airtable_metadata":
+			config.AirtableMetadata = value
+		case "sync_interval_minutes":
+			config.SyncIntervalMinutes, _ = strconv.Atoi(value)
+		case "export_columns":
+			config.ExportColumns = value
+		case "smtp_host":
+			config.SMTPHost = value
+		case "smtp_port":
+			config.SMTPPort, _ = strconv.Atoi(value)
+		case "smtp_security":
+			config.SMTPSecurity = value
+		case "smtp_username":
+			config.SMTPUsername = value
+		case "smtp_password":
+			config.SMTPPassword = value
+		case "smtp_from":
+			config.SMTPFrom = value
+		case "email_format":
+			config.EmailFormat = value
+		case "email_signature":
+			config.EmailSignature = value
+		case "imap_host":
+			config.IMAPHost = value
+		case "imap_port":
+			config.IMAPPort, _ = strconv.Atoi(value)
+		case "imap_security":
+			config.IMAPSecurity = value
+		case "imap_username":
+			config.IMAPUsername = value
+		case "imap_password":
+			config.IMAPPassword = value
+		case "imap_mailbox":
+			config.IMAPMailbox = value
+		case "imap_poll_minutes":
+			config.IMAPPollMinutes, _ = strconv.Atoi(value)
+		case "send_daily_cap":
+			config.SendDailyCap, _ = strconv.Atoi(value)
+		case "send_min_gap_seconds":
+			config.SendMinGapSeconds, _ = strconv.Atoi(value)
+		case "send_max_gap_seconds":
+			config.SendMaxGapSeconds, _ = strconv.Atoi(value)
+		case "send_hours":
+			config.SendHours = value
+		case "send_days":
+			config.SendDays = value
+		case "send_default_timezone":
+			config.SendDefaultTimezone = value
 		}
 	}
 
@@ -40,8 +169,10 @@ func (h *Handlers) loadConfig() (types.Config, error) {
 	return config, nil
 }
 
-func (h *Handlers) saveConfig(config types.Config) error {
-	log.Printf("Saving config: %+v", config)
+// saveConfig stores database overrides. An empty value removes the override
+// so the setting falls back to the environment, config file or default.
+func (h *Handlers) saveConfig(overrides map[string]string) error {
+	log.Printf("Saving config overrides for %d settings", len(overrides))
 	tx, err := h.db.Begin()
 	if err != nil {
 		log.Printf("Error beginning transaction: %v", err)
@@ -56,15 +187,27 @@ func (h *Handlers) saveConfig(config types.Config) error {
 	}
 	defer stmt.Close()
 
-	configItems := map[string]string{
-		"anthropic_api_key":     config.AnthropicAPIKey,
-		"airtable_access_token": config.AirtableAccessToken,
-		"airtable_base_id":      config.AirtableBaseID,
-		"airtable_table_name":   config.AirtableTableName,
-		"default_language":      config.DefaultLanguage,
-	}
+	for key, value := range overrides {
+		if s, ok := settings.Lookup(key); !ok || s.Runtime {
+			return fmt.Errorf("setting %q cannot be saved in the database", key)
+		}
 
-	for key, value := range configItems {
+		value = strings.TrimSpace(value)
+		if err := validateSetting(key, value); err != nil {
+			return fmt.Errorf("setting %q: %w", key, err)
+		}
+		if value == "" {
+			if _, err := tx.Exec("DELETE FROM config WHERE key = ?", key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if secretConfigKeys[key] {
+			if value, err = h.keys.Encrypt(value); err != nil {
+				return err
+			}
+		}
 		if _, err := stmt.Exec(key, value); err != nil {
 			return err
 		}
@@ -78,6 +221,65 @@ func (h *Handlers) saveConfig(config types.Config) error {
 	return nil
 }
 
+// dropUnsetOverrides removes rows the old /config form saved for fields left
+// blank, which would otherwise hide values from the environment or config
+// file. A saved zero is a value: a crawl delay of 0 turns the delay off.
+func (h *Handlers) dropUnsetOverrides() (int64, error) {
+	res, err := h.db.Exec("DELETE FROM config WHERE value = ''")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// reencryptSecrets seals every stored secret with the current master key.
+// It migrates plaintext values and completes key rotations.
+func (h *Handlers) reencryptSecrets() (int, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT key, value FROM config")
+	if err != nil {
+		return 0, err
+	}
+
+	updates := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !secretConfigKeys[key] || !h.keys.NeedsReencrypt(value) {
+			continue
+		}
+
+		plain, err := h.keys.Decrypt(value)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error decrypting %s: %w", key, err)
+		}
+		if updates[key], err = h.keys.Encrypt(plain); err != nil {
+			rows.Close()
+			return 0, err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for key, value := range updates {
+		if _, err := tx.Exec("UPDATE config SET value = ? WHERE key = ?", value, key); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), tx.Commit()
+}
+
 func (h *Handlers) deleteField(id int64) error {
 	_, err := h.db.Exec("DELETE FROM airtable_fields WHERE id = ?", id)
 	return err
@@ -98,3 +300,30 @@ func (h *Handlers) getRequiredConfig() (types.Config, error) {
 
 	return config, nil
 }
+
+// websiteCacheKey keys cached content by the website as stored on the contact,
+// ignoring case and a trailing slash.
+func websiteCacheKey(website string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(website)), "/")
+}
+
+func (h *Handlers) saveWebsiteCache(website, content string) error {
+	_, err := h.db.Exec(
+		"INSERT OR REPLACE INTO website_cache (website, content, fetched_at) VALUES (?, ?, ?)",
+		websiteCacheKey(website), content, time.Now().UTC(),
+	)
+	return err
+}
+
+func (h *Handlers) loadWebsiteCache(website string) (string, time.Time, error) {
+	var content string
+	var fetchedAt time.Time
+	err := h.db.QueryRow(
+		"SELECT content, fetched_at FROM website_cache WHERE website = ?",
+		websiteCacheKey(website),
+	).Scan(&content, &fetchedAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, nil
+	}
+	return content, fetchedAt, err
+}
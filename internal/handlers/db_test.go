@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"outreach-generator/internal/secrets"
+	"outreach-generator/internal/settings"
+)
+
+// testSchema holds the tables of cmd/server the tests touch.
+const testSchema = `
+	CREATE TABLE config (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+
+	CREATE TABLE contacts (
+		id TEXT PRIMARY KEY,
+		source TEXT NOT NULL,
+		fullname TEXT NOT NULL DEFAULT '',
+		company_name TEXT NOT NULL DEFAULT '',
+		business_segment TEXT NOT NULL DEFAULT '',
+		website TEXT NOT NULL DEFAULT '',
+		phone TEXT NOT NULL DEFAULT '',
+		city TEXT NOT NULL DEFAULT '',
+		country TEXT NOT NULL DEFAULT '',
+		email TEXT NOT NULL DEFAULT '',
+		language TEXT NOT NULL DEFAULT '',
+		outreach_text TEXT NOT NULL DEFAULT '',
+		outreach_status TEXT NOT NULL DEFAULT '',
+		outreach_model TEXT NOT NULL DEFAULT '',
+		outreach_generated_at TEXT NOT NULL DEFAULT '',
+		outreach_language TEXT NOT NULL DEFAULT '',
+		language_reason TEXT NOT NULL DEFAULT '',
+		website_status TEXT NOT NULL DEFAULT '',
+		website_detail TEXT NOT NULL DEFAULT '',
+		created_time TEXT NOT NULL DEFAULT '',
+		synced_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE imports (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		format TEXT NOT NULL,
+		delimiter TEXT NOT NULL DEFAULT '',
+		sheet TEXT NOT NULL DEFAULT '',
+		header TEXT NOT NULL,
+		mapping TEXT NOT NULL DEFAULT '{}',
+		dedupe TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		rows INTEGER NOT NULL DEFAULT 0,
+		imported INTEGER NOT NULL DEFAULT 0,
+		skipped INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE sends (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		contact_id TEXT NOT NULL,
+		step INTEGER NOT NULL DEFAULT 0,
+		sender TEXT NOT NULL DEFAULT '',
+		recipient TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		message_id TEXT NOT NULL DEFAULT '',
+		response TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		sent_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE send_queue (
+		contact_id TEXT PRIMARY KEY,
+		step INTEGER NOT NULL DEFAULT 0,
+		queued_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE sequences (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE sequence_steps (
+		sequence_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		delay_days INTEGER NOT NULL,
+		prompt TEXT NOT NULL,
+		PRIMARY KEY (sequence_id, position)
+	);
+
+	CREATE TABLE enrollments (
+		contact_id TEXT PRIMARY KEY,
+		sequence_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		stop_reason TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		retry_at DATETIME,
+		step_offset INTEGER NOT NULL DEFAULT 0,
+		enrolled_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE sequence_messages (
+		contact_id TEXT NOT NULL,
+		step INTEGER NOT NULL,
+		body TEXT NOT NULL,
+		generated_at DATETIME NOT NULL,
+		PRIMARY KEY (contact_id, step)
+	);
+
+	CREATE TABLE inbound_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		contact_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		sender TEXT NOT NULL DEFAULT '',
+		subject TEXT NOT NULL DEFAULT '',
+		message_id TEXT UNIQUE,
+		detail TEXT NOT NULL DEFAULT '',
+		received_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE campaigns (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		source TEXT NOT NULL,
+		view TEXT NOT NULL DEFAULT '',
+		prompt TEXT NOT NULL DEFAULT '',
+		profile_id INTEGER NOT NULL DEFAULT 0,
+		language TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL DEFAULT '',
+		max_tokens INTEGER NOT NULL DEFAULT 0,
+		send_hours TEXT NOT NULL DEFAULT '',
+		send_days TEXT NOT NULL DEFAULT '',
+		paused INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	);`
+
+func newTestHandlers(t *testing.T) *Handlers {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(testSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := secrets.Load(base64.StdEncoding.EncodeToString(make([]byte, 32)), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Handlers{db: db, keys: keys}
+}
+
+func TestSecretConfigKeysCoverSecretSettings(t *testing.T) {
+	for _, s := range settings.All {
+		if s.Secret && !secretConfigKeys[s.Key] {
+			t.Errorf("secret setting %s is not encrypted at rest", s.Key)
+		}
+	}
+}
+
+func TestSaveConfigEncryptsMailPasswords(t *testing.T) {
+	h := newTestHandlers(t)
+
+	err := h.saveConfig(map[string]string{
+		"smtp_password": "smtp-secret",
+		"imap_password": "imap-secret",
+		"smtp_host":     "mail.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, plain := range map[string]string{"smtp_password": "smtp-secret", "imap_password": "imap-secret"} {
+		var stored string
+		if err := h.db.QueryRow("SELECT value FROM config WHERE key = ?", key).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if !secrets.IsEncrypted(stored) || strings.Contains(stored, plain) {
+			t.Errorf("%s stored as %q, want ciphertext", key, stored)
+		}
+	}
+
+	overrides, err := h.loadOverrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overrides["smtp_password"] != "smtp-secret" {
+		t.Errorf("smtp_password = %q, want it decrypted", overrides["smtp_password"])
+	}
+	if overrides["smtp_host"] != "mail.example.com" {
+		t.Errorf("smtp_host = %q, want it stored as is", overrides["smtp_host"])
+	}
+}
+
+func TestReencryptSecretsMigratesPlaintextPassword(t *testing.T) {
+	h := newTestHandlers(t)
+
+	if _, err := h.db.Exec("INSERT INTO config (key, value) VALUES ('smtp_password', 'legacy')"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := h.reencryptSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("reencryptSecrets() = %d, want 1", n)
+	}
+
+	var stored string
+	if err := h.db.QueryRow("SELECT value FROM config WHERE key = 'smtp_password'").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !secrets.IsEncrypted(stored) {
+		t.Errorf("smtp_password stored as %q after re-encryption", stored)
+	}
+}
+
+func TestCrawlDelayOfZeroIsKept(t *testing.T) {
+	h := newTestHandlers(t)
+	layers, err := settings.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.settings = layers
+
+	crawlDelay := func() time.Duration {
+		t.Helper()
+		config, err := h.loadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crawlPolicyFromConfig(config).Delay
+	}
+
+	if got := crawlDelay(); got != defaultCrawlDelay {
+		t.Errorf("unset crawl delay = %v, want %v", got, defaultCrawlDelay)
+	}
+
+	if err := h.saveConfig(map[string]string{"crawl_delay_ms": "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.dropUnsetOverrides(); err != nil {
+		t.Fatal(err)
+	}
+	if got := crawlDelay(); got != 0 {
+		t.Errorf("crawl delay saved as 0 = %v, want no delay", got)
+	}
+
+	if err := h.saveConfig(map[string]string{"crawl_delay_ms": "-5"}); err == nil {
+		t.Error("saveConfig() accepted a negative crawl delay")
+	}
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+
+	"outreach-generator/internal/types"
+)
+
+// minWebsiteText is the amount of visible text below which a page is
+// reported as empty rather than usable for research.
+const minWebsiteText = 200
+
+var ErrNoContent = errors.New("no content found on the website")
+
+// websiteDiagnosis is the outcome of probing a contact's website. URL is the
+// variant that answered, so later fetches can skip the failed ones.
+type websiteDiagnosis struct {
+	URL    string
+	Status string
+	Detail string
+}
+
+// OK reports whether the website can be used for generation. A redirect to
+// another domain is only informational.
+func (d websiteDiagnosis) OK() bool {
+	return d.Status == types.WebsiteOK || d.Status == types.WebsiteRedirected
+}
+
+func (d websiteDiagnosis) Error() string {
+	return d.Detail
+}
+
+// Markers are matched against the lower-cased response body.
+var (
+	botProtectionMarkers = []string{
+		"cf-browser-verification",
+		"cf-chl-",
+		"challenge-platform",
+		"just a moment...",
+		"attention required! | cloudflare",
+		"ddos protection by",
+		"_incapsula_resource",
+		"perimeterx",
+		"px-captcha",
+		"sgcaptcha",
+		"captcha-delivery.com",
+		"please verify you are a human",
+	}
+	parkedMarkers = []string{
+		"this domain is for sale",
+		"this domain may be for sale",
+		"domain is for sale",
+		"buy this domain",
+		"the domain has expired",
+		"domain parking",
+		"parked free",
+		"parkingcrew",
+		"sedoparking",
+		"bodis.com",
+		"hugedomains",
+		"domena na sprzedaż",
+		"diese domain steht zum verkauf",
+		"ce domaine est à vendre",
+		"este dominio está a la venta",
+	}
+	parkingHosts = []string{
+		"sedo.com",
+		"dan.com",
+		"afternic.com",
+		"hugedomains.com",
+		"bodis.com",
+		"parkingcrew.net",
+		"godaddy.com",
+	}
+)
+
+// diagnoseWebsite probes https before http and the www. variant of the host,
+// and classifies the best outcome into one of the types.Website* categories.
+func (h *Handlers) diagnoseWebsite(config types.Config, website string) websiteDiagnosis {
+	normalized, err := h.fetch.normalizeWebsiteURL(website)
+	if err != nil {
+		return websiteDiagnosis{Status: types.WebsiteBlocked, Detail: err.Error()}
+	}
+
+	u, _ := url.Parse(normalized)
+	client := h.crawl.client(crawlPolicyFromConfig(config), 10*time.Second)
+
+	var best websiteDiagnosis
+	unresolved := map[string]bool{}
+	for _, candidate := range websiteVariants(u) {
+		if unresolved[candidate.Host] {
+			continue
+		}
+
+		diag := h.probeWebsite(client, candidate)
+		if diag.OK() {
+			return diag
+		}
+		if diag.Status == types.WebsiteDNSFailure {
+			unresolved[candidate.Host] = true
+		}
+		if best.Status == "" || diagnosisRank(diag.Status) > diagnosisRank(best.Status) {
+			best = diag
+		}
+	}
+	return best
+}
+
+// websiteVariants lists the URLs to try, in order of preference.
+func websiteVariants(u *url.URL) []*url.URL {
+	hosts := []string{u.Host}
+	switch {
+	case net.ParseIP(u.Hostname()) != nil || !strings.Contains(u.Hostname(), "."):
+		// Addresses and single-label hosts have no www. variant
+	case strings.HasPrefix(u.Host, "www."):
+		hosts = append(hosts, strings.TrimPrefix(u.Host, "www."))
+	default:
+		hosts = append(hosts, "www."+u.Host)
+	}
+
+	var variants []*url.URL
+	for _, h := range hosts {
+		for _, scheme := range []string{"https", "http"} {
+			v := *u
+			v.Scheme = scheme
+			v.Host = h
+			variants = append(variants, &v)
+		}
+	}
+	return variants
+}
+
+func (h *Handlers) probeWebsite(client *http.Client, u *url.URL) websiteDiagnosis {
+	diag := websiteDiagnosis{URL: u.String()}
+
+	resp, err := client.Get(u.String())
+	if err != nil {
+		diag.Status = classifyFetchError(err)
+		diag.Detail = describeWebsiteStatus(diag.Status, u.Hostname(), err)
+		return diag
+	}
+	defer resp.Body.Close()
+
+	final := resp.Request.URL
+	diag.URL = final.String()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 2<<20))
+	if err != nil {
+		diag.Status = classifyFetchError(err)
+		diag.Detail = describeWebsiteStatus(diag.Status, u.Hostname(), err)
+		return diag
+	}
+	lower := strings.ToLower(string(body))
+
+	switch {
+	case isParkingHost(final.Hostname()) || containsAny(lower, parkedMarkers):
+		diag.Status = types.WebsiteParked
+		diag.Detail = fmt.Sprintf("%s looks like a parked or for-sale domain", u.Hostname())
+	case isBotProtected(resp, lower):
+		diag.Status = types.WebsiteBotProtection
+		diag.Detail = fmt.Sprintf("%s is behind bot protection (status %d)", u.Hostname(), resp.StatusCode)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		diag.Status = types.WebsiteHTTPError
+		diag.Detail = fmt.Sprintf("website returned status code: %d", resp.StatusCode)
+	case len(visibleText(body)) < minWebsiteText:
+		diag.Status = types.WebsiteEmpty
+		diag.Detail = fmt.Sprintf("%s has almost no readable text", u.Hostname())
+	case !sameSite(u.Hostname(), final.Hostname()):
+		diag.Status = types.WebsiteRedirected
+		diag.Detail = fmt.Sprintf("redirects to %s", final.Hostname())
+	default:
+		diag.Status = types.WebsiteOK
+	}
+	return diag
+}
+
+// classifyFetchError maps transport errors to a website category.
+func classifyFetchError(err error) string {
+	var (
+		dnsErr     *net.DNSError
+		certErr    *tls.CertificateVerificationError
+		hostErr    x509.HostnameError
+		authErr    x509.UnknownAuthorityError
+		invalidErr x509.CertificateInvalidError
+		recordErr  tls.RecordHeaderError
+		netErr     net.Error
+	)
+
+	switch {
+	case errors.Is(err, ErrRobotsDisallowed):
+		return types.WebsiteRobots
+	case errors.Is(err, ErrBlockedDestination):
+		return types.WebsiteBlocked
+	case errors.Is(err, ErrNoContent):
+		return types.WebsiteEmpty
+	case errors.As(err, &dnsErr):
+		return types.WebsiteDNSFailure
+	case errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &authErr),
+		errors.As(err, &invalidErr), errors.As(err, &recordErr),
+		strings.Contains(err.Error(), "tls:"):
+		return types.WebsiteTLSError
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return types.WebsiteTimeout
+	}
+	return types.WebsiteUnreachable
+}
+
+func describeWebsiteStatus(status, host string, err error) string {
+	switch status {
+	case types.WebsiteRobots:
+		return "the website disallows crawling in robots.txt"
+	case types.WebsiteBlocked:
+		return err.Error()
+	case types.WebsiteDNSFailure:
+		return fmt.Sprintf("DNS lookup failed for %s", host)
+	case types.WebsiteTLSError:
+		return fmt.Sprintf("TLS error for %s: %v", host, err)
+	case types.WebsiteTimeout:
+		return fmt.Sprintf("%s timed out", host)
+	case types.WebsiteEmpty:
+		return fmt.Sprintf("%s has almost no readable text", host)
+	}
+	return fmt.Sprintf("website unavailable: %v", err)
+}
+
+// diagnosisRank orders failures by how far the request got, so the most
+// informative one is reported when every variant fails.
+func diagnosisRank(status string) int {
+	switch status {
+	case types.WebsiteRobots, types.WebsiteBlocked:
+		return 9
+	case types.WebsiteParked:
+		return 8
+	case types.WebsiteBotProtection:
+		return 7
+	case types.WebsiteEmpty:
+		return 6
+	case types.WebsiteHTTPError:
+		return 5
+	case types.WebsiteTLSError:
+		return 4
+	case types.WebsiteTimeout:
+		return 3
+	case types.WebsiteUnreachable:
+		return 2
+	case types.WebsiteDNSFailure:
+		return 1
+	}
+	return 0
+}
+
+func isBotProtected(resp *http.Response, body string) bool {
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if resp.Header.Get("cf-mitigated") != "" || resp.Header.Get("cf-ray") != "" ||
+			strings.Contains(strings.ToLower(resp.Header.Get("Server")), "cloudflare") {
+			return true
+		}
+	}
+	return containsAny(body, botProtectionMarkers) && len(visibleText([]byte(body))) < 2000
+}
+
+func isParkingHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, p := range parkingHosts {
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameSite treats hosts differing only by a www. prefix as the same site.
+func sameSite(a, b string) bool {
+	a = strings.TrimPrefix(strings.ToLower(a), "www.")
+	b = strings.TrimPrefix(strings.ToLower(b), "www.")
+	return a == b
+}
+
+// visibleText returns the page text without scripts, styles and markup.
+func visibleText(body []byte) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(body)))
+	if err != nil {
+		return ""
+	}
+	doc.Find("script, style, noscript, template").Remove()
+	return strings.Join(strings.Fields(doc.Find("body").Text()), " ")
+}
+
+func containsAny(s string, markers []string) bool {
+	for _, m := range markers {
+		if strings.Contains(s, m) {
+			return true
+		}
+	}
+	return false
+}
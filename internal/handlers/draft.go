@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+// draftFileChars are the characters kept when naming a draft after its
+// company.
+var draftFileChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// draftMessage builds a contact's approved outreach as a draft for the
+// rep's own mail client. Unlike a message sent here it has no Message-ID,
+// which the client adds when sending, and no from address unless one is
+// configured, so the client's account is used.
+func draftMessage(config types.Config, contact types.Contact) (outgoingMessage, error) {
+	if contact.OutreachStatus != types.OutreachApproved {
+		return outgoingMessage{}, errors.New("only approved outreach can be exported as a draft")
+	}
+	msg, err := composeOutreach(config, contact)
+	msg.Draft = true
+	return msg, err
+}
+
+// draftFileName names a contact's draft after their company.
+func draftFileName(contact types.Contact) string {
+	name := strings.Trim(draftFileChars.ReplaceAllString(strings.ToLower(contact.CompanyName), "-"), "-")
+	if name == "" {
+		name = strings.Trim(draftFileChars.ReplaceAllString(strings.ToLower(contact.ID), "-"), "-")
+	}
+	return "outreach-" + name + ".eml"
+}
+
+// writeMbox writes the approved drafts of contacts as an mbox file, one
+// message after the other, and returns how many it wrote. Encoded messages
+// have no lines starting "From ", so they are stored unchanged. Contacts
+// whose draft cannot be built are left out.
+func writeMbox(w io.Writer, config types.Config, contacts []types.Contact) (int, error) {
+	written := 0
+	for _, contact := range contacts {
+		if contact.OutreachStatus != types.OutreachApproved {
+			continue
+		}
+		msg, err := draftMessage(config, contact)
+		if err != nil {
+			log.Printf("Leaving %s out of the mbox export: %v", contact.ID, err)
+			continue
+		}
+		data, err := msg.encode()
+		if err != nil {
+			return written, err
+		}
+
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "From MAILER-DAEMON %s\n", msg.Date.UTC().Format(time.ANSIC))
+		b.WriteString(strings.ReplaceAll(strings.TrimRight(string(data), "\r\n"), "\r\n", "\n"))
+		b.WriteString("\n\n")
+		if _, err := w.Write(b.Bytes()); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+// HandleDownloadDraft downloads a contact's approved outreach as an .eml
+// file that mail clients open as a draft ready to send.
+func (h *Handlers) HandleDownloadDraft() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contact, _, err := h.requestContact(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+		msg, err := draftMessage(config, contact)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := msg.encode()
+		if err != nil {
+			http.Error(w, "Failed to encode the draft", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", draftFileName(contact)))
+		w.Write(data)
+	}
+}
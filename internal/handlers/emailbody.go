@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"outreach-generator/internal/types"
+)
+
+var (
+	// linkPattern finds the links of outreach text: Markdown links, bare
+	// http(s) URLs, www. hosts and email addresses
+	linkPattern = regexp.MustCompile(`\[([^\]\n]+)\]\((https?://[^\s()]+)\)|https?://[^\s<>"]+|www\.[^\s<>"]+|[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	// paragraphBreak separates paragraphs of plain text
+	paragraphBreak = regexp.MustCompile(`\n\s*\n`)
+)
+
+// signatureSeparator is the line mail clients recognise as the start of a
+// signature.
+const signatureSeparator = "-- "
+
+// emailLink is a link found in outreach text. Label is what the reader
+// sees, which for anything but a Markdown link is the address itself.
+type emailLink struct {
+	Label string
+	Href  string
+}
+
+// renderEmail turns a plain text body into what is sent: the text with the
+// signature, and unless the format is text also an HTML version of both.
+// Markdown links become "label (address)" in the text.
+func renderEmail(config types.Config, body string) (text, htmlBody string) {
+	body = normalizeNewlines(body)
+	signature := normalizeNewlines(config.EmailSignature)
+
+	text = linkPattern.ReplaceAllStringFunc(body, func(match string) string {
+		link, ok := parseLink(match)
+		switch {
+		case !ok || !strings.HasPrefix(match, "["):
+			return match
+		case link.Label == link.Href:
+			return link.Href
+		}
+		return link.Label + " (" + link.Href + ")"
+	})
+	if signature != "" {
+		text += "\n\n" + signatureSeparator + "\n" + signature
+	}
+	if config.EmailFormat == types.EmailText {
+		return text, ""
+	}
+
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"></head>\n")
+	b.WriteString(`<body style="font-family: Arial, Helvetica, sans-serif; font-size: 14px; line-height: 1.5; color: #222222;">` + "\n")
+	b.WriteString(htmlParagraphs(body))
+	if signature != "" {
+		b.WriteString(`<div style="margin-top: 24px; padding-top: 12px; border-top: 1px solid #dddddd; color: #666666; font-size: 13px;">` + "\n")
+		b.WriteString(htmlParagraphs(signature))
+		b.WriteString("</div>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	return text, b.String()
+}
+
+func normalizeNewlines(s string) string {
+	return strings.TrimSpace(strings.ReplaceAll(s, "\r\n", "\n"))
+}
+
+// htmlParagraphs renders plain text as HTML paragraphs, with line breaks
+// kept, every character escaped and links made clickable.
+func htmlParagraphs(text string) string {
+	var b strings.Builder
+	for _, para := range paragraphBreak.Split(text, -1) {
+		if strings.TrimSpace(para) == "" {
+			continue
+		}
+		lines := strings.Split(para, "\n")
+		for i, line := range lines {
+			lines[i] = htmlLine(line)
+		}
+		b.WriteString(`<p style="margin: 0 0 14px 0;">` + strings.Join(lines, "<br>\n") + "</p>\n")
+	}
+	return b.String()
+}
+
+// htmlLine escapes a line of text and links what parseLink accepts. Anything
+// else, such as a javascript: address, stays text.
+func htmlLine(line string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range linkPattern.FindAllStringIndex(line, -1) {
+		link, ok := parseLink(line[m[0]:m[1]])
+		if !ok {
+			continue
+		}
+		// Punctuation that ends a sentence is not part of a bare address
+		end := m[0] + len(linkMatch(line[m[0]:m[1]]))
+		b.WriteString(html.EscapeString(line[last:m[0]]))
+		b.WriteString(`<a href="` + html.EscapeString(link.Href) + `" target="_blank" rel="noopener noreferrer">` + html.EscapeString(link.Label) + "</a>")
+		last = end
+	}
+	b.WriteString(html.EscapeString(line[last:]))
+	return b.String()
+}
+
+// linkMatch drops trailing punctuation from a bare address, which usually
+// ends the sentence rather than the address.
+func linkMatch(match string) string {
+	if strings.HasPrefix(match, "[") {
+		return match
+	}
+	return strings.TrimRight(match, ".,;:!?)'\"")
+}
+
+// parseLink reads a match of linkPattern. Only http, https and mailto
+// addresses with a host and no user info are links: "https://bank.com@evil"
+// would show one host and open another. A Markdown label that looks like an
+// address of a different host is replaced by the real address for the same
+// reason.
+func parseLink(match string) (emailLink, bool) {
+	if sub := linkPattern.FindStringSubmatch(match); sub != nil && sub[1] != "" {
+		link, ok := safeLink(sub[2])
+		if !ok {
+			return emailLink{}, false
+		}
+		label := strings.TrimSpace(sub[1])
+		if looksLikeAddress(label) && labelHost(label) != hostOf(link.Href) {
+			label = link.Href
+		}
+		return emailLink{Label: label, Href: link.Href}, true
+	}
+
+	match = linkMatch(match)
+	switch {
+	case strings.HasPrefix(match, "http://"), strings.HasPrefix(match, "https://"):
+		return safeLink(match)
+	case strings.HasPrefix(match, "www."):
+		link, ok := safeLink("https://" + match)
+		link.Label = match
+		return link, ok
+	case strings.Contains(match, "@"):
+		return emailLink{Label: match, Href: "mailto:" + match}, true
+	}
+	return emailLink{}, false
+}
+
+func safeLink(raw string) (emailLink, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return emailLink{}, false
+	}
+	return emailLink{Label: raw, Href: u.String()}, true
+}
+
+func looksLikeAddress(label string) bool {
+	return !strings.Contains(label, " ") && strings.Contains(label, ".")
+}
+
+// labelHost is the host a label that looks like an address names, read as
+// a URL the way a reader would: "www.bank.com/evil.io" names bank.com.
+func labelHost(label string) string {
+	if !strings.Contains(label, "://") {
+		label = "https://" + label
+	}
+	return hostOf(label)
+}
+
+func hostOf(href string) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import "testing"
+
+func TestParseLinkReplacesSpoofedLabels(t *testing.T) {
+	tests := []struct {
+		match string
+		label string
+	}{
+		{"[our website](https://evil.io)", "our website"},
+		{"[evil.io](https://evil.io/offer)", "evil.io"},
+		{"[www.evil.io](https://evil.io)", "www.evil.io"},
+		{"[https://www.evil.io/offer](https://evil.io/offer)", "https://www.evil.io/offer"},
+		{"[bank.com](https://evil.io)", "https://evil.io"},
+		{"[www.bank.com/evil.io](https://evil.io)", "https://evil.io"},
+		{"[evil.io.bank.com](https://evil.io)", "https://evil.io"},
+		{"[bank.com?evil.io](https://evil.io)", "https://evil.io"},
+	}
+
+	for _, tt := range tests {
+		link, ok := parseLink(tt.match)
+		if !ok {
+			t.Errorf("parseLink(%q) is not a link", tt.match)
+			continue
+		}
+		if link.Label != tt.label {
+			t.Errorf("parseLink(%q) label = %q, want %q", tt.match, link.Label, tt.label)
+		}
+	}
+}
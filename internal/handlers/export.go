@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+// Export formats
+const (
+	exportCSV   = "csv"
+	exportJSONL = "jsonl"
+	exportXLSX  = "xlsx"
+	exportMbox  = "mbox"
+)
+
+// exportColumn is a column contacts can be exported with.
+type exportColumn struct {
+	Name  string
+	Value func(c types.Contact) string
+}
+
+func outreachSubject(c types.Contact) string {
+	subject, _ := parseOutreach(c.OutreachText)
+	return subject
+}
+
+func outreachBody(c types.Contact) string {
+	_, body := parseOutreach(c.OutreachText)
+	return body
+}
+
+// exportColumns lists every column an export can have, in the order the
+// settings page documents them.
+var exportColumns = []exportColumn{
+	{"id", func(c types.Contact) string { return c.ID }},
+	{"source", func(c types.Contact) string { return c.Source }},
+	{"company_name", func(c types.Contact) string { return c.CompanyName }},
+	{"fullname", func(c types.Contact) string { return c.Fullname }},
+	{"business_segment", func(c types.Contact) string { return c.BusinessSegment }},
+	{"email", func(c types.Contact) string { return c.Email }},
+	{"phone", func(c types.Contact) string { return c.Phone }},
+	{"website", func(c types.Contact) string { return c.Website }},
+	{"city", func(c types.Contact) string { return c.City }},
+	{"country", func(c types.Contact) string { return c.Country }},
+	{"subject", outreachSubject},
+	{"body", outreachBody},
+	{"status", func(c types.Contact) string { return c.OutreachStatus }},
+	{"model", func(c types.Contact) string { return c.OutreachModel }},
+	{"generated_at", func(c types.Contact) string { return c.GeneratedAt }},
+	{"created_time", func(c types.Contact) string { return c.CreatedTime }},
+	{"website_status", func(c types.Contact) string { return c.WebsiteStatus }},
+}
+
+// exportColumnNames lists the names of every export column.
+func exportColumnNames() []string {
+	names := make([]string, len(exportColumns))
+	for i, c := range exportColumns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// parseExportColumns resolves a comma separated list of column names.
+func parseExportColumns(list string) ([]exportColumn, error) {
+	var columns []exportColumn
+	for _, name := range splitList(list) {
+		found := false
+		for _, c := range exportColumns {
+			if strings.EqualFold(c.Name, name) {
+				columns = append(columns, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q, known columns are %s", name, strings.Join(exportColumnNames(), ", "))
+		}
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns given")
+	}
+	return columns, nil
+}
+
+// exportFilter is the part of the home page's filters an export honours.
+// An empty field matches every contact; "unchecked" matches contacts whose
+// website or outreach has no status yet.
+type exportFilter struct {
+	WebsiteStatus  string
+	OutreachStatus string
+}
+
+func (f exportFilter) matches(c types.Contact) bool {
+	return statusMatches(f.WebsiteStatus, c.WebsiteStatus) && statusMatches(f.OutreachStatus, c.OutreachStatus)
+}
+
+func statusMatches(wanted, status string) bool {
+	switch wanted {
+	case "":
+		return true
+	case "unchecked":
+		return status == ""
+	}
+	return wanted == status
+}
+
+// writeExport writes contacts in one of the export formats.
+func writeExport(w io.Writer, format string, columns []exportColumn, contacts []types.Contact) error {
+	if format == exportJSONL {
+		return writeJSONLines(w, columns, contacts)
+	}
+
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.Name
+	}
+	records := [][]string{header}
+	for _, contact := range contacts {
+		record := make([]string, len(columns))
+		for i, c := range columns {
+			record[i] = c.Value(contact)
+		}
+		records = append(records, record)
+	}
+
+	if format == exportXLSX {
+		return writeXLSX(w, "Contacts", records)
+	}
+	return writeCSV(w, ",", records)
+}
+
+// writeJSONLines writes one JSON object per contact with the columns in
+// their configured order.
+func writeJSONLines(w io.Writer, columns []exportColumn, contacts []types.Contact) error {
+	for _, contact := range contacts {
+		var b strings.Builder
+		b.WriteString("{")
+		for i, c := range columns {
+			key, _ := json.Marshal(c.Name)
+			value, err := json.Marshal(c.Value(contact))
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.Write(key)
+			b.WriteString(":")
+			b.Write(value)
+		}
+		b.WriteString("}\n")
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleExport downloads the contacts of a source with their outreach as
+// CSV, JSON Lines or XLSX, or their approved drafts as mbox. The website
+// and outreach status filters of the home page are applied, and the columns
+// come from the export_columns setting unless the request lists its own.
+func (h *Handlers) HandleExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		format := query.Get("format")
+		contentType := map[string]string{
+			exportCSV:   "text/csv; charset=utf-8",
+			exportJSONL: "application/x-ndjson",
+			exportXLSX:  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+			exportMbox:  "application/mbox",
+		}[format]
+		if contentType == "" {
+			http.Error(w, "format must be csv, jsonl, xlsx or mbox", http.StatusBadRequest)
+			return
+		}
+
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+		list := config.ExportColumns
+		if query.Get("columns") != "" {
+			list = query.Get("columns")
+		}
+		columns, err := parseExportColumns(list)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		source, err := h.contactSource(query.Get("source"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contacts, err := source.Contacts()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		filter := exportFilter{
+			WebsiteStatus:  query.Get("website_status"),
+			OutreachStatus: query.Get("outreach_status"),
+		}
+		var selected []types.Contact
+		for _, c := range contacts {
+			if filter.matches(c) {
+				selected = append(selected, c)
+			}
+		}
+
+		name := fmt.Sprintf("outreach-%s.%s", time.Now().Format("2006-01-02"), format)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		if format == exportMbox {
+			if _, err := writeMbox(w, config, selected); err != nil {
+				log.Printf("Error writing mbox export: %v", err)
+			}
+			return
+		}
+		if err := writeExport(w, format, columns, selected); err != nil {
+			log.Printf("Error writing %s export: %v", format, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"outreach-generator/internal/types"
+)
+
+// researchWebsite diagnoses and fetches the contact's website. When the
+// website cannot be used and a fallback mode is configured, it returns the
+// fallback research instead and flags the contact as lower confidence.
+func (h *Handlers) researchWebsite(config types.Config, contact *types.Contact) (string, bool) {
+	diag := h.diagnoseWebsite(config, contact.Website)
+	applyDiagnosis(contact, diag)
+
+	if diag.OK() {
+		content, err := h.fetchWebsiteContent(config, diag.URL)
+		if err == nil {
+			if err := h.saveWebsiteCache(contact.Website, content); err != nil {
+				log.Printf("Warning: Failed to cache website content: %v", err)
+			}
+			return content, true
+		}
+		log.Printf("Error fetching website content: %v", err)
+		setWebsiteError(contact, err)
+	}
+
+	return h.fallbackResearch(config, contact)
+}
+
+// fallbackResearch builds research for a contact whose website is unusable:
+// a cached copy of the website when we have one, otherwise (in contact data
+// mode) only the contact fields and business segment.
+func (h *Handlers) fallbackResearch(config types.Config, contact *types.Contact) (string, bool) {
+	if config.FallbackMode == "" || config.FallbackMode == types.FallbackOff {
+		return "", false
+	}
+
+	// A robots.txt disallow also rules out content we crawled before it
+	if contact.WebsiteStatus != types.WebsiteRobots {
+		content, fetchedAt, err := h.loadWebsiteCache(contact.Website)
+		if err != nil {
+			log.Printf("Warning: Failed to load cached website content: %v", err)
+		}
+		if content != "" {
+			date := fetchedAt.Format("2006-01-02")
+			markFallback(contact, fmt.Sprintf("cached website content from %s", date))
+			return fmt.Sprintf("%s\n\n(Cached copy from %s. The live website is currently unavailable, so do not mention recent changes.)",
+				content, date), true
+		}
+	}
+
+	if config.FallbackMode != types.FallbackContactData {
+		return "", false
+	}
+
+	markFallback(contact, "contact details and business segment only")
+	return contactResearch(*contact), true
+}
+
+// canFallback reports whether fallbackResearch would produce something for
+// the contact, so the UI can keep the generate button enabled.
+func (h *Handlers) canFallback(config types.Config, contact types.Contact) bool {
+	switch config.FallbackMode {
+	case types.FallbackContactData:
+		return true
+	case types.FallbackCached:
+		if contact.WebsiteStatus == types.WebsiteRobots {
+			return false
+		}
+		content, _, err := h.loadWebsiteCache(contact.Website)
+		return err == nil && content != ""
+	}
+	return false
+}
+
+// markFallback replaces the website error with a lower-confidence flag. The
+// website status and detail stay on the contact to explain why.
+func markFallback(contact *types.Contact, source string) {
+	contact.Error = ""
+	contact.ErrorKind = ""
+	contact.LowConfidence = true
+	contact.FallbackSource = source
+}
+
+// contactResearch describes what we know about a contact without its website,
+// in the spirit of the old "focus on the business segment" note.
+func contactResearch(contact types.Contact) string {
+	var b strings.Builder
+	b.WriteString("Website content was not available. Focus on the business segment and company name to generate relevant outreach, and do not claim to have read their website.\n\n")
+	b.WriteString("Known details about the company:\n")
+	fmt.Fprintf(&b, "- Company: %s\n", contact.CompanyName)
+	if contact.BusinessSegment != "" {
+		fmt.Fprintf(&b, "- Business Segment: %s\n", contact.BusinessSegment)
+	}
+	if location := joinNonEmpty(", ", contact.City, contact.Country); location != "" {
+		fmt.Fprintf(&b, "- Location: %s\n", location)
+	}
+	if at := strings.LastIndex(contact.Email, "@"); at >= 0 {
+		fmt.Fprintf(&b, "- Email domain: %s\n", contact.Email[at+1:])
+	}
+	if contact.Website != "" {
+		fmt.Fprintf(&b, "- Website address: %s\n", contact.Website)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	var kept []string
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, sep)
+}
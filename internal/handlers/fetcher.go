@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"outreach-generator/internal/settings"
+)
+
+var ErrBlockedDestination = errors.New("destination not allowed")
+
+// blockedNetworks lists ranges that are not covered by the net.IP helpers
+// but must never be reached from user supplied URLs.
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+)
+
+// fetchPolicy guards every outbound request made on behalf of a contact
+// website. The destination is resolved before dialing and each address is
+// checked, so redirects and DNS tricks are covered by the same rules.
+type fetchPolicy struct {
+	schemes    map[string]bool
+	ports      map[string]bool
+	allowNets  []*net.IPNet
+	allowHosts map[string]bool
+	resolver   *net.Resolver
+	dialer     *net.Dialer
+}
+
+func newFetchPolicy() *fetchPolicy {
+	return &fetchPolicy{
+		schemes:    map[string]bool{"http": true, "https": true},
+		ports:      map[string]bool{"80": true, "443": true},
+		allowHosts: map[string]bool{},
+		resolver:   net.DefaultResolver,
+		dialer:     &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second},
+	}
+}
+
+// fetchPolicyFromSettings builds the default policy and applies the overrides
+// meant for internal testing:
+//
+//	fetch_allowlist      comma separated hosts or CIDRs allowed even if private
+//	fetch_allowed_ports  comma separated extra ports besides 80 and 443
+func fetchPolicyFromSettings(layers *settings.Layers) *fetchPolicy {
+	p := newFetchPolicy()
+	for _, entry := range splitList(layers.Get("fetch_allowlist")) {
+		p.allow(entry)
+	}
+	for _, port := range splitList(layers.Get("fetch_allowed_ports")) {
+		p.ports[port] = true
+	}
+	return p
+}
+
+// allow adds a host name, IP address or CIDR to the allowlist.
+func (p *fetchPolicy) allow(entry string) {
+	if _, n, err := net.ParseCIDR(entry); err == nil {
+		p.allowNets = append(p.allowNets, n)
+		return
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		p.allowNets = append(p.allowNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return
+	}
+	p.allowHosts[strings.ToLower(entry)] = true
+}
+
+// checkURL validates the scheme and port of a URL before any request is made.
+func (p *fetchPolicy) checkURL(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	if !p.schemes[scheme] {
+		return fmt.Errorf("%w: scheme %q", ErrBlockedDestination, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w: missing host", ErrBlockedDestination)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in URL", ErrBlockedDestination)
+	}
+
+	port := u.Port()
+	if port == "" {
+		return nil
+	}
+	if !p.ports[port] && !p.allowlisted(u.Hostname()) {
+		return fmt.Errorf("%w: port %s", ErrBlockedDestination, port)
+	}
+	return nil
+}
+
+// allowlisted reports whether a host name or literal address was explicitly
+// allowed through FETCH_ALLOWLIST.
+func (p *fetchPolicy) allowlisted(host string) bool {
+	if p.allowHosts[strings.ToLower(host)] {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range p.allowNets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkIP rejects loopback, private, link-local and other special ranges
+// unless the host or address was explicitly allowlisted.
+func (p *fetchPolicy) checkIP(host string, ip net.IP) error {
+	if p.allowHosts[strings.ToLower(host)] {
+		return nil
+	}
+	for _, n := range p.allowNets {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s resolves to %s", ErrBlockedDestination, host, ip)
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrBlockedDestination, host, ip)
+		}
+	}
+	return nil
+}
+
+// dialContext resolves the host itself and connects to a vetted address, so
+// the IP that was checked is the IP that gets dialed.
+func (p *fetchPolicy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !p.ports[port] && !p.allowlisted(host) {
+		return nil, fmt.Errorf("%w: port %s", ErrBlockedDestination, port)
+	}
+
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	for _, a := range addrs {
+		if err := p.checkIP(host, a.IP); err != nil {
+			return nil, err
+		}
+	}
+
+	var lastErr error
+	for _, a := range addrs {
+		conn, err := p.dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (p *fetchPolicy) transport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 nil,
+		DialContext:           p.dialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// checkRedirect applies the URL rules to every hop of a redirect chain.
+func (p *fetchPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("too many redirects")
+	}
+	return p.checkURL(req.URL)
+}
+
+func (p *fetchPolicy) client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     p.transport(),
+		CheckRedirect: p.checkRedirect,
+	}
+}
+
+// normalizeWebsiteURL adds a scheme to bare domains and validates the result
+// against the fetch policy.
+func (p *fetchPolicy) normalizeWebsiteURL(website string) (string, error) {
+	website = strings.TrimSpace(website)
+	if !strings.Contains(website, "://") {
+		website = "http://" + website
+	}
+
+	u, err := url.Parse(website)
+	if err != nil {
+		return "", fmt.Errorf("invalid website URL: %w", err)
+	}
+	if err := p.checkURL(u); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+// schemaWriteScope is needed to create fields through the Meta API.
+const schemaWriteScope = "schema.bases:write"
+
+// outputFieldSpec describes an output field: how to create it and which
+// existing field types can hold its value.
+type outputFieldSpec struct {
+	// Metadata is the metadata item the field holds, empty for the body
+	Metadata string
+	Label    string
+	Name     string
+	Type     string
+	Options  map[string]interface{}
+	Accepts  []string
+}
+
+func outputFieldSpecs(config types.Config) []outputFieldSpec {
+	choices := make([]map[string]string, len(types.OutreachStatuses))
+	for i, status := range types.OutreachStatuses {
+		choices[i] = map[string]string{"name": status}
+	}
+
+	specs := []outputFieldSpec{
+		{
+			Label:   "Body",
+			Name:    config.AirtableBodyField,
+			Type:    "multilineText",
+			Accepts: []string{"multilineText", "richText", "singleLineText"},
+		},
+		{
+			Metadata: types.MetadataSubject,
+			Label:    "Subject",
+			Name:     config.AirtableSubjectField,
+			Type:     "singleLineText",
+			Accepts:  []string{"singleLineText", "multilineText"},
+		},
+		{
+			Metadata: types.MetadataStatus,
+			Label:    "Status",
+			Name:     config.AirtableStatusField,
+			Type:     "singleSelect",
+			Options:  map[string]interface{}{"choices": choices},
+			Accepts:  []string{"singleSelect", "singleLineText"},
+		},
+		{
+			Metadata: types.MetadataGeneratedAt,
+			Label:    "Generated at",
+			Name:     config.AirtableGeneratedAtField,
+			Type:     "dateTime",
+			Options: map[string]interface{}{
+				"dateFormat": map[string]string{"name": "iso"},
+				"timeFormat": map[string]string{"name": "24hour"},
+				"timeZone":   "utc",
+			},
+			Accepts: []string{"dateTime", "date", "singleLineText"},
+		},
+		{
+			Metadata: types.MetadataModel,
+			Label:    "Model",
+			Name:     config.AirtableModelField,
+			Type:     "singleLineText",
+			Accepts:  []string{"singleLineText", "multilineText"},
+		},
+		{
+			Metadata: types.MetadataTemplate,
+			Label:    "Template",
+			Name:     config.AirtableTemplateField,
+			Type:     "multilineText",
+			Accepts:  []string{"multilineText", "richText", "singleLineText"},
+		},
+		{
+			Metadata: types.MetadataError,
+			Label:    "Error",
+			Name:     config.AirtableErrorField,
+			Type:     "multilineText",
+			Accepts:  []string{"multilineText", "singleLineText"},
+		},
+	}
+
+	// Only the body and the enabled metadata are needed
+	enabled := specs[:0]
+	for _, spec := range specs {
+		if spec.Name != "" && (spec.Metadata == "" || metadataEnabled(config, spec.Metadata)) {
+			enabled = append(enabled, spec)
+		}
+	}
+	return enabled
+}
+
+// checkOutputFields compares the specs with the table schema.
+func checkOutputFields(schema *types.TableSchema, specs []outputFieldSpec) []types.OutputField {
+	fields := make([]types.OutputField, 0, len(specs))
+	for _, spec := range specs {
+		f := types.OutputField{Label: spec.Label, Name: spec.Name, Type: spec.Type}
+		if existing, ok := schema.Field(spec.Name); ok {
+			f.Exists = true
+			f.ActualType = existing.Type
+			for _, t := range spec.Accepts {
+				if t == existing.Type {
+					f.Compatible = true
+				}
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// HandleOutputFields shows which output fields exist in the Airtable table.
+func (h *Handlers) HandleOutputFields() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+
+		fields, err := h.outputFieldStatus(config)
+		if err != nil {
+			components.PickerError(err.Error()).Render(r.Context(), w)
+			return
+		}
+		components.OutputFields(fields, "", nil).Render(r.Context(), w)
+	}
+}
+
+// HandleCreateOutputFields creates the missing output fields with the Meta
+// API. Fields that exist with another type are left alone.
+func (h *Handlers) HandleCreateOutputFields() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+
+		schema, err := h.requireAirtableSchema(config)
+		if err != nil {
+			components.PickerError(err.Error()).Render(r.Context(), w)
+			return
+		}
+		specs := outputFieldSpecs(config)
+		fields := checkOutputFields(schema, specs)
+
+		// Check the scope up front so the user gets one clear message instead
+		// of a 403 per field
+		if _, scopes, err := airtableWhoami(config); err == nil && scopes != nil && !hasScope(scopes, schemaWriteScope) {
+			components.OutputFields(fields, "", []string{
+				fmt.Sprintf("The access token does not have the %s scope, which is needed to create fields. Add it at airtable.com/create/tokens, or create the fields listed above by hand.", schemaWriteScope),
+			}).Render(r.Context(), w)
+			return
+		}
+
+		var created []string
+		var errs []string
+		for i, spec := range specs {
+			if fields[i].Exists {
+				continue
+			}
+			if err := createAirtableField(config, schema.ID, spec); err != nil {
+				log.Printf("Error creating Airtable field %s: %v", spec.Name, err)
+				errs = append(errs, fmt.Sprintf("%s: %s", spec.Name,
+					describeAPIError(err, fmt.Sprintf("Creating fields needs the %s scope", schemaWriteScope))))
+				continue
+			}
+			created = append(created, spec.Name)
+		}
+
+		if fields, err = h.outputFieldStatus(config); err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		message := "All output fields already exist."
+		if len(created) > 0 {
+			message = "Created " + strings.Join(created, ", ") + "."
+		} else if len(errs) > 0 {
+			message = ""
+		}
+		components.OutputFields(fields, message, errs).Render(r.Context(), w)
+	}
+}
+
+func (h *Handlers) outputFieldStatus(config types.Config) ([]types.OutputField, error) {
+	schema, err := h.requireAirtableSchema(config)
+	if err != nil {
+		return nil, err
+	}
+	return checkOutputFields(schema, outputFieldSpecs(config)), nil
+}
+
+func (h *Handlers) requireAirtableSchema(config types.Config) (*types.TableSchema, error) {
+	if config.AirtableAccessToken == "" || config.AirtableBaseID == "" || config.AirtableTableName == "" {
+		return nil, errors.New("Configure the Airtable token, base and table first.")
+	}
+	schema, err := h.fetchAirtableSchema(config)
+	if err != nil {
+		log.Printf("Error fetching Airtable schema: %v", err)
+		return nil, fmt.Errorf("Could not read the table schema: %s", describeAPIError(err, "the token needs the schema.bases:read scope"))
+	}
+	return schema, nil
+}
+
+// createAirtableField adds a field to a table with the Meta API.
+func createAirtableField(config types.Config, tableID string, spec outputFieldSpec) error {
+	endpoint := fmt.Sprintf("%s/meta/bases/%s/tables/%s/fields", airtableAPI,
+		url.PathEscape(config.AirtableBaseID), url.PathEscape(tableID))
+
+	payload := map[string]interface{}{
+		"name":        spec.Name,
+		"type":        spec.Type,
+		"description": fmt.Sprintf("Outreach %s, written by the outreach generator", strings.ToLower(spec.Label)),
+	}
+	if spec.Options != nil {
+		payload["options"] = spec.Options
+	}
+	return airtableRequest(config, "POST", endpoint, payload, nil)
+}
+
+// airtableWhoami returns the token's user ID and scopes. Scopes is nil when
+// Airtable does not report them.
+func airtableWhoami(config types.Config) (string, []string, error) {
+	var whoami struct {
+		ID     string   `json:"id"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := airtableRequest(config, "GET", airtableAPI+"/meta/whoami", nil, &whoami); err != nil {
+		return "", nil, err
+	}
+	return whoami.ID, whoami.Scopes, nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
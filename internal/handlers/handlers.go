@@ -2,14 +2,52 @@ package handlers
 
 import (
 	"database/sql"
+	"log"
+
+	"outreach-generator/internal/secrets"
+	"outreach-generator/internal/settings"
 )
 
 type Handlers struct {
-	db *sql.DB
+	db       *sql.DB
+	keys     *secrets.Keyring
+	settings *settings.Layers
+	fetch    *fetchPolicy
+	crawl    *crawler
+	sync     *contactSyncer
+	sends    *sendScheduler
+	inbox    *contactSyncer
 }
 
-func New(db *sql.DB) *Handlers {
-	return &Handlers{
-		db: db,
+func New(db *sql.DB, keys *secrets.Keyring, layers *settings.Layers) *Handlers {
+	fetch := fetchPolicyFromSettings(layers)
+	h := &Handlers{
+		db:       db,
+		keys:     keys,
+		settings: layers,
+		fetch:    fetch,
+		crawl:    newCrawler(fetch),
+		sync:     &contactSyncer{},
+		sends:    &sendScheduler{},
+		inbox:    &contactSyncer{},
+	}
+
+	if n, err := h.dropUnsetOverrides(); err != nil {
+		log.Printf("Warning: Failed to clean up config overrides: %v", err)
+	} else if n > 0 {
+		log.Printf("Removed %d empty config overrides", n)
 	}
+
+	// Encrypt secrets saved before encryption existed or under an old key
+	if n, err := h.reencryptSecrets(); err != nil {
+		log.Printf("Warning: Failed to re-encrypt secrets: %v", err)
+	} else if n > 0 {
+		log.Printf("Re-encrypted %d secrets with key %s", n, keys.CurrentKeyID())
+	}
+
+	go h.scheduleSync()
+	go h.scheduleSends()
+	go h.scheduleInboxChecks()
+
+	return h
 }
@@ -1,38 +1,195 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+
 	"outreach-generator/internal/components"
 	"outreach-generator/internal/types"
 )
 
+// outreachRequest is the body of a single generation request.
+type outreachRequest struct {
+	Website     string `json:"website"`
+	Prompt      string `json:"prompt"`
+	RecordID    string `json:"recordId"`
+	Language    string `json:"language"`
+	Profile     string `json:"profile"` // sender profile ID, empty for the default one
+	ContactInfo struct {
+		Name    string `json:"name"`
+		Company string `json:"company"`
+		Segment string `json:"segment"`
+		City    string `json:"city"`
+		Country string `json:"country"`
+		Email   string `json:"email"`
+	} `json:"contactInfo"`
+}
+
+// fillContact takes the details of the contact a request left empty from
+// the mirror, so the contact card only needs to send the record ID.
+func (req *outreachRequest) fillContact(contact types.Contact) {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&req.Website, contact.Website)
+	fill(&req.ContactInfo.Name, contact.Fullname)
+	fill(&req.ContactInfo.Company, contact.CompanyName)
+	fill(&req.ContactInfo.Segment, contact.BusinessSegment)
+	fill(&req.ContactInfo.City, contact.City)
+	fill(&req.ContactInfo.Country, contact.Country)
+	fill(&req.ContactInfo.Email, contact.Email)
+}
+
+// outreachLanguages are the languages outreach can be written in.
+var outreachLanguages = []types.Language{
+	{Code: "en", Name: "English"},
+	{Code: "pl", Name: "Polish"},
+	{Code: "de", Name: "German"},
+	{Code: "es", Name: "Spanish"},
+	{Code: "fr", Name: "French"},
+	{Code: "it", Name: "Italian"},
+	{Code: "nl", Name: "Dutch"},
+	{Code: "pt", Name: "Portuguese"},
+}
+
+// languageOptions lists the outreach languages with one of them selected.
+func languageOptions(selected string) []types.Language {
+	languages := append([]types.Language(nil), outreachLanguages...)
+	for i := range languages {
+		languages[i].Selected = languages[i].Code == selected
+	}
+	return languages
+}
+
+func knownLanguage(code string) bool {
+	for _, lang := range outreachLanguages {
+		if lang.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Handlers) HandleHome() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		languages := []types.Language{
-			{Code: "en", Name: "English", Selected: true},
-			{Code: "pl", Name: "Polish"},
-			{Code: "de", Name: "German"},
-			{Code: "es", Name: "Spanish"},
-			{Code: "fr", Name: "French"},
+		// Imported lists are local, so they are shown right away; Airtable
+		// contacts load on request
+		key := r.URL.Query().Get("source")
+		var contacts []types.Contact
+		if key != "" && key != sourceAirtable {
+			source, err := h.contactSource(key)
+			if err == nil {
+				contacts, err = source.Contacts()
+			}
+			if err != nil {
+				log.Printf("Warning: Failed to load contacts of %s: %v", key, err)
+			}
 		}
 
-		component := components.Home(nil, languages)
+		sequences, err := h.listSequences()
+		if err != nil {
+			log.Printf("Warning: Failed to load sequences: %v", err)
+		}
+
+		profiles, err := h.listProfiles()
+		if err != nil {
+			log.Printf("Warning: Failed to load sender profiles: %v", err)
+		}
+
+		prompt, language := h.savedSelection(key)
+		component := components.Home(contacts, prompt, languageOptions(language), h.contactSources(), key, sequences, profiles)
 		component.Render(r.Context(), w)
 	}
 }
 
+// HandleOutreachSettings returns the prompt template and language saved for
+// the selected source, when another source is picked on the home page.
+func (h *Handlers) HandleOutreachSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prompt, language := h.savedSelection(r.URL.Query().Get("source"))
+		components.OutreachSettings(prompt, languageOptions(language)).Render(r.Context(), w)
+	}
+}
+
+// HandleSetLanguage saves the outreach language picked on the home page, for
+// the selected campaign or as the default language.
+func (h *Handlers) HandleSetLanguage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		language := r.FormValue("language")
+		if !knownLanguage(language) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown language %q", language))
+			return
+		}
+		h.saveSelection(w, r, "default_language", language, h.setCampaignLanguage)
+	}
+}
+
+// HandleSetPrompt saves the prompt template edited on the home page, for the
+// selected campaign or for every other source.
+func (h *Handlers) HandleSetPrompt() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.saveSelection(w, r, "outreach_prompt", strings.TrimSpace(r.FormValue("prompt")), h.setCampaignPrompt)
+	}
+}
+
+// saveSelection stores a home page selection with the campaign selected in
+// the "source" field, or as the setting for every other source.
+func (h *Handlers) saveSelection(w http.ResponseWriter, r *http.Request, key, value string, setCampaign func(int64, string) error) {
+	var err error
+	if id, ok := campaignID(r.FormValue("source")); ok {
+		err = setCampaign(id, value)
+	} else {
+		err = h.saveConfig(map[string]string{key: value})
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Campaign not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving %s: %v", key, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to save the selection")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// savedSelection returns the prompt template and language saved for a
+// source: a campaign's own, or those saved from the home page.
+func (h *Handlers) savedSelection(key string) (string, string) {
+	config, err := h.loadConfig()
+	if err != nil {
+		log.Printf("Warning: Failed to load configuration: %v", err)
+	}
+	if id, ok := campaignID(key); ok {
+		if c, err := h.loadCampaign(id); err == nil {
+			config = applyCampaign(config, c)
+		}
+	}
+	return config.OutreachPrompt, config.DefaultLanguage
+}
+
 func (h *Handlers) HandleGetCompanies() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		config, err := h.getRequiredConfig()
+		source, err := h.contactSource(r.URL.Query().Get("source"))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		contacts, err := h.fetchAirtableContacts(config)
+		contacts, err := source.Contacts()
+		if errors.Is(err, types.ErrMissingConfig) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -45,28 +202,13 @@ func (h *Handlers) HandleGetCompanies() http.HandlerFunc {
 
 func (h *Handlers) HandleGenerateOutreach() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		config, err := h.getRequiredConfig()
-		if err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
-			return
-		}
-
-		var req struct {
-			Website     string `json:"website"`
-			Prompt      string `json:"prompt"`
-			RecordID    string `json:"recordId"`
-			Language    string `json:"language"`
-			ContactInfo struct {
-				Name    string `json:"name"`
-				Company string `json:"company"`
-				Segment string `json:"segment"`
-			} `json:"contactInfo"`
-		}
+		var req outreachRequest
 
 		contentType := r.Header.Get("Content-Type")
 		log.Printf("Content-Type: %s", contentType)
 
-		if contentType == "application/x-www-form-urlencoded" {
+		// htmx posts the card's values as a form; API clients may send JSON
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/json" {
 			if err := r.ParseForm(); err != nil {
 				log.Printf("Error parsing form: %v", err)
 				respondWithError(w, http.StatusBadRequest, "Failed to parse form data")
@@ -77,6 +219,7 @@ func (h *Handlers) HandleGenerateOutreach() http.HandlerFunc {
 			req.Prompt = r.FormValue("prompt")
 			req.RecordID = r.FormValue("recordId")
 			req.Language = r.FormValue("language")
+			req.Profile = r.FormValue("profile")
 
 			// Parse contactInfo from JSON string
 			contactInfoStr := r.FormValue("contactInfo")
@@ -101,134 +244,221 @@ func (h *Handlers) HandleGenerateOutreach() http.HandlerFunc {
 		log.Printf("- Prompt: %s", req.Prompt)
 		log.Printf("- RecordID: %s", req.RecordID)
 		log.Printf("- Language: %s", req.Language)
+		log.Printf("- Sender profile: %s", req.Profile)
 		log.Printf("- Contact Info:")
 		log.Printf("  - Name: %s", req.ContactInfo.Name)
 		log.Printf("  - Company: %s", req.ContactInfo.Company)
 		log.Printf("  - Segment: %s", req.ContactInfo.Segment)
 
-		// Fetch website content
-		websiteContent, err := h.fetchWebsiteContent(req.Website)
+		// The mirror knows which source the record belongs to, and fills in
+		// the contact details the request left out
+		sourceKey := sourceAirtable
+		var language string
+		if stored, err := h.getContact(req.RecordID); err == nil {
+			sourceKey = stored.Source
+			language = stored.Language
+			req.fillContact(stored)
+		}
+		source, err := h.contactSource(sourceKey)
 		if err != nil {
-			log.Printf("Error fetching website content: %v", err)
-			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Failed to fetch website content: %v", err))
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		config, err := h.sourceConfig(source)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		// Sprawdź dostępność strony
-		if err := checkWebsite(req.Website); err != nil {
-			contact := types.Contact{
-				ID:              req.RecordID,
-				Fullname:        req.ContactInfo.Name,
-				CompanyName:     req.ContactInfo.Company,
-				BusinessSegment: req.ContactInfo.Segment,
-				Website:         req.Website,
-				Error:           fmt.Sprintf("Website error: %v", err),
-			}
+		applySelection(source, config, &req)
+		pc, err := h.requestPromptContext(req.Profile, req.Prompt)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		contact := types.Contact{
+			ID:              req.RecordID,
+			Fullname:        req.ContactInfo.Name,
+			CompanyName:     req.ContactInfo.Company,
+			BusinessSegment: req.ContactInfo.Segment,
+			City:            req.ContactInfo.City,
+			Country:         req.ContactInfo.Country,
+			Email:           req.ContactInfo.Email,
+			Website:         req.Website,
+			Language:        language,
+		}
+
+		// An empty or blocked website is only rejected when no fallback
+		// can stand in for it; otherwise research decides, as in generate-all
+		if _, err := h.fetch.normalizeWebsiteURL(req.Website); err != nil && !h.canFallback(config, contact) {
+			log.Printf("Rejected website %q: %v", req.Website, err)
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid website: %v", err))
+			return
+		}
+
+		// Sprawdź dostępność strony i pobierz treść
+		websiteContent, ok := h.researchWebsite(config, &contact)
+		h.storeWebsiteStatus(contact)
+		if !ok {
+			recordOutreachError(source, config, contact, true)
 			component := components.ContactCard(contact)
 			component.Render(r.Context(), w)
 			return
 		}
 
+		// The language picked on the page applies when nothing about the
+		// contact tells theirs
+		req.Language = h.storeOutreachLanguage(&contact, websiteContent, req.Language)
+
 		// Generate outreach text
-		outreachText, err := h.generateOutreachText(config, req, websiteContent)
+		outreachText, err := h.generateOutreachText(config, req, pc, websiteContent)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+			contact.Error = fmt.Sprintf("Generation error: %v", err)
+			contact.ErrorKind = types.ErrorKindGeneration
+			recordOutreachError(source, config, contact, true)
+			component := components.ContactCard(contact)
+			component.Render(r.Context(), w)
 			return
 		}
 
-		if err := h.updateAirtableOutreach(config, req.RecordID, outreachText); err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+		contact.OutreachText = outreachText
+		if err := updateOutreach(source, config, generatedUpdate(req.RecordID, config.AnthropicModel, req.Prompt, outreachText)); err != nil {
+			// Keep the text on the card so it is not lost
+			contact.Error = fmt.Sprintf("Update error: %v", err)
+			contact.ErrorKind = types.ErrorKindUpdate
+			component := components.ContactCard(contact)
+			component.Render(r.Context(), w)
 			return
 		}
+		contact.OutreachStatus = types.OutreachGenerated
 
-		contacts, err := h.fetchAirtableContacts(config)
+		// Re-read the record so the card and the mirror show what the source
+		// stored
+		if err := source.Refresh(config, req.RecordID); err != nil {
+			log.Printf("Warning: Failed to re-read record %s: %v", req.RecordID, err)
+		}
+		stored, err := h.getContact(req.RecordID)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to fetch contact details")
+			log.Printf("Warning: Failed to read mirrored contact %s: %v", req.RecordID, err)
+		} else {
+			stored.OutreachText = outreachText
+			stored.OutreachStatus = types.OutreachGenerated
+			stored.WebsiteStatus = contact.WebsiteStatus
+			stored.WebsiteDetail = contact.WebsiteDetail
+			stored.LowConfidence = contact.LowConfidence
+			stored.FallbackSource = contact.FallbackSource
+			stored.OutreachLanguage = contact.OutreachLanguage
+			stored.LanguageReason = contact.LanguageReason
+			contact = stored
+		}
+
+		component := components.ContactCard(contact)
+		component.Render(r.Context(), w)
+	}
+}
+
+// HandleCheckWebsites runs the website diagnostics for every contact without
+// generating anything, so the list can be filtered by website health first.
+func (h *Handlers) HandleCheckWebsites() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		source, config, err := h.requestSource(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		var contact types.Contact
-		for _, c := range contacts {
-			if c.ID == req.RecordID {
-				contact = c
-				contact.OutreachText = outreachText
-				break
+		contacts, err := source.Contacts()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		batch := newOutreachBatch(source, config)
+		for i := range contacts {
+			applyDiagnosis(&contacts[i], h.diagnoseWebsite(config, contacts[i].Website))
+			h.storeWebsiteStatus(contacts[i])
+			if contacts[i].Error != "" {
+				contacts[i].FallbackAvailable = h.canFallback(config, contacts[i])
+				queueOutreachError(batch, contacts[i], false)
 			}
 		}
+		for id, err := range batch.flush() {
+			log.Printf("Warning: Failed to write website error for %s to %s: %v", id, source.Name(), err)
+		}
 
-		component := components.ContactCard(contact)
+		component := components.ContactsList(contacts)
 		component.Render(r.Context(), w)
 	}
 }
 
 func (h *Handlers) HandleGenerateAll() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		config, err := h.getRequiredConfig()
+		source, config, err := h.requestSource(r)
 		if err != nil {
 			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		contacts, err := h.fetchAirtableContacts(config)
+		base := outreachRequest{Prompt: r.FormValue("prompt"), Profile: r.FormValue("profile"), Language: r.FormValue("language")}
+		applySelection(source, config, &base)
+		pc, err := h.requestPromptContext(base.Profile, base.Prompt)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		contacts, err := source.Contacts()
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 
+		batch := newOutreachBatch(source, config)
 		for i := range contacts {
 			// Sprawdź dostępność strony przed generowaniem
-			if err := checkWebsite(contacts[i].Website); err != nil {
-				contacts[i].Error = fmt.Sprintf("Website error: %v", err)
-				continue
-			}
-
-			// Fetch website content
-			websiteContent, err := h.fetchWebsiteContent(contacts[i].Website)
-			if err != nil {
-				contacts[i].Error = fmt.Sprintf("Website error: %v", err)
+			websiteContent, ok := h.researchWebsite(config, &contacts[i])
+			h.storeWebsiteStatus(contacts[i])
+			if !ok {
+				queueOutreachError(batch, contacts[i], true)
 				continue
 			}
 
 			// Generuj outreach tylko dla kontaktów bez błędów
 			if contacts[i].Error == "" {
-				req := struct {
-					Website     string `json:"website"`
-					Prompt      string `json:"prompt"`
-					RecordID    string `json:"recordId"`
-					Language    string `json:"language"`
-					ContactInfo struct {
-						Name    string `json:"name"`
-						Company string `json:"company"`
-						Segment string `json:"segment"`
-					} `json:"contactInfo"`
-				}{
+				req := outreachRequest{
 					Website:  contacts[i].Website,
-					Prompt:   r.FormValue("prompt"),
+					Prompt:   base.Prompt,
 					RecordID: contacts[i].ID,
-					Language: config.DefaultLanguage,
-					ContactInfo: struct {
-						Name    string `json:"name"`
-						Company string `json:"company"`
-						Segment string `json:"segment"`
-					}{
-						Name:    contacts[i].Fullname,
-						Company: contacts[i].CompanyName,
-						Segment: contacts[i].BusinessSegment,
-					},
+					Language: h.storeOutreachLanguage(&contacts[i], websiteContent, base.Language),
 				}
+				req.ContactInfo.Name = contacts[i].Fullname
+				req.ContactInfo.Company = contacts[i].CompanyName
+				req.ContactInfo.Segment = contacts[i].BusinessSegment
+				req.ContactInfo.City = contacts[i].City
+				req.ContactInfo.Country = contacts[i].Country
 
-				outreachText, err := h.generateOutreachText(config, req, websiteContent)
+				outreachText, err := h.generateOutreachText(config, req, pc, websiteContent)
 				if err != nil {
 					contacts[i].Error = fmt.Sprintf("Generation error: %v", err)
+					contacts[i].ErrorKind = types.ErrorKindGeneration
+					queueOutreachError(batch, contacts[i], true)
 					continue
 				}
 
-				if err := h.updateAirtableOutreach(config, contacts[i].ID, outreachText); err != nil {
-					contacts[i].Error = fmt.Sprintf("Update error: %v", err)
-					continue
-				}
-
+				batch.add(generatedUpdate(contacts[i].ID, config.AnthropicModel, req.Prompt, outreachText))
 				contacts[i].OutreachText = outreachText
+				contacts[i].OutreachStatus = types.OutreachGenerated
+			}
+		}
+
+		// Report records whose write failed; the generated text stays on the
+		// card so it is not lost
+		errs := batch.flush()
+		for i := range contacts {
+			if err, failed := errs[contacts[i].ID]; failed && contacts[i].Error == "" {
+				contacts[i].Error = fmt.Sprintf("Update error: %v", err)
+				contacts[i].ErrorKind = types.ErrorKindUpdate
 			}
 		}
 
@@ -237,6 +467,77 @@ func (h *Handlers) HandleGenerateAll() http.HandlerFunc {
 	}
 }
 
+// requestSource resolves the source named by a bulk request's "source"
+// field together with the configuration it needs.
+func (h *Handlers) requestSource(r *http.Request) (ContactSource, types.Config, error) {
+	source, err := h.contactSource(r.FormValue("source"))
+	if err != nil {
+		return nil, types.Config{}, err
+	}
+	config, err := h.sourceConfig(source)
+	return source, config, err
+}
+
+// requestPromptContext loads the sender profile a generation request selected,
+// or the default one, and checks that the prompt's references can be filled.
+func (h *Handlers) requestPromptContext(profile, prompt string) (promptContext, error) {
+	var id int64
+	if profile != "" {
+		var err error
+		if id, err = strconv.ParseInt(profile, 10, 64); err != nil {
+			return promptContext{}, fmt.Errorf("invalid sender profile %q", profile)
+		}
+	}
+	pc, err := h.loadPromptContext(id)
+	if err != nil {
+		return pc, err
+	}
+	if _, err := pc.expand(prompt); err != nil {
+		return pc, fmt.Errorf("Prompt template: %v", err)
+	}
+	return pc, nil
+}
+
+// storeWebsiteStatus keeps the diagnosis in the mirror so the website filter
+// still works after a reload.
+func (h *Handlers) storeWebsiteStatus(contact types.Contact) {
+	if contact.WebsiteStatus == "" {
+		return
+	}
+	if err := h.saveWebsiteStatus(contact); err != nil {
+		log.Printf("Warning: Failed to save website status for %s: %v", contact.ID, err)
+	}
+}
+
+// applyDiagnosis copies the website health onto the contact and marks it as
+// failed when the website cannot be used. Skips caused by robots.txt get their
+// own kind so they are not mistaken for outages.
+func applyDiagnosis(contact *types.Contact, diag websiteDiagnosis) {
+	contact.WebsiteStatus = diag.Status
+	contact.WebsiteDetail = diag.Detail
+	if diag.OK() {
+		return
+	}
+
+	if diag.Status == types.WebsiteRobots {
+		contact.Error = "Skipped: the website disallows crawling in robots.txt"
+		contact.ErrorKind = types.ErrorKindRobots
+		return
+	}
+	contact.Error = fmt.Sprintf("Website error: %s", diag.Detail)
+	contact.ErrorKind = types.ErrorKindWebsite
+}
+
+// setWebsiteError classifies an error from fetching website content.
+func setWebsiteError(contact *types.Contact, err error) {
+	status := classifyFetchError(err)
+	applyDiagnosis(contact, websiteDiagnosis{
+		URL:    contact.Website,
+		Status: status,
+		Detail: describeWebsiteStatus(status, contact.Website, err),
+	})
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
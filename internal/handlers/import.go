@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+// importPreviewRows is how many rows the mapping step shows.
+const importPreviewRows = 5
+
+// HandleImportPage lists the imported contact lists and the upload form.
+func (h *Handlers) HandleImportPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		imports, err := h.listImports()
+		if err != nil {
+			http.Error(w, "Failed to load imports", http.StatusInternalServerError)
+			return
+		}
+		components.ImportPage(imports).Render(r.Context(), w)
+	}
+}
+
+// HandleListImports returns the list of imports.
+func (h *Handlers) HandleListImports() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		imports, err := h.listImports()
+		if err != nil {
+			http.Error(w, "Failed to load imports", http.StatusInternalServerError)
+			return
+		}
+		components.ImportList(imports).Render(r.Context(), w)
+	}
+}
+
+// HandleUploadImport reads an uploaded CSV or XLSX file and continues with
+// the column mapping step. Nothing is imported until the mapping is saved.
+func (h *Handlers) HandleUploadImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize+1<<20)
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			components.ImportError("Choose a CSV or XLSX file of at most 10 MB.").Render(r.Context(), w)
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, maxImportSize+1))
+		if err != nil {
+			components.ImportError(fmt.Sprintf("Failed to read the upload: %v", err)).Render(r.Context(), w)
+			return
+		}
+		if len(data) > maxImportSize {
+			components.ImportError("The file is larger than 10 MB.").Render(r.Context(), w)
+			return
+		}
+
+		imp, rows, err := readContactFile(header.Filename, data)
+		if err != nil {
+			components.ImportError(err.Error()).Render(r.Context(), w)
+			return
+		}
+		if imp, err = h.createImport(imp, rows); err != nil {
+			log.Printf("Error saving import %s: %v", header.Filename, err)
+			components.ImportError("Failed to save the upload.").Render(r.Context(), w)
+			return
+		}
+
+		log.Printf("Uploaded %s: %d rows, %d columns", imp.Name, imp.Rows, len(imp.Header))
+		components.ImportMapping(imp, previewRows(rows)).Render(r.Context(), w)
+	}
+}
+
+// HandleImport shows the mapping step of a pending import or the result of
+// a finished one.
+func (h *Handlers) HandleImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		imp, rows, ok := h.requestImport(w, r)
+		if !ok {
+			return
+		}
+		if imp.Status == types.ImportPending {
+			components.ImportMapping(imp, previewRows(rows)).Render(r.Context(), w)
+			return
+		}
+		components.ImportResult(imp, importRowErrors(rows)).Render(r.Context(), w)
+	}
+}
+
+// HandleApplyImport imports the rows of a pending upload with the submitted
+// column mapping and de-duplication mode.
+func (h *Handlers) HandleApplyImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		imp, rows, ok := h.requestImport(w, r)
+		if !ok {
+			return
+		}
+		if imp.Status != types.ImportPending {
+			components.ImportError("This file was already imported. Delete it and upload it again to change the mapping.").Render(r.Context(), w)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			components.ImportError("Failed to parse the mapping.").Render(r.Context(), w)
+			return
+		}
+		imp.Mapping = map[string]int{}
+		for _, field := range types.ImportFields {
+			value := r.FormValue("map_" + field.Key)
+			if value == "" {
+				continue
+			}
+			column, err := strconv.Atoi(value)
+			if err != nil || column < 0 || column >= len(imp.Header) {
+				components.ImportError(fmt.Sprintf("Invalid column for %s.", field.Label)).Render(r.Context(), w)
+				return
+			}
+			imp.Mapping[field.Key] = column
+		}
+		if _, ok := imp.Mapping["website"]; !ok {
+			if _, ok := imp.Mapping["email"]; !ok {
+				components.ImportError("Map at least the website or the email column.").Render(r.Context(), w)
+				return
+			}
+		}
+
+		switch dedupe := r.FormValue("dedupe"); dedupe {
+		case types.DedupeEmail, types.DedupeDomain, types.DedupeNone:
+			imp.Dedupe = dedupe
+		default:
+			components.ImportError("Choose how duplicates are detected.").Render(r.Context(), w)
+			return
+		}
+
+		imp, rowErrors, err := h.applyImport(imp, rows)
+		if err != nil {
+			log.Printf("Error importing %s: %v", imp.Name, err)
+			components.ImportError("Failed to import the contacts.").Render(r.Context(), w)
+			return
+		}
+
+		log.Printf("Imported %s: %d contacts, %d rows skipped", imp.Name, imp.Imported, imp.Skipped)
+		components.ImportResult(imp, rowErrors).Render(r.Context(), w)
+	}
+}
+
+// HandleExportImport downloads an import in its original format with the
+// generated outreach added.
+func (h *Handlers) HandleExportImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		imp, err := h.loadImport(chi.URLParam(r, "id"))
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load import", http.StatusInternalServerError)
+			return
+		}
+
+		contentType := "text/csv; charset=utf-8"
+		if imp.Format == types.ImportXLSX {
+			contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(imp)))
+		if err := h.exportImport(w, imp); err != nil {
+			log.Printf("Error exporting %s: %v", imp.Name, err)
+		}
+	}
+}
+
+// HandleDeleteImport removes an import and its contacts and returns the
+// updated list.
+func (h *Handlers) HandleDeleteImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h.deleteImport(chi.URLParam(r, "id")); err != nil {
+			http.Error(w, "Failed to delete import", http.StatusInternalServerError)
+			return
+		}
+
+		imports, err := h.listImports()
+		if err != nil {
+			http.Error(w, "Failed to load imports", http.StatusInternalServerError)
+			return
+		}
+		components.ImportList(imports).Render(r.Context(), w)
+	}
+}
+
+// requestImport loads the import named in the URL with its rows, writing
+// the error response itself when that fails.
+func (h *Handlers) requestImport(w http.ResponseWriter, r *http.Request) (types.Import, []importRow, bool) {
+	imp, err := h.loadImport(chi.URLParam(r, "id"))
+	if err == sql.ErrNoRows {
+		components.ImportError("This import no longer exists.").Render(r.Context(), w)
+		return imp, nil, false
+	}
+	if err == nil {
+		var rows []importRow
+		if rows, err = h.loadImportRows(imp.ID); err == nil {
+			return imp, rows, true
+		}
+	}
+	log.Printf("Error loading import: %v", err)
+	components.ImportError("Failed to load the import.").Render(r.Context(), w)
+	return imp, nil, false
+}
+
+func previewRows(rows []importRow) [][]string {
+	var preview [][]string
+	for _, row := range rows[:min(importPreviewRows, len(rows))] {
+		preview = append(preview, row.Cells)
+	}
+	return preview
+}
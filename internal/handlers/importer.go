@@ -0,0 +1,647 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/xuri/excelize/v2"
+
+	"outreach-generator/internal/types"
+)
+
+const (
+	// maxImportSize bounds uploaded contact lists
+	maxImportSize = 10 << 20
+	// maxImportRows keeps a single import to a size the UI can list
+	maxImportRows = 10000
+)
+
+// Export columns added to an import's original columns. A file exported
+// earlier already has them and they are filled in place.
+const (
+	exportSubjectColumn = "outreach_subject"
+	exportBodyColumn    = "outreach_text"
+	exportStatusColumn  = "outreach_status"
+)
+
+// importColumnAliases are normalized header names recognized for each
+// contact field when guessing the column mapping. The first ones match the
+// Airtable field names.
+var importColumnAliases = map[string][]string{
+	"fullname":         {"fullname", "name", "contactname", "contact", "contactperson", "imieinazwisko"},
+	"company_name":     {"companyname", "company", "organization", "organisation", "firma", "nazwafirmy"},
+	"business_segment": {"businesssegment", "segment", "industry", "branża", "branza"},
+	"website":          {"website", "url", "www", "web", "domain", "strona", "stronawww"},
+	"email":            {"email", "emailaddress", "mail"},
+	"phone":            {"phone", "phonenumber", "telephone", "tel", "telefon"},
+	"city":             {"city", "town", "miasto"},
+	"country":          {"country", "kraj"},
+	"language":         {"language", "lang", "język", "jezyk"},
+}
+
+// importRow is one non-empty data row of an uploaded file, numbered as in
+// the file so errors can be found in a spreadsheet.
+type importRow struct {
+	Number    int
+	Cells     []string
+	ContactID string
+	Error     string
+}
+
+// readContactFile reads the header and data rows of an uploaded CSV or XLSX
+// file. The format follows the file extension.
+func readContactFile(name string, data []byte) (types.Import, []importRow, error) {
+	imp := types.Import{Name: filepath.Base(name)}
+
+	var records [][]string
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv", ".txt":
+		imp.Format = types.ImportCSV
+		imp.Delimiter = detectDelimiter(data)
+		records, err = readCSV(data, imp.Delimiter)
+	case ".xlsx":
+		imp.Format = types.ImportXLSX
+		imp.Sheet, records, err = readXLSX(data)
+	default:
+		return imp, nil, fmt.Errorf("unsupported file type %q, upload a .csv or .xlsx file", filepath.Ext(name))
+	}
+	if err != nil {
+		return imp, nil, fmt.Errorf("error reading %s: %w", imp.Name, err)
+	}
+	if len(records) == 0 {
+		return imp, nil, errors.New("the file is empty")
+	}
+
+	imp.Header = records[0]
+	var rows []importRow
+	for i, record := range records[1:] {
+		if isEmptyRecord(record) {
+			continue
+		}
+		rows = append(rows, importRow{Number: i + 2, Cells: record})
+	}
+	if len(rows) == 0 {
+		return imp, nil, errors.New("the file has a header but no rows")
+	}
+	if len(rows) > maxImportRows {
+		return imp, nil, fmt.Errorf("the file has %d rows, at most %d can be imported at once", len(rows), maxImportRows)
+	}
+
+	// Give every cell a column, naming the ones without a header
+	width := len(imp.Header)
+	for _, row := range rows {
+		width = max(width, len(row.Cells))
+	}
+	for len(imp.Header) < width {
+		imp.Header = append(imp.Header, "")
+	}
+	for i, column := range imp.Header {
+		if strings.TrimSpace(column) == "" {
+			imp.Header[i] = fmt.Sprintf("Column %d", i+1)
+		}
+	}
+	for i := range rows {
+		for len(rows[i].Cells) < width {
+			rows[i].Cells = append(rows[i].Cells, "")
+		}
+	}
+
+	imp.Rows = len(rows)
+	imp.Mapping = guessMapping(imp.Header)
+	imp.Dedupe = types.DedupeEmail
+	imp.Status = types.ImportPending
+	return imp, rows, nil
+}
+
+// detectDelimiter picks the most frequent of comma, semicolon and tab in the
+// header line. Spreadsheets in many European locales save CSV with
+// semicolons.
+func detectDelimiter(data []byte) string {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	best, count := ",", 0
+	for _, d := range []string{",", ";", "\t"} {
+		if n := bytes.Count(line, []byte(d)); n > count {
+			best, count = d, n
+		}
+	}
+	return best
+}
+
+func readCSV(data []byte, delimiter string) ([][]string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = rune(delimiter[0])
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	return r.ReadAll()
+}
+
+// readXLSX reads the active sheet of a workbook.
+func readXLSX(data []byte) (string, [][]string, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	sheet := f.GetSheetName(f.GetActiveSheetIndex())
+	if sheet == "" {
+		sheet = f.GetSheetName(0)
+	}
+	rows, err := f.GetRows(sheet)
+	return sheet, rows, err
+}
+
+func isEmptyRecord(record []string) bool {
+	for _, cell := range record {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeHeader lowercases a column name and drops everything but letters
+// and digits, so "E-mail" and "Company Name" match their aliases.
+func normalizeHeader(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// guessMapping maps contact fields to the columns whose header matches one
+// of their aliases. Fields without a match are left out.
+func guessMapping(header []string) map[string]int {
+	mapping := map[string]int{}
+	for _, field := range types.ImportFields {
+		for i, column := range header {
+			if containsString(importColumnAliases[field.Key], normalizeHeader(column)) {
+				mapping[field.Key] = i
+				break
+			}
+		}
+	}
+	return mapping
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// importContact builds the contact of a row from the column mapping.
+func importContact(imp types.Import, row importRow) types.Contact {
+	cell := func(field string) string {
+		i, ok := imp.Mapping[field]
+		if !ok || i < 0 || i >= len(row.Cells) {
+			return ""
+		}
+		return strings.TrimSpace(row.Cells[i])
+	}
+
+	return types.Contact{
+		ID:              fmt.Sprintf("%s-%d", imp.ID, row.Number),
+		Fullname:        cell("fullname"),
+		CompanyName:     cell("company_name"),
+		BusinessSegment: cell("business_segment"),
+		Website:         cell("website"),
+		Phone:           cell("phone"),
+		City:            cell("city"),
+		Country:         cell("country"),
+		Email:           cell("email"),
+		Language:        cell("language"),
+		// Keeps file order when the mirror sorts by creation time
+		CreatedTime: imp.CreatedAt.UTC().Add(time.Duration(row.Number) * time.Millisecond).Format("2006-01-02T15:04:05.000Z"),
+	}
+}
+
+// validateContact returns the problems that keep an imported contact from
+// being used, joined into one message.
+func (h *Handlers) validateContact(c types.Contact) string {
+	var problems []string
+	if c.CompanyName == "" && c.Fullname == "" {
+		problems = append(problems, "needs a company name or full name")
+	}
+	if c.Email == "" && c.Website == "" {
+		problems = append(problems, "needs an email or a website")
+	}
+	if c.Email != "" {
+		if addr, err := mail.ParseAddress(c.Email); err != nil || addr.Address != c.Email {
+			problems = append(problems, fmt.Sprintf("invalid email %q", c.Email))
+		}
+	}
+	if c.Website != "" {
+		if _, err := h.fetch.normalizeWebsiteURL(c.Website); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid website %q", c.Website))
+		}
+	}
+	return strings.Join(problems, "; ")
+}
+
+// dedupeKey returns the value contacts are compared by, or "" when the
+// contact cannot be compared. Domains come from the website only, since
+// email domains are often shared webmail providers.
+func dedupeKey(mode string, c types.Contact) string {
+	switch mode {
+	case types.DedupeEmail:
+		return strings.ToLower(c.Email)
+	case types.DedupeDomain:
+		return websiteDomain(c.Website)
+	}
+	return ""
+}
+
+// websiteDomain returns the host of a website without a leading "www.".
+func websiteDomain(website string) string {
+	website = strings.TrimSpace(website)
+	if website == "" {
+		return ""
+	}
+	if !strings.Contains(website, "://") {
+		website = "http://" + website
+	}
+	u, err := url.Parse(website)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// existingDedupeKeys maps the keys of contacts already in the mirror to the
+// name of their source, so an import does not repeat them. A contact copied
+// into a campaign is named by the source it was copied from when that still
+// has it, and by the campaign otherwise.
+func (h *Handlers) existingDedupeKeys(mode string) (map[string]string, error) {
+	keys := map[string]string{}
+	if mode == types.DedupeNone {
+		return keys, nil
+	}
+
+	// Campaign copies come first so the original's name replaces theirs
+	rows, err := h.db.Query(`SELECT c.email, c.website,
+			COALESCE(i.name, 'campaign ' || ca.name, 'Airtable')
+		FROM contacts c
+		LEFT JOIN imports i ON i.id = c.source
+		LEFT JOIN campaigns ca ON ? || ca.id = c.source
+		ORDER BY ca.id IS NULL`, campaignPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c types.Contact
+		var sourceName string
+		if err := rows.Scan(&c.Email, &c.Website, &sourceName); err != nil {
+			return nil, err
+		}
+		if key := dedupeKey(mode, c); key != "" {
+			keys[key] = sourceName
+		}
+	}
+	return keys, rows.Err()
+}
+
+// applyImport validates and de-duplicates the rows of a pending import with
+// its mapping, stores the valid ones as contacts and records the reason for
+// every skipped row.
+func (h *Handlers) applyImport(imp types.Import, rows []importRow) (types.Import, []types.ImportRowError, error) {
+	existing, err := h.existingDedupeKeys(imp.Dedupe)
+	if err != nil {
+		return imp, nil, err
+	}
+
+	seen := map[string]int{}
+	var contacts []types.Contact
+	var rowErrors []types.ImportRowError
+	for i := range rows {
+		contact := importContact(imp, rows[i])
+		problem := h.validateContact(contact)
+		if problem == "" {
+			if key := dedupeKey(imp.Dedupe, contact); key != "" {
+				if first, dup := seen[key]; dup {
+					problem = fmt.Sprintf("duplicate %s of row %d", imp.Dedupe, first)
+				} else if source, dup := existing[key]; dup {
+					problem = fmt.Sprintf("duplicate %s, already in %s", imp.Dedupe, source)
+				} else {
+					seen[key] = rows[i].Number
+				}
+			}
+		}
+
+		rows[i].Error = problem
+		rows[i].ContactID = ""
+		if problem != "" {
+			rowErrors = append(rowErrors, types.ImportRowError{Row: rows[i].Number, Message: problem})
+			continue
+		}
+		rows[i].ContactID = contact.ID
+		contacts = append(contacts, contact)
+	}
+
+	imp.Status = types.ImportImported
+	imp.Imported = len(contacts)
+	imp.Skipped = len(rowErrors)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return imp, nil, err
+	}
+	defer tx.Rollback()
+
+	if err := upsertContacts(tx, imp.ID, contacts, time.Now().UTC()); err != nil {
+		return imp, nil, err
+	}
+	for _, row := range rows {
+		if _, err := tx.Exec("UPDATE import_rows SET contact_id = ?, error = ? WHERE import_id = ? AND row_number = ?",
+			row.ContactID, row.Error, imp.ID, row.Number); err != nil {
+			return imp, nil, err
+		}
+	}
+	if err := saveImport(tx, imp); err != nil {
+		return imp, nil, err
+	}
+	return imp, rowErrors, tx.Commit()
+}
+
+func newImportID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "imp" + hex.EncodeToString(b), nil
+}
+
+// createImport stores an upload and its rows while it waits for the column
+// mapping.
+func (h *Handlers) createImport(imp types.Import, rows []importRow) (types.Import, error) {
+	id, err := newImportID()
+	if err != nil {
+		return imp, err
+	}
+	imp.ID = id
+	imp.CreatedAt = time.Now().UTC()
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return imp, err
+	}
+	defer tx.Rollback()
+
+	header, err := json.Marshal(imp.Header)
+	if err != nil {
+		return imp, err
+	}
+	if _, err := tx.Exec(`INSERT INTO imports (id, name, format, delimiter, sheet, header, status, rows, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		imp.ID, imp.Name, imp.Format, imp.Delimiter, imp.Sheet, string(header), imp.Status, imp.Rows, imp.CreatedAt); err != nil {
+		return imp, err
+	}
+	if err := saveImport(tx, imp); err != nil {
+		return imp, err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO import_rows (import_id, row_number, cells) VALUES (?, ?, ?)")
+	if err != nil {
+		return imp, err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		cells, err := json.Marshal(row.Cells)
+		if err != nil {
+			return imp, err
+		}
+		if _, err := stmt.Exec(imp.ID, row.Number, string(cells)); err != nil {
+			return imp, err
+		}
+	}
+	return imp, tx.Commit()
+}
+
+// saveImport stores the mapping, status and counts of an import.
+func saveImport(tx *sql.Tx, imp types.Import) error {
+	mapping, err := json.Marshal(imp.Mapping)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE imports SET mapping = ?, dedupe = ?, status = ?, imported = ?, skipped = ?
+		WHERE id = ?`, string(mapping), imp.Dedupe, imp.Status, imp.Imported, imp.Skipped, imp.ID)
+	return err
+}
+
+const importColumns = `id, name, format, delimiter, sheet, header, mapping, dedupe, status, rows, imported, skipped, created_at`
+
+func scanImport(row interface{ Scan(...interface{}) error }) (types.Import, error) {
+	var imp types.Import
+	var header, mapping string
+	err := row.Scan(&imp.ID, &imp.Name, &imp.Format, &imp.Delimiter, &imp.Sheet, &header, &mapping,
+		&imp.Dedupe, &imp.Status, &imp.Rows, &imp.Imported, &imp.Skipped, &imp.CreatedAt)
+	if err != nil {
+		return imp, err
+	}
+	if err := json.Unmarshal([]byte(header), &imp.Header); err != nil {
+		return imp, fmt.Errorf("error decoding header of import %s: %w", imp.ID, err)
+	}
+	if err := json.Unmarshal([]byte(mapping), &imp.Mapping); err != nil {
+		return imp, fmt.Errorf("error decoding mapping of import %s: %w", imp.ID, err)
+	}
+	return imp, nil
+}
+
+func (h *Handlers) loadImport(id string) (types.Import, error) {
+	return scanImport(h.db.QueryRow(`SELECT `+importColumns+` FROM imports WHERE id = ?`, id))
+}
+
+// listImports returns every import, newest first.
+func (h *Handlers) listImports() ([]types.Import, error) {
+	rows, err := h.db.Query(`SELECT ` + importColumns + ` FROM imports ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var imports []types.Import
+	for rows.Next() {
+		imp, err := scanImport(rows)
+		if err != nil {
+			return nil, err
+		}
+		imports = append(imports, imp)
+	}
+	return imports, rows.Err()
+}
+
+func (h *Handlers) loadImportRows(id string) ([]importRow, error) {
+	rows, err := h.db.Query(`SELECT row_number, cells, contact_id, error FROM import_rows
+		WHERE import_id = ? ORDER BY row_number`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []importRow
+	for rows.Next() {
+		var row importRow
+		var cells string
+		if err := rows.Scan(&row.Number, &cells, &row.ContactID, &row.Error); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(cells), &row.Cells); err != nil {
+			return nil, fmt.Errorf("error decoding row %d of import %s: %w", row.Number, id, err)
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// importRowErrors lists the skipped rows of an import.
+func importRowErrors(rows []importRow) []types.ImportRowError {
+	var errs []types.ImportRowError
+	for _, row := range rows {
+		if row.Error != "" {
+			errs = append(errs, types.ImportRowError{Row: row.Number, Message: row.Error})
+		}
+	}
+	return errs
+}
+
+// deleteImport removes an import together with its rows and contacts.
+func (h *Handlers) deleteImport(id string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM contacts WHERE source = ?",
+		"DELETE FROM import_rows WHERE import_id = ?",
+		"DELETE FROM imports WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// exportImport writes an import back in its original format: the original
+// columns and rows, plus the subject, body and status of the generated
+// outreach.
+func (h *Handlers) exportImport(w io.Writer, imp types.Import) error {
+	rows, err := h.loadImportRows(imp.ID)
+	if err != nil {
+		return err
+	}
+
+	header := append([]string(nil), imp.Header...)
+	column := func(name string) int {
+		for i, c := range header {
+			if strings.EqualFold(strings.TrimSpace(c), name) {
+				return i
+			}
+		}
+		header = append(header, name)
+		return len(header) - 1
+	}
+	subjectCol := column(exportSubjectColumn)
+	bodyCol := column(exportBodyColumn)
+	statusCol := column(exportStatusColumn)
+
+	records := [][]string{header}
+	for _, row := range rows {
+		record := append([]string(nil), row.Cells...)
+		for len(record) < len(header) {
+			record = append(record, "")
+		}
+
+		if row.ContactID != "" {
+			contact, err := h.getContact(row.ContactID)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if contact.OutreachText != "" {
+				subject, body := parseOutreach(contact.OutreachText)
+				record[subjectCol] = subject
+				record[bodyCol] = body
+			}
+			if contact.OutreachStatus != "" {
+				record[statusCol] = contact.OutreachStatus
+			}
+		}
+		records = append(records, record)
+	}
+
+	if imp.Format == types.ImportXLSX {
+		return writeXLSX(w, imp.Sheet, records)
+	}
+	return writeCSV(w, imp.Delimiter, records)
+}
+
+func writeCSV(w io.Writer, delimiter string, records [][]string) error {
+	cw := csv.NewWriter(w)
+	if delimiter != "" {
+		cw.Comma = rune(delimiter[0])
+	}
+	if err := cw.WriteAll(records); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func writeXLSX(w io.Writer, sheet string, records [][]string) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	if sheet == "" {
+		sheet = "Sheet1"
+	}
+	if err := f.SetSheetName(f.GetSheetName(0), sheet); err != nil {
+		return err
+	}
+	for i, record := range records {
+		cells := make([]interface{}, len(record))
+		for j, value := range record {
+			cells[j] = value
+		}
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return err
+		}
+		if err := f.SetSheetRow(sheet, cell, &cells); err != nil {
+			return err
+		}
+	}
+	return f.Write(w)
+}
+
+// exportFileName names an export after the uploaded file.
+func exportFileName(imp types.Import) string {
+	ext := filepath.Ext(imp.Name)
+	if ext == "" {
+		ext = "." + imp.Format
+	}
+	return strings.TrimSuffix(imp.Name, ext) + "-outreach" + ext
+}
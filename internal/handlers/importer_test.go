@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+func TestExistingDedupeKeysNamesSources(t *testing.T) {
+	h := newTestHandlers(t)
+	now := time.Now()
+
+	for _, stmt := range []string{
+		`INSERT INTO imports (id, name, format, header, status, created_at) VALUES ('imp1', 'Trade fair.csv', 'csv', '[]', 'imported', ?)`,
+		`INSERT INTO campaigns (id, name, source, created_at) VALUES (1, 'Spring push', 'airtable', ?)`,
+	} {
+		if _, err := h.db.Exec(stmt, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct{ id, source, email string }{
+		{"rec1", "airtable", "anna@example.com"},
+		{"imp1-1", "imp1", "ben@example.com"},
+		// Copies of the first two, and of a contact since deleted
+		{"cmp1-rec1", "cmp1", "anna@example.com"},
+		{"cmp1-imp1-1", "cmp1", "ben@example.com"},
+		{"cmp1-rec9", "cmp1", "cara@example.com"},
+	} {
+		if _, err := h.db.Exec(`INSERT INTO contacts (id, source, email, synced_at) VALUES (?, ?, ?, ?)`,
+			c.id, c.source, c.email, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := h.existingDedupeKeys(types.DedupeEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"anna@example.com": "Airtable",
+		"ben@example.com":  "Trade fair.csv",
+		"cara@example.com": "campaign Spring push",
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("existingDedupeKeys() = %v, want %v", keys, want)
+	}
+}
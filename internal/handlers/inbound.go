@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	msgtextproto "github.com/emersion/go-message/textproto"
+
+	"outreach-generator/internal/types"
+)
+
+// msgIDPattern finds message IDs in headers like References and in the text
+// of bounces that come without a delivery status report.
+var msgIDPattern = regexp.MustCompile(`<[^<>\s@]+@[^<>\s]+>`)
+
+// autoReplySubjects are subject prefixes of out-of-office and other
+// automatic replies from servers that do not set Auto-Submitted.
+var autoReplySubjects = []string{
+	"auto:", "autoreply", "auto-reply", "auto reply", "automatic reply", "out of office", "out of the office",
+	"automatische antwort", "abwesenheitsnotiz", "abwesend", "odpowiedź automatyczna", "autoodpowiedź",
+	"nieobecność", "réponse automatique", "absence", "respuesta automática", "fuera de la oficina",
+	"risposta automatica", "fuori sede", "automatisch antwoord", "afwezig",
+}
+
+// inboundMessage is an incoming message as far as matching it to outreach
+// needs.
+type inboundMessage struct {
+	UID        uint32
+	From       string
+	Subject    string
+	MessageID  string
+	InReplyTo  []string
+	ReceivedAt time.Time
+	Kind       string
+	// Bounce details, read from the full message
+	OriginalIDs []string
+	Recipients  []string
+	Detail      string
+}
+
+// readInboundHeader reads the header of an incoming message and classifies
+// it by the header alone. Messages that look like bounces are classified
+// again once the full message is read.
+func readInboundHeader(uid uint32, r io.Reader, received time.Time) (inboundMessage, error) {
+	header, err := readMailHeader(r)
+	if err != nil {
+		return inboundMessage{}, err
+	}
+
+	msg := inboundMessage{UID: uid, ReceivedAt: received}
+	if from, err := header.AddressList("From"); err == nil && len(from) > 0 {
+		msg.From = strings.ToLower(from[0].Address)
+	}
+	if msg.Subject, err = header.Subject(); err != nil {
+		msg.Subject = header.Get("Subject")
+	}
+	msg.MessageID = firstMsgID(header.Get("Message-Id"))
+	msg.InReplyTo = msgIDPattern.FindAllString(header.Get("In-Reply-To")+" "+header.Get("References"), -1)
+	if msg.ReceivedAt.IsZero() {
+		msg.ReceivedAt, _ = header.Date()
+	}
+	msg.Kind = classifyHeader(header, msg.From, msg.Subject)
+	return msg, nil
+}
+
+// classifyHeader tells replies from automatic replies and likely bounces.
+// Automatic replies are recognised by the headers of RFC 3834 and the
+// common vendor headers, then by their subject.
+func classifyHeader(header mail.Header, from, subject string) string {
+	mediaType, params, _ := header.ContentType()
+	if mediaType == "multipart/report" && strings.EqualFold(params["report-type"], "delivery-status") {
+		return types.InboundBounce
+	}
+	local, _, _ := strings.Cut(from, "@")
+	if local == "mailer-daemon" || local == "postmaster" {
+		return types.InboundBounce
+	}
+
+	if auto := strings.ToLower(header.Get("Auto-Submitted")); auto != "" && auto != "no" {
+		return types.InboundAutoReply
+	}
+	for _, key := range []string{"X-Autoreply", "X-Autorespond", "X-Autoresponder"} {
+		if header.Has(key) {
+			return types.InboundAutoReply
+		}
+	}
+	switch strings.ToLower(header.Get("Precedence")) {
+	case "auto_reply", "bulk", "junk":
+		return types.InboundAutoReply
+	}
+	lower := strings.ToLower(strings.TrimSpace(subject))
+	for _, prefix := range autoReplySubjects {
+		if strings.HasPrefix(lower, prefix) {
+			return types.InboundAutoReply
+		}
+	}
+	return types.InboundReply
+}
+
+// readBounce reads the delivery status report of a bounce: the failed
+// recipients, the status and diagnostic, and the message ID of the
+// returned message. Reports that only delay or relay the message are not
+// bounces, and the message is then ignored. Bounces without a report are
+// matched by the message IDs in their text.
+func readBounce(msg *inboundMessage, r io.Reader) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return err
+	}
+
+	report := false
+	failed := false
+	if mr := entity.MultipartReader(); mr != nil {
+		for {
+			// A bounce cut at the fetch limit ends in a broken part; the
+			// report comes before the returned message, so it was read
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			mediaType, _, _ := part.Header.ContentType()
+			switch mediaType {
+			case "message/delivery-status", "message/global-delivery-status":
+				report = true
+				status, err := readDeliveryStatus(part.Body)
+				if err != nil {
+					return err
+				}
+				for _, rcpt := range status {
+					if !strings.EqualFold(rcpt.Get("Action"), "failed") {
+						continue
+					}
+					failed = true
+					if addr := reportAddress(rcpt.Get("Final-Recipient")); addr != "" {
+						msg.Recipients = append(msg.Recipients, addr)
+					}
+					if addr := reportAddress(rcpt.Get("Original-Recipient")); addr != "" {
+						msg.Recipients = append(msg.Recipients, addr)
+					}
+					if msg.Detail == "" {
+						msg.Detail = strings.TrimSpace(rcpt.Get("Status") + " " + reportText(rcpt.Get("Diagnostic-Code")))
+					}
+				}
+			case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+				h, err := readMailHeader(part.Body)
+				if err == nil {
+					msg.OriginalIDs = append(msg.OriginalIDs, msgIDPattern.FindAllString(h.Get("Message-Id"), -1)...)
+				}
+			}
+		}
+	}
+
+	switch {
+	case report && !failed:
+		msg.Kind = ""
+	case !report:
+		msg.OriginalIDs = msgIDPattern.FindAllString(string(raw), -1)
+		msg.Detail = "Undeliverable, without a delivery status report"
+	}
+	return nil
+}
+
+// readDeliveryStatus splits a delivery status report into its blocks of
+// fields, the first about the message and the others one per recipient.
+func readDeliveryStatus(r io.Reader) ([]textproto.MIMEHeader, error) {
+	tp := textproto.NewReader(bufio.NewReader(r))
+	var blocks []textproto.MIMEHeader
+	for {
+		block, err := tp.ReadMIMEHeader()
+		if len(block) > 0 {
+			blocks = append(blocks, block)
+		}
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return blocks, err
+		}
+	}
+}
+
+// reportAddress reads an address field of a report like "rfc822; a@b.com".
+func reportAddress(field string) string {
+	kind, addr, ok := strings.Cut(field, ";")
+	if !ok || !strings.EqualFold(strings.TrimSpace(kind), "rfc822") {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(strings.TrimSpace(addr), "<>"))
+}
+
+// reportText drops the type of a diagnostic like "smtp; 550 5.1.1 ...".
+func reportText(field string) string {
+	if _, text, ok := strings.Cut(field, ";"); ok {
+		field = text
+	}
+	return strings.Join(strings.Fields(field), " ")
+}
+
+func readMailHeader(r io.Reader) (mail.Header, error) {
+	h, err := msgtextproto.ReadHeader(bufio.NewReader(r))
+	return mail.Header{Header: message.Header{Header: h}}, err
+}
+
+func firstMsgID(s string) string {
+	return msgIDPattern.FindString(s)
+}
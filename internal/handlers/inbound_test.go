@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bytes"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+func TestReadBounce(t *testing.T) {
+	failed := readFixture(t, "dsn-failed.eml")
+	tests := []struct {
+		name       string
+		data       []byte
+		kind       string
+		recipients []string
+		ids        []string
+		detail     string
+	}{
+		{
+			name:       "hard bounce",
+			data:       failed,
+			kind:       types.InboundBounce,
+			recipients: []string{"anna@example.com", "anna@example.com"},
+			ids:        []string{"<1760000000.abc123@sender.test>"},
+			detail:     "5.1.1 550 5.1.1 <anna@example.com>: Recipient address rejected: User unknown",
+		},
+		{
+			name: "soft bounce",
+			data: readFixture(t, "dsn-delayed.eml"),
+			kind: "",
+		},
+		{
+			// The header of the returned message is cut off
+			name:       "cut off at the fetch limit",
+			data:       failed[:bytes.Index(failed, []byte("From: Jan"))],
+			kind:       types.InboundBounce,
+			recipients: []string{"anna@example.com", "anna@example.com"},
+			detail:     "5.1.1 550 5.1.1 <anna@example.com>: Recipient address rejected: User unknown",
+		},
+		{
+			name:   "without a report",
+			data:   readFixture(t, "dsn-unreported.eml"),
+			kind:   types.InboundBounce,
+			ids:    []string{"<1760000000.abc123@sender.test>"},
+			detail: "Undeliverable, without a delivery status report",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := readInboundHeader(1, bytes.NewReader(tt.data), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Kind != types.InboundBounce {
+				t.Fatalf("header classified as %q, want a bounce", header.Kind)
+			}
+
+			msg := &header
+			if err := readBounce(msg, bytes.NewReader(tt.data)); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Kind != tt.kind {
+				t.Errorf("Kind = %q, want %q", msg.Kind, tt.kind)
+			}
+			if tt.kind == "" {
+				return
+			}
+			if !reflect.DeepEqual(msg.Recipients, tt.recipients) {
+				t.Errorf("Recipients = %q, want %q", msg.Recipients, tt.recipients)
+			}
+			// Text without a report may hold other IDs and bracketed
+			// addresses as well
+			for _, id := range tt.ids {
+				if !slices.Contains(msg.OriginalIDs, id) {
+					t.Errorf("OriginalIDs = %q, want %s among them", msg.OriginalIDs, id)
+				}
+			}
+			if msg.Detail != tt.detail {
+				t.Errorf("Detail = %q, want %q", msg.Detail, tt.detail)
+			}
+		})
+	}
+}
+
+func TestClassifyAutoReplies(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"From: anna@example.com\nSubject: Re: Hello\n", types.InboundReply},
+		{"From: anna@example.com\nSubject: Re: Hello\nAuto-Submitted: auto-replied\n", types.InboundAutoReply},
+		{"From: anna@example.com\nSubject: Re: Hello\nAuto-Submitted: no\n", types.InboundReply},
+		{"From: anna@example.com\nSubject: Out of Office: Hello\n", types.InboundAutoReply},
+		{"From: anna@example.com\nSubject: Hello\nPrecedence: bulk\n", types.InboundAutoReply},
+		{"From: MAILER-DAEMON@example.com\nSubject: failure notice\n", types.InboundBounce},
+	}
+
+	for _, tt := range tests {
+		header := strings.ReplaceAll(tt.header, "\n", "\r\n") + "\r\n"
+		msg, err := readInboundHeader(1, strings.NewReader(header), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Kind != tt.want {
+			t.Errorf("%q classified as %q, want %q", tt.header, msg.Kind, tt.want)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+const (
+	// inboxCheckInterval is how often the schedule checks whether the
+	// mailbox is due to be checked
+	inboxCheckInterval = time.Minute
+	// imapTimeout bounds connecting and every command
+	imapTimeout = 30 * time.Second
+	// inboxFetchBatch is how many headers are fetched at once
+	inboxFetchBatch = 100
+	// maxBounceSize is how much of a bounce is read; the report comes
+	// before the returned message, which may carry large attachments
+	maxBounceSize = 256 << 10
+)
+
+var (
+	errIMAPNotConfigured = errors.New("IMAP host not configured")
+	errInboxCheckRunning = errors.New("an inbox check is already running")
+)
+
+// inboxState is where the checks of a mailbox got to. UIDs are only
+// comparable within one UIDVALIDITY, so a new one starts over.
+type inboxState struct {
+	types.InboxStatus
+	UIDValidity uint32
+	LastUID     uint32
+}
+
+// inboxName identifies the checked mailbox, so that switching accounts
+// does not skip or repeat messages.
+func inboxName(config types.Config) string {
+	if config.IMAPHost == "" {
+		return ""
+	}
+	return config.IMAPUsername + "@" + config.IMAPHost + "/" + imapMailbox(config)
+}
+
+func imapMailbox(config types.Config) string {
+	if config.IMAPMailbox == "" {
+		return "INBOX"
+	}
+	return config.IMAPMailbox
+}
+
+// dialIMAP connects to the configured server and secures the connection as
+// configured. As with SMTP, STARTTLS is required rather than opportunistic.
+func dialIMAP(config types.Config) (*client.Client, error) {
+	if config.IMAPHost == "" {
+		return nil, errIMAPNotConfigured
+	}
+	port := config.IMAPPort
+	if port == 0 {
+		port = 993
+	}
+	addr := net.JoinHostPort(config.IMAPHost, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: config.IMAPHost}
+
+	dialer := &net.Dialer{Timeout: imapTimeout}
+	var c *client.Client
+	var err error
+	if config.IMAPSecurity == "" || config.IMAPSecurity == types.SMTPTLS {
+		c, err = client.DialWithDialerTLS(dialer, addr, tlsConfig)
+	} else {
+		c, err = client.DialWithDialer(dialer, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	c.Timeout = imapTimeout
+
+	if config.IMAPSecurity == types.SMTPStartTLS {
+		if ok, _ := c.SupportStartTLS(); !ok {
+			c.Logout()
+			return nil, errors.New("the server does not offer STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, fmt.Errorf("STARTTLS: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func loginIMAP(c *client.Client, config types.Config) error {
+	if config.IMAPUsername == "" {
+		return errors.New("set the IMAP username")
+	}
+	if err := c.Login(config.IMAPUsername, config.IMAPPassword); err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	return nil
+}
+
+// checkInbox reads the messages that arrived since the last check and
+// matches them to sent outreach. Replies and bounces update the contact's
+// status, which also ends their sequence.
+func (h *Handlers) checkInbox() error {
+	if !h.inbox.start() {
+		return errInboxCheckRunning
+	}
+	defer h.inbox.finish()
+	return h.runInboxCheck()
+}
+
+// runInboxCheck is checkInbox for a caller that has marked the check as
+// running.
+func (h *Handlers) runInboxCheck() error {
+	config, err := h.loadConfig()
+	if err != nil {
+		return err
+	}
+	if config.IMAPHost == "" {
+		return errIMAPNotConfigured
+	}
+	state, err := h.loadInboxState(inboxName(config))
+	if err != nil {
+		return err
+	}
+
+	matched, checkErr := h.pollInbox(config, &state)
+	state.CheckedAt = time.Now()
+	state.Error = ""
+	if checkErr != nil {
+		state.Error = checkErr.Error()
+	}
+	if err := h.saveInboxState(state); err != nil {
+		log.Printf("Error saving inbox state: %v", err)
+	}
+	if checkErr != nil {
+		return checkErr
+	}
+	log.Printf("Checked %s: %d new messages matched to outreach", state.Mailbox, matched)
+	return nil
+}
+
+// pollInbox handles the new messages of the mailbox in UID order,
+// advancing state as it goes so a failure does not repeat them. Messages
+// from before the first send cannot answer it and are skipped.
+func (h *Handlers) pollInbox(config types.Config, state *inboxState) (int, error) {
+	c, err := dialIMAP(config)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Logout()
+	if err := loginIMAP(c, config); err != nil {
+		return 0, err
+	}
+	mbox, err := c.Select(imapMailbox(config), true)
+	if err != nil {
+		return 0, fmt.Errorf("selecting %s: %w", imapMailbox(config), err)
+	}
+	if mbox.UidValidity != state.UIDValidity {
+		state.UIDValidity = mbox.UidValidity
+		state.LastUID = 0
+	}
+
+	first, err := h.firstDelivery()
+	if err != nil {
+		return 0, err
+	}
+	if first.IsZero() {
+		if mbox.UidNext > 0 {
+			state.LastUID = mbox.UidNext - 1
+		}
+		return 0, nil
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(state.LastUID+1, 0)
+	criteria.Since = first.AddDate(0, 0, -1)
+	found, err := c.UidSearch(criteria)
+	if err != nil {
+		return 0, fmt.Errorf("searching %s: %w", imapMailbox(config), err)
+	}
+	// "n:*" always includes the newest message, even when it is older
+	var uids []uint32
+	for _, uid := range found {
+		if uid > state.LastUID {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	own := ""
+	if from, err := mail.ParseAddress(config.SMTPFrom); err == nil {
+		own = strings.ToLower(from.Address)
+	}
+	matched := 0
+	for start := 0; start < len(uids); start += inboxFetchBatch {
+		batch := uids[start:min(start+inboxFetchBatch, len(uids))]
+		msgs, err := fetchInboundHeaders(c, batch)
+		if err != nil {
+			return matched, err
+		}
+		if err := fetchBounces(c, msgs); err != nil {
+			return matched, err
+		}
+		for _, msg := range msgs {
+			if msg.From != own {
+				ok, err := h.matchInbound(config, msg)
+				if err != nil {
+					return matched, err
+				}
+				if ok {
+					matched++
+				}
+			}
+			state.LastUID = msg.UID
+		}
+	}
+	return matched, nil
+}
+
+// fetchInboundHeaders reads and classifies the headers of messages. A
+// message whose header cannot be read is kept without a kind, so it is
+// passed over but not read again.
+func fetchInboundHeaders(c *client.Client, uids []uint32) ([]*inboundMessage, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, section.FetchItem()}
+
+	ch := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, ch)
+	}()
+
+	var msgs []*inboundMessage
+	for m := range ch {
+		body := m.GetBody(section)
+		if body == nil {
+			msgs = append(msgs, &inboundMessage{UID: m.Uid})
+			continue
+		}
+		msg, err := readInboundHeader(m.Uid, body, m.InternalDate)
+		if err != nil {
+			log.Printf("Warning: Failed to read message %d: %v", m.Uid, err)
+			msg = inboundMessage{UID: m.Uid}
+		}
+		msgs = append(msgs, &msg)
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("fetching messages: %w", err)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].UID < msgs[j].UID })
+	return msgs, nil
+}
+
+// fetchBounces reads the delivery status reports of the messages that look
+// like bounces.
+func fetchBounces(c *client.Client, msgs []*inboundMessage) error {
+	bounces := map[uint32]*inboundMessage{}
+	seqset := new(imap.SeqSet)
+	for _, msg := range msgs {
+		if msg.Kind == types.InboundBounce {
+			bounces[msg.UID] = msg
+			seqset.AddNum(msg.UID)
+		}
+	}
+	if len(bounces) == 0 {
+		return nil
+	}
+
+	section := &imap.BodySectionName{Peek: true, Partial: []int{0, maxBounceSize}}
+	items := []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+	ch := make(chan *imap.Message, len(bounces))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, ch)
+	}()
+
+	for m := range ch {
+		msg, ok := bounces[m.Uid]
+		body := m.GetBody(section)
+		if !ok || body == nil {
+			continue
+		}
+		if err := readBounce(msg, body); err != nil {
+			log.Printf("Warning: Failed to read bounce %d: %v", m.Uid, err)
+			msg.Kind = ""
+		}
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("fetching bounces: %w", err)
+	}
+	return nil
+}
+
+// matchInbound finds the contact an incoming message is about, by the
+// message IDs it refers to and then by address, records it and updates the
+// contact's status. A reply is never overwritten by a later bounce.
+func (h *Handlers) matchInbound(config types.Config, msg *inboundMessage) (bool, error) {
+	if msg.Kind == "" {
+		return false, nil
+	}
+	ids, addrs := msg.InReplyTo, []string{msg.From}
+	if msg.Kind == types.InboundBounce {
+		ids, addrs = msg.OriginalIDs, msg.Recipients
+	}
+
+	detail := msg.Detail
+	contactID, err := h.contactByMessageID(ids)
+	if err != nil {
+		return false, err
+	}
+	if contactID == "" {
+		if contactID, err = h.contactByRecipient(addrs, msg.ReceivedAt); err != nil {
+			return false, err
+		}
+		if contactID != "" && detail == "" {
+			detail = "Matched by address"
+		}
+	}
+	if contactID == "" {
+		return false, nil
+	}
+
+	stored, err := h.recordInbound(types.InboundMessage{
+		ContactID:  contactID,
+		Kind:       msg.Kind,
+		From:       msg.From,
+		Subject:    msg.Subject,
+		MessageID:  msg.MessageID,
+		ReceivedAt: msg.ReceivedAt,
+		Detail:     detail,
+	})
+	if err != nil || !stored {
+		return false, err
+	}
+
+	contact, err := h.getContact(contactID)
+	if err != nil {
+		return false, err
+	}
+	status := ""
+	switch msg.Kind {
+	case types.InboundReply:
+		if contact.OutreachStatus != types.OutreachReplied {
+			status = types.OutreachReplied
+		}
+	case types.InboundBounce:
+		if contact.OutreachStatus != types.OutreachReplied && contact.OutreachStatus != types.OutreachBounced {
+			status = types.OutreachBounced
+		}
+	}
+	log.Printf("Received %s from %s for %s", strings.ReplaceAll(msg.Kind, "_", "-"), msg.From, contactID)
+	if status == "" {
+		return true, nil
+	}
+
+	update := types.OutreachUpdate{RecordID: contactID, Status: status}
+	source, err := h.contactSource(contact.Source)
+	if err == nil {
+		err = updateOutreach(source, config, update)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to mark %s as %s in its source: %v", contactID, status, err)
+		if err := h.applyOutreachUpdate(update); err != nil {
+			log.Printf("Warning: Failed to mark %s as %s locally: %v", contactID, status, err)
+		}
+	}
+	return true, nil
+}
+
+// scheduleInboxChecks checks the mailbox every imap_poll_minutes. Like the
+// sync schedule, the interval is re-read each time.
+func (h *Handlers) scheduleInboxChecks() {
+	ticker := time.NewTicker(inboxCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		config, err := h.loadConfig()
+		if err != nil || config.IMAPHost == "" || config.IMAPPollMinutes <= 0 {
+			continue
+		}
+		state, err := h.loadInboxState(inboxName(config))
+		if err != nil {
+			continue
+		}
+		interval := time.Duration(config.IMAPPollMinutes) * time.Minute
+		if time.Since(state.CheckedAt) < interval {
+			continue
+		}
+
+		if err := h.checkInbox(); err != nil && !errors.Is(err, errInboxCheckRunning) {
+			log.Printf("Scheduled inbox check failed: %v", err)
+		}
+	}
+}
+
+// inboxStatus combines the stored state of the configured mailbox with the
+// counts of matched messages and whether a check is running.
+func (h *Handlers) inboxStatus() (types.InboxStatus, error) {
+	config, err := h.loadConfig()
+	if err != nil {
+		return types.InboxStatus{}, err
+	}
+	state, err := h.loadInboxState(inboxName(config))
+	if err != nil {
+		return types.InboxStatus{}, err
+	}
+	status := state.InboxStatus
+	status.Running = h.inbox.isRunning()
+	return status, h.countInbound(&status)
+}
+
+// HandleCheckInbox starts an inbox check in the background and returns the
+// status bar, which polls until the check is done.
+func (h *Handlers) HandleCheckInbox() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Marking the check as running before the status is rendered lets
+		// the status bar poll it; a check already running is shown as is
+		if h.inbox.start() {
+			go func() {
+				defer h.inbox.finish()
+				if err := h.runInboxCheck(); err != nil {
+					log.Printf("Manual inbox check failed: %v", err)
+				}
+			}()
+		}
+		h.renderInboxStatus(w, r)
+	}
+}
+
+// HandleInboxStatus returns the inbox status bar. When a check the page was
+// waiting for has finished, it also tells the contacts list to reload.
+func (h *Handlers) HandleInboxStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.renderInboxStatus(w, r)
+	}
+}
+
+func (h *Handlers) renderInboxStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := h.inboxStatus()
+	if err != nil {
+		http.Error(w, "Failed to load inbox status", http.StatusInternalServerError)
+		return
+	}
+	waiting := r.Method == http.MethodPost || r.URL.Query().Get("waiting") == "1"
+	if waiting && !status.Running {
+		w.Header().Set("HX-Trigger", "contactsSynced")
+	}
+	components.InboxStatus(status).Render(r.Context(), w)
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+
+	"outreach-generator/internal/types"
+)
+
+// newFakeIMAP serves the go-imap memory backend, whose INBOX holds one
+// unrelated message, and returns its config and INBOX.
+func newFakeIMAP(t *testing.T) (types.Config, *memory.Mailbox) {
+	t.Helper()
+
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return types.Config{
+		IMAPHost:     addr.IP.String(),
+		IMAPPort:     addr.Port,
+		IMAPSecurity: types.SMTPNone,
+		IMAPUsername: "username",
+		IMAPPassword: "password",
+		SMTPFrom:     "Jan Kowalski <jan@sender.test>",
+	}, mbox.(*memory.Mailbox)
+}
+
+func deliverTestMessage(t *testing.T, mbox *memory.Mailbox, header string) {
+	t.Helper()
+	body := strings.ReplaceAll(header, "\n", "\r\n") + "\r\nThanks for reaching out.\r\n"
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addSentContact stores a contact and the outreach sent to it.
+func addSentContact(t *testing.T, h *Handlers, id, email, messageID string) {
+	t.Helper()
+	if _, err := h.db.Exec(`INSERT INTO contacts (id, source, email, outreach_status, synced_at)
+		VALUES (?, 'test', ?, ?, ?)`, id, email, types.OutreachSent, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.db.Exec(`INSERT INTO sends (contact_id, sender, recipient, subject, message_id, sent_at)
+		VALUES (?, 'jan@sender.test', ?, 'Hello', ?, ?)`, id, email, messageID, time.Now().Add(-time.Hour).UTC()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contactStatus(t *testing.T, h *Handlers, id string) string {
+	t.Helper()
+	contact, err := h.getContact(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contact.OutreachStatus
+}
+
+func TestPollInboxMatchesReplies(t *testing.T) {
+	h := newTestHandlers(t)
+	config, mbox := newFakeIMAP(t)
+
+	addSentContact(t, h, "anna", "anna@example.com", "<1.anna@sender.test>")
+	addSentContact(t, h, "ben", "ben@example.com", "<2.ben@sender.test>")
+	addSentContact(t, h, "cara", "cara@example.com", "<3.cara@sender.test>")
+
+	// Replies from other addresses are matched by the IDs they refer to
+	deliverTestMessage(t, mbox, `From: Anna <anna.private@example.net>
+Subject: Re: Hello
+Message-ID: <r1@example.net>
+In-Reply-To: <1.anna@sender.test>
+`)
+	deliverTestMessage(t, mbox, `From: Ben's Assistant <office@example.com>
+Subject: Re: Hello
+Message-ID: <r2@example.com>
+References: <older@example.com> <2.ben@sender.test>
+`)
+	// Our own copies and unrelated mail are passed over
+	deliverTestMessage(t, mbox, `From: Jan Kowalski <jan@sender.test>
+Subject: Hello
+Message-ID: <3.cara@sender.test>
+`)
+	deliverTestMessage(t, mbox, `From: news@example.org
+Subject: Our newsletter
+Message-ID: <n1@example.org>
+`)
+
+	state := inboxState{}
+	matched, err := h.pollInbox(config, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched != 2 {
+		t.Errorf("pollInbox() matched %d messages, want 2", matched)
+	}
+	if state.UIDValidity != 1 || state.LastUID != 10 {
+		t.Errorf("state = UIDVALIDITY %d, last UID %d, want 1 and 10", state.UIDValidity, state.LastUID)
+	}
+	for id, want := range map[string]string{"anna": types.OutreachReplied, "ben": types.OutreachReplied, "cara": types.OutreachSent} {
+		if got := contactStatus(t, h, id); got != want {
+			t.Errorf("status of %s = %q, want %q", id, got, want)
+		}
+	}
+
+	// Only messages after the high-water mark are read again
+	deliverTestMessage(t, mbox, `From: Cara <cara@example.com>
+Subject: Re: Hello
+Message-ID: <r3@example.com>
+In-Reply-To: <3.cara@sender.test>
+`)
+	matched, err = h.pollInbox(config, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched != 1 || state.LastUID != 11 {
+		t.Errorf("second pollInbox() matched %d up to UID %d, want 1 up to 11", matched, state.LastUID)
+	}
+	if got := contactStatus(t, h, "cara"); got != types.OutreachReplied {
+		t.Errorf("status of cara = %q, want %q", got, types.OutreachReplied)
+	}
+
+	// A new UIDVALIDITY starts over, reading every message again
+	if _, err := h.db.Exec("DELETE FROM inbound_messages"); err != nil {
+		t.Fatal(err)
+	}
+	state.UIDValidity = 99
+	if _, err := h.pollInbox(config, &state); err != nil {
+		t.Fatal(err)
+	}
+	var stored int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM inbound_messages").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if state.UIDValidity != 1 || stored != 3 {
+		t.Errorf("after a new UIDVALIDITY: UIDVALIDITY %d with %d stored messages, want 1 with 3", state.UIDValidity, stored)
+	}
+}
+
+func TestPollInboxBeforeFirstSend(t *testing.T) {
+	h := newTestHandlers(t)
+	config, mbox := newFakeIMAP(t)
+	deliverTestMessage(t, mbox, `From: Anna <anna@example.com>
+Subject: Hi
+Message-ID: <early@example.com>
+`)
+
+	state := inboxState{}
+	matched, err := h.pollInbox(config, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched != 0 || state.LastUID != 7 {
+		t.Errorf("pollInbox() matched %d up to UID %d, want 0 up to 7", matched, state.LastUID)
+	}
+}
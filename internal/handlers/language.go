@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/abadojack/whatlanggo"
+
+	"outreach-generator/internal/types"
+)
+
+// detectionSample is how much website text language detection reads; the
+// start of a page is enough and keeps long pages cheap.
+const detectionSample = 5000
+
+// minDetectionText is the least website text, in characters, worth running
+// detection on. Shorter text is mostly navigation and names.
+const minDetectionText = 80
+
+// languageAliases are the names a language field may use besides the code,
+// in English and in the language itself.
+var languageAliases = map[string]string{
+	"english":    "en",
+	"polish":     "pl",
+	"polski":     "pl",
+	"german":     "de",
+	"deutsch":    "de",
+	"spanish":    "es",
+	"español":    "es",
+	"espanol":    "es",
+	"french":     "fr",
+	"français":   "fr",
+	"francais":   "fr",
+	"italian":    "it",
+	"italiano":   "it",
+	"dutch":      "nl",
+	"nederlands": "nl",
+	"portuguese": "pt",
+	"português":  "pt",
+	"portugues":  "pt",
+}
+
+// countryLanguages maps countries, by name or ISO code, to the language
+// business email is written in there. Countries with several languages, like
+// Belgium, Switzerland or Canada, are left out so detection or the default
+// decides.
+var countryLanguages = map[string]string{
+	"pl": "pl", "poland": "pl", "polska": "pl",
+	"de": "de", "germany": "de", "deutschland": "de",
+	"at": "de", "austria": "de", "österreich": "de",
+	"li": "de", "liechtenstein": "de",
+	"fr": "fr", "france": "fr",
+	"mc": "fr", "monaco": "fr",
+	"es": "es", "spain": "es", "españa": "es", "espana": "es",
+	"mx": "es", "mexico": "es", "méxico": "es",
+	"ar": "es", "argentina": "es",
+	"cl": "es", "chile": "es",
+	"co": "es", "colombia": "es",
+	"pe": "es", "peru": "es", "perú": "es",
+	"it": "it", "italy": "it", "italia": "it",
+	"nl": "nl", "netherlands": "nl", "the netherlands": "nl", "nederland": "nl", "holland": "nl",
+	"pt": "pt", "portugal": "pt",
+	"br": "pt", "brazil": "pt", "brasil": "pt",
+	"gb": "en", "uk": "en", "united kingdom": "en", "great britain": "en", "england": "en", "scotland": "en", "wales": "en",
+	"ie": "en", "ireland": "en",
+	"us": "en", "usa": "en", "united states": "en", "united states of america": "en",
+	"au": "en", "australia": "en",
+	"nz": "en", "new zealand": "en",
+}
+
+// chooseLanguage picks the language of a contact's outreach: the language
+// field of the contact, then the language detected on its website, then the
+// language of its country, and otherwise the fallback. It returns the
+// language code and which of those decided it. Fallback research is not
+// detected: it is our English description of the contact, or a cached copy
+// with an English note appended.
+func chooseLanguage(contact types.Contact, websiteContent, fallback string) (string, string) {
+	if code, ok := languageCode(contact.Language); ok {
+		return code, types.LanguageFromField
+	}
+	if !contact.LowConfidence {
+		if code, ok := detectLanguage(websiteContent); ok {
+			return code, types.LanguageFromWebsite
+		}
+	}
+	if code := countryLanguages[normalizePlace(contact.Country)]; code != "" {
+		return code, types.LanguageFromCountry
+	}
+	return fallback, types.LanguageFromDefault
+}
+
+// storeOutreachLanguage chooses the language of a contact's outreach and
+// keeps it in the mirror with the reason, so the card can show both. The
+// fallback is the language picked for the source.
+func (h *Handlers) storeOutreachLanguage(contact *types.Contact, websiteContent, fallback string) string {
+	contact.OutreachLanguage, contact.LanguageReason = chooseLanguage(*contact, websiteContent, fallback)
+	if err := h.saveOutreachLanguage(*contact); err != nil {
+		log.Printf("Warning: Failed to save outreach language for %s: %v", contact.ID, err)
+	}
+	return contact.OutreachLanguage
+}
+
+// languageCode reads a language field, which may hold a code such as "fr" or
+// "fr-CA", or a language name. Languages outreach cannot be written in are
+// ignored.
+func languageCode(value string) (string, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if code, ok := languageAliases[value]; ok {
+		return code, true
+	}
+	if i := strings.IndexAny(value, "-_"); i > 0 {
+		value = value[:i]
+	}
+	return value, knownLanguage(value)
+}
+
+// detectLanguage runs trigram detection on website text. Only a reliable
+// detection of a language outreach can be written in counts.
+func detectLanguage(text string) (string, bool) {
+	if len(text) > detectionSample {
+		text = strings.ToValidUTF8(text[:detectionSample], "")
+	}
+	if utf8.RuneCountInString(strings.Join(strings.Fields(text), " ")) < minDetectionText {
+		return "", false
+	}
+	info := whatlanggo.Detect(text)
+	if !info.IsReliable() {
+		return "", false
+	}
+	code := info.Lang.Iso6391()
+	return code, knownLanguage(code)
+}
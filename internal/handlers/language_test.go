@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"outreach-generator/internal/types"
+)
+
+func TestChooseLanguage(t *testing.T) {
+	french := strings.Repeat("Nous fabriquons des onduleurs solaires pour les petites exploitations agricoles de la région. ", 3)
+	german := strings.Repeat("Wir entwickeln Wechselrichter für kleine landwirtschaftliche Betriebe in der ganzen Region. ", 3)
+	lyon := types.Contact{City: "Lyon", Country: "France"}
+	fallback := lyon
+	markFallback(&fallback, "contact details and business segment only")
+
+	tests := []struct {
+		name       string
+		contact    types.Contact
+		content    string
+		wantCode   string
+		wantReason string
+	}{
+		{"field", types.Contact{Language: "Deutsch", Country: "France"}, french, "de", types.LanguageFromField},
+		{"website", lyon, german, "de", types.LanguageFromWebsite},
+		{"country", lyon, "", "fr", types.LanguageFromCountry},
+		{"contact data fallback", fallback, contactResearch(fallback), "fr", types.LanguageFromCountry},
+		{"default", types.Contact{Country: "Switzerland"}, "", "en", types.LanguageFromDefault},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, reason := chooseLanguage(tt.contact, tt.content, "en")
+			if code != tt.wantCode || reason != tt.wantReason {
+				t.Errorf("chooseLanguage() = %s, %s, want %s, %s", code, reason, tt.wantCode, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,478 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"outreach-generator/internal/types"
+)
+
+const (
+	smtpDialTimeout = 30 * time.Second
+	// smtpSessionTimeout bounds a whole session, from connecting to QUIT
+	smtpSessionTimeout = 2 * time.Minute
+)
+
+var errSMTPNotConfigured = errors.New("SMTP is not configured: set the host and from address on /config")
+
+// recipientError is a failure caused by one message or recipient rather
+// than the server or account, so the next message may still go through.
+type recipientError struct {
+	error
+}
+
+func (e recipientError) Unwrap() error {
+	return e.error
+}
+
+// outgoingMessage is an email ready to be encoded. Body is the plain text
+// and HTML, when set, its alternative.
+type outgoingMessage struct {
+	From      *mail.Address
+	To        *mail.Address
+	Subject   string
+	Body      string
+	HTML      string
+	MessageID string
+	// InReplyTo threads a follow-up under the initial outreach
+	InReplyTo string
+	Date      time.Time
+	// Draft marks the message as unsent, so mail clients open it ready to
+	// edit and send
+	Draft bool
+}
+
+// outreachMessage builds the email for a contact's outreach, with the
+// subject and body parsed from the generated text.
+func outreachMessage(config types.Config, contact types.Contact) (outgoingMessage, error) {
+	if config.SMTPHost == "" || config.SMTPFrom == "" {
+		return outgoingMessage{}, errSMTPNotConfigured
+	}
+	msg, err := composeOutreach(config, contact)
+	if err != nil {
+		return outgoingMessage{}, err
+	}
+	msg.MessageID, err = newMessageID(msg.From.Address)
+	return msg, err
+}
+
+// composeOutreach renders a contact's outreach as it is sent, but without
+// what only sending needs: the from address is left out when none is
+// configured, and there is no Message-ID yet. Drafts and previews use it.
+func composeOutreach(config types.Config, contact types.Contact) (outgoingMessage, error) {
+	var from *mail.Address
+	if config.SMTPFrom != "" {
+		var err error
+		if from, err = mail.ParseAddress(config.SMTPFrom); err != nil {
+			return outgoingMessage{}, fmt.Errorf("invalid from address: %w", err)
+		}
+	}
+	to, err := mail.ParseAddress(contact.Email)
+	if err != nil || contact.Email == "" {
+		return outgoingMessage{}, recipientError{fmt.Errorf("invalid recipient %q", contact.Email)}
+	}
+	to.Name = contact.Fullname
+
+	subject, body := parseOutreach(contact.OutreachText)
+	if subject == "" || body == "" {
+		return outgoingMessage{}, recipientError{errors.New("the outreach needs a subject line and a body")}
+	}
+	text, html := renderEmail(config, body)
+	return outgoingMessage{
+		From:    from,
+		To:      to,
+		Subject: subject,
+		Body:    text,
+		HTML:    html,
+		Date:    time.Now(),
+	}, nil
+}
+
+// followUpMessage builds a follow-up as a reply to the initial outreach,
+// so mail clients show the sequence as one conversation.
+func followUpMessage(config types.Config, contact types.Contact, initial types.SendResult, body string) (outgoingMessage, error) {
+	if config.SMTPHost == "" || config.SMTPFrom == "" {
+		return outgoingMessage{}, errSMTPNotConfigured
+	}
+	from, err := mail.ParseAddress(config.SMTPFrom)
+	if err != nil {
+		return outgoingMessage{}, fmt.Errorf("invalid from address: %w", err)
+	}
+	// Follow-ups go where the initial outreach went
+	to := &mail.Address{Name: contact.Fullname, Address: initial.To}
+	if strings.TrimSpace(body) == "" {
+		return outgoingMessage{}, recipientError{errors.New("the follow-up is empty")}
+	}
+
+	subject := initial.Subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	msg, err := newMessage(config, from, to, subject, body)
+	msg.InReplyTo = initial.MessageID
+	return msg, err
+}
+
+func newMessage(config types.Config, from, to *mail.Address, subject, body string) (outgoingMessage, error) {
+	messageID, err := newMessageID(from.Address)
+	if err != nil {
+		return outgoingMessage{}, err
+	}
+	text, html := renderEmail(config, body)
+	return outgoingMessage{
+		From:      from,
+		To:        to,
+		Subject:   subject,
+		Body:      text,
+		HTML:      html,
+		MessageID: messageID,
+		Date:      time.Now(),
+	}, nil
+}
+
+// newMessageID makes a unique Message-ID in the sender's domain.
+func newMessageID(from string) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().Unix(), hex.EncodeToString(b), domain), nil
+}
+
+// encode renders the message with CRLF line endings. Non-ASCII subjects
+// and names are MIME encoded and long header lines are folded. The text,
+// and the HTML as a multipart/alternative when there is one, are
+// quoted-printable with lines starting "From " escaped, so the message can
+// be stored in an mbox file unchanged. A message without a from address or
+// Message-ID leaves them to the mail client that sends it.
+func (m outgoingMessage) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		buf.WriteString(foldHeader(name, value) + "\r\n")
+	}
+	if m.From != nil {
+		header("From", m.From.String())
+	}
+	header("To", m.To.String())
+	header("Subject", encodeWords(m.Subject))
+	header("Date", m.Date.Format(time.RFC1123Z))
+	if m.MessageID != "" {
+		header("Message-ID", m.MessageID)
+	}
+	if m.Draft {
+		header("X-Unsent", "1")
+	}
+	if m.InReplyTo != "" {
+		header("In-Reply-To", m.InReplyTo)
+		header("References", m.InReplyTo)
+	}
+	header("MIME-Version", "1.0")
+
+	text, err := quotedPrintable(m.Body)
+	if err != nil {
+		return nil, err
+	}
+	if m.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n" + text + "\r\n")
+		return buf.Bytes(), nil
+	}
+
+	html, err := quotedPrintable(m.HTML)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	header("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", parts.Boundary()))
+	buf.WriteString("\r\n")
+	// Clients show the last alternative they support, so HTML comes last
+	for _, part := range []struct{ contentType, data string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(w, part.data+"\r\n"); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// quotedPrintable encodes text with CRLF line endings.
+func quotedPrintable(text string) (string, error) {
+	var b bytes.Buffer
+	qp := quotedprintable.NewWriter(&b)
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if _, err := qp.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n"))); err != nil {
+		return "", err
+	}
+	if err := qp.Close(); err != nil {
+		return "", err
+	}
+	return escapeFromLines(b.String()), nil
+}
+
+// maxQPLine is the longest line quoted-printable allows.
+const maxQPLine = 76
+
+// escapeFromLines encodes the F of quoted-printable lines starting with
+// "From ", which mbox readers take for the start of the next message, and
+// breaks lines the escape makes too long.
+func escapeFromLines(encoded string) string {
+	lines := strings.Split(encoded, "\r\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "From ") {
+			continue
+		}
+		line = "=46" + line[1:]
+		if len(line) > maxQPLine {
+			// Break before the soft line break's "=", never inside an =XX escape
+			cut := maxQPLine - 1
+			for line[cut-1] == '=' || line[cut-2] == '=' {
+				cut--
+			}
+			line = line[:cut] + "=\r\n" + line[cut:]
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// maxHeaderLine is the line length header lines stay within: RFC 2047
+// limits lines with encoded words to 76 characters.
+const maxHeaderLine = 76
+
+// maxEncodedWord keeps an encoded word and the field name on one line.
+const maxEncodedWord = 60
+
+// encodeWords MIME encodes a header value that is not plain ASCII as
+// Q-encoded UTF-8 words separated by spaces, short enough for foldHeader
+// to keep every line within maxHeaderLine. Characters are never split
+// across words.
+func encodeWords(s string) string {
+	if mime.QEncoding.Encode("utf-8", s) == s {
+		return s
+	}
+	const prefix, suffix = "=?utf-8?q?", "?="
+	var words []string
+	var word strings.Builder
+	for _, r := range s {
+		var enc string
+		switch {
+		case r == ' ':
+			enc = "_"
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("!*+-/", r)):
+			enc = string(r)
+		default:
+			for _, b := range []byte(string(r)) {
+				enc += fmt.Sprintf("=%02X", b)
+			}
+		}
+		if word.Len() > 0 && len(prefix)+word.Len()+len(enc)+len(suffix) > maxEncodedWord {
+			words = append(words, prefix+word.String()+suffix)
+			word.Reset()
+		}
+		word.WriteString(enc)
+	}
+	words = append(words, prefix+word.String()+suffix)
+	return strings.Join(words, " ")
+}
+
+// foldHeader breaks a header line at spaces so its lines stay within
+// maxHeaderLine where possible, never right after the field name. Encoded
+// words are separated by spaces, so long encoded subjects fold between them.
+func foldHeader(name, value string) string {
+	var b strings.Builder
+	line := name + ": " + value
+	start := len(name) + 2
+	for len(line) > maxHeaderLine {
+		i := strings.LastIndex(line[start:maxHeaderLine+1], " ")
+		if i <= 0 {
+			// A word longer than a line is broken after it instead
+			if i = strings.Index(line[start+1:], " "); i < 0 {
+				break
+			}
+			i++
+		}
+		i += start
+		b.WriteString(line[:i] + "\r\n")
+		line = line[i:]
+		start = 1
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// dialSMTP connects to the configured server, says hello and secures the
+// connection as configured. STARTTLS is required, not opportunistic, so a
+// server that stops offering it cannot downgrade the session.
+func dialSMTP(config types.Config) (*smtp.Client, error) {
+	if config.SMTPHost == "" {
+		return nil, errSMTPNotConfigured
+	}
+	port := config.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(config.SMTPHost, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: config.SMTPHost}
+
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	var conn net.Conn
+	var err error
+	if config.SMTPSecurity == types.SMTPTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpSessionTimeout))
+
+	c, err := smtp.NewClient(conn, config.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("greeting from %s: %w", addr, err)
+	}
+	if err := c.Hello(heloName(config)); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("EHLO: %w", err)
+	}
+
+	if config.SMTPSecurity == "" || config.SMTPSecurity == types.SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, errors.New("the server does not offer STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("STARTTLS: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// heloName introduces us with the from address's domain, which many
+// servers prefer over "localhost".
+func heloName(config types.Config) string {
+	if from, err := mail.ParseAddress(config.SMTPFrom); err == nil {
+		if i := strings.LastIndex(from.Address, "@"); i >= 0 {
+			return from.Address[i+1:]
+		}
+	}
+	return "localhost"
+}
+
+// authenticateSMTP logs in when a username is configured. PLAIN auth is
+// refused over unencrypted connections except to localhost.
+func authenticateSMTP(c *smtp.Client, config types.Config) error {
+	if config.SMTPUsername == "" {
+		return nil
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return errors.New("the server does not offer authentication")
+	}
+	if err := c.Auth(smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, config.SMTPHost)); err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+	return nil
+}
+
+// sendMail delivers a message and returns the server's reply to the
+// message data, which usually carries its queue ID.
+func sendMail(config types.Config, msg outgoingMessage) (string, error) {
+	data, err := msg.encode()
+	if err != nil {
+		return "", err
+	}
+
+	c, err := dialSMTP(config)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	if err := authenticateSMTP(c, config); err != nil {
+		return "", err
+	}
+	if err := c.Mail(msg.From.Address); err != nil {
+		return "", fmt.Errorf("MAIL FROM: %w", err)
+	}
+	if err := c.Rcpt(msg.To.Address); err != nil {
+		return "", replyError("RCPT TO", err)
+	}
+
+	// smtp.Client.Data hides the final reply, so DATA is sent by hand
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return "", fmt.Errorf("DATA: %w", err)
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", fmt.Errorf("DATA: %w", err)
+	}
+
+	w := c.Text.DotWriter()
+	if _, err := w.Write(data); err != nil {
+		return "", fmt.Errorf("writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("writing message: %w", err)
+	}
+	code, reply, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return "", replyError("message rejected", err)
+	}
+
+	// The message is accepted at this point; a failed QUIT changes nothing
+	c.Quit()
+	return fmt.Sprintf("%d %s", code, reply), nil
+}
+
+// replyError wraps a failed reply to a recipient or message. Permanent 5xx
+// replies are recipient errors; 4xx replies such as greylisting are
+// temporary, so the message is retried later.
+func replyError(step string, err error) error {
+	err = fmt.Errorf("%s: %w", step, err)
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return recipientError{err}
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+// fakeSMTP is a scripted SMTP server. Replies override the default reply to
+// a command, "." being the reply to the message data.
+type fakeSMTP struct {
+	addr       *net.TCPAddr
+	extensions []string
+	replies    map[string]string
+	messages   chan string
+}
+
+func newFakeSMTP(t *testing.T, extensions []string, replies map[string]string) *fakeSMTP {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &fakeSMTP{
+		addr:       ln.Addr().(*net.TCPAddr),
+		extensions: extensions,
+		replies:    replies,
+		messages:   make(chan string, 1),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) reply(cmd, fallback string) string {
+	if r, ok := s.replies[cmd]; ok {
+		return r
+	}
+	return fallback
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	tp := textproto.NewConn(conn)
+
+	tp.PrintfLine("220 fake.test ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch cmd {
+		case "EHLO":
+			// The first line greets, the rest list extensions
+			lines := append([]string{"fake.test"}, s.extensions...)
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, l)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("%s", s.reply(cmd, "454 4.7.0 TLS not available"))
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("%s", s.reply(cmd, "250 2.1.0 Ok"))
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.messages <- string(data)
+			tp.PrintfLine("%s", s.reply(".", "250 2.0.0 Ok: queued as ABC123"))
+		case "QUIT":
+			tp.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			tp.PrintfLine("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+func (s *fakeSMTP) config(security string) types.Config {
+	return types.Config{
+		SMTPHost:     s.addr.IP.String(),
+		SMTPPort:     s.addr.Port,
+		SMTPSecurity: security,
+		SMTPFrom:     "Jan Kowalski <jan@sender.test>",
+	}
+}
+
+func testMessage(t *testing.T) outgoingMessage {
+	t.Helper()
+	msg, err := newMessage(types.Config{EmailFormat: "text"},
+		&mail.Address{Name: "Jan Kowalski", Address: "jan@sender.test"},
+		&mail.Address{Name: "Anna Nowak", Address: "anna@example.com"},
+		"Hello", "Hi Anna,\n\nA short note.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSendMailReturnsDataReply(t *testing.T) {
+	server := newFakeSMTP(t, nil, nil)
+	msg := testMessage(t)
+
+	reply, err := sendMail(server.config(types.SMTPNone), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "250 2.0.0 Ok: queued as ABC123" {
+		t.Errorf("sendMail() = %q, want the reply to the message data", reply)
+	}
+
+	select {
+	case data := <-server.messages:
+		// ReadDotBytes turns CRLF into LF
+		if !strings.Contains(data, "Message-ID: "+msg.MessageID+"\n") {
+			t.Errorf("message is missing Message-ID %s:\n%s", msg.MessageID, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server received no message")
+	}
+}
+
+func TestDialSMTPRequiresStartTLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		wantErr    string
+	}{
+		{"not offered", nil, "does not offer STARTTLS"},
+		{"refused", []string{"STARTTLS"}, "STARTTLS: 454"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, tt.extensions, nil)
+
+			_, err := sendMail(server.config(types.SMTPStartTLS), testMessage(t))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("sendMail() error = %v, want %q", err, tt.wantErr)
+			}
+			select {
+			case <-server.messages:
+				t.Error("the message was sent without TLS")
+			default:
+			}
+		})
+	}
+}
+
+func TestSendMailSortsRejections(t *testing.T) {
+	tests := []struct {
+		name          string
+		replies       map[string]string
+		wantRecipient bool
+	}{
+		{"unknown recipient", map[string]string{"RCPT": "550 5.1.1 User unknown"}, true},
+		{"greylisted recipient", map[string]string{"RCPT": "450 4.2.0 Greylisted, try again later"}, false},
+		{"message rejected", map[string]string{".": "554 5.7.1 Message refused as spam"}, true},
+		{"message deferred", map[string]string{".": "451 4.3.0 Temporary failure"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, nil, tt.replies)
+
+			_, err := sendMail(server.config(types.SMTPNone), testMessage(t))
+			if err == nil {
+				t.Fatal("sendMail() succeeded, want an error")
+			}
+			var rejected recipientError
+			if got := errors.As(err, &rejected); got != tt.wantRecipient {
+				t.Errorf("sendMail() error %v is a recipient error: %v, want %v", err, got, tt.wantRecipient)
+			}
+		})
+	}
+}
+
+func TestHeloNameUsesFromDomain(t *testing.T) {
+	for from, want := range map[string]string{
+		"Jan <jan@sender.test>": "sender.test",
+		"":                      "localhost",
+	} {
+		if got := heloName(types.Config{SMTPFrom: from}); got != want {
+			t.Errorf("heloName(%q) = %q, want %q", from, got, want)
+		}
+	}
+}
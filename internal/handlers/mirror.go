@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+// sourceAirtable names contacts mirrored from Airtable.
+const sourceAirtable = "airtable"
+
+const contactColumns = `id, fullname, company_name, business_segment, website, phone, city, country, email,
+	language, outreach_text, outreach_status, outreach_model, outreach_generated_at, outreach_language,
+	language_reason, website_status, website_detail, created_time, source`
+
+func scanContact(row interface{ Scan(...interface{}) error }) (types.Contact, error) {
+	var c types.Contact
+	err := row.Scan(&c.ID, &c.Fullname, &c.CompanyName, &c.BusinessSegment, &c.Website, &c.Phone,
+		&c.City, &c.Country, &c.Email, &c.Language, &c.OutreachText, &c.OutreachStatus, &c.OutreachModel,
+		&c.GeneratedAt, &c.OutreachLanguage, &c.LanguageReason, &c.WebsiteStatus, &c.WebsiteDetail,
+		&c.CreatedTime, &c.Source)
+	return c, err
+}
+
+// listContacts returns the mirrored contacts of a source in source order.
+func (h *Handlers) listContacts(source string) ([]types.Contact, error) {
+	rows, err := h.db.Query(`SELECT `+contactColumns+` FROM contacts
+		WHERE source = ? ORDER BY created_time, id`, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contacts []types.Contact
+	for rows.Next() {
+		c, err := scanContact(rows)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return contacts, h.attachSendState(contacts)
+}
+
+func (h *Handlers) getContact(id string) (types.Contact, error) {
+	c, err := scanContact(h.db.QueryRow(`SELECT `+contactColumns+` FROM contacts WHERE id = ?`, id))
+	if err != nil {
+		return c, err
+	}
+	contacts := []types.Contact{c}
+	err = h.attachSendState(contacts)
+	return contacts[0], err
+}
+
+// upsertContacts stores contacts from a source. Website diagnostics are kept,
+// since the source does not know about them.
+func upsertContacts(tx *sql.Tx, source string, contacts []types.Contact, now time.Time) error {
+	stmt, err := tx.Prepare(`INSERT INTO contacts (id, source, fullname, company_name, business_segment,
+			website, phone, city, country, email, language, outreach_text, outreach_status, outreach_model,
+			outreach_generated_at, created_time, synced_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			source = excluded.source,
+			fullname = excluded.fullname,
+			company_name = excluded.company_name,
+			business_segment = excluded.business_segment,
+			website = excluded.website,
+			phone = excluded.phone,
+			city = excluded.city,
+			country = excluded.country,
+			email = excluded.email,
+			language = excluded.language,
+			outreach_text = excluded.outreach_text,
+			outreach_status = excluded.outreach_status,
+			outreach_model = excluded.outreach_model,
+			outreach_generated_at = excluded.outreach_generated_at,
+			created_time = excluded.created_time,
+			synced_at = excluded.synced_at,
+			website_status = CASE WHEN contacts.website = excluded.website THEN contacts.website_status ELSE '' END,
+			website_detail = CASE WHEN contacts.website = excluded.website THEN contacts.website_detail ELSE '' END`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, c := range contacts {
+		if _, err := stmt.Exec(c.ID, source, c.Fullname, c.CompanyName, c.BusinessSegment,
+			c.Website, c.Phone, c.City, c.Country, c.Email, c.Language, c.OutreachText, c.OutreachStatus,
+			c.OutreachModel, c.GeneratedAt, c.CreatedTime, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteContactsNotSynced removes contacts of a source that a full sync
+// started at syncStart did not see, i.e. records deleted upstream.
+func deleteContactsNotSynced(tx *sql.Tx, source string, syncStart time.Time) (int64, error) {
+	res, err := tx.Exec("DELETE FROM contacts WHERE source = ? AND synced_at < ?", source, syncStart)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// applyOutreachUpdate mirrors a successful Airtable write locally.
+func (h *Handlers) applyOutreachUpdate(u types.OutreachUpdate) error {
+	var sets []string
+	var args []interface{}
+	if u.Body != "" {
+		sets = append(sets, "outreach_text = ?")
+		args = append(args, u.Body)
+	}
+	if u.Status != "" {
+		sets = append(sets, "outreach_status = ?")
+		args = append(args, u.Status)
+	}
+	if u.Model != "" {
+		sets = append(sets, "outreach_model = ?")
+		args = append(args, u.Model)
+	}
+	if !u.GeneratedAt.IsZero() {
+		sets = append(sets, "outreach_generated_at = ?")
+		args = append(args, u.GeneratedAt.UTC().Format(time.RFC3339))
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	args = append(args, u.RecordID)
+	_, err := h.db.Exec("UPDATE contacts SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+	return err
+}
+
+// saveWebsiteStatus keeps the last diagnosis so the website filter still
+// works after a reload.
+func (h *Handlers) saveWebsiteStatus(contact types.Contact) error {
+	_, err := h.db.Exec("UPDATE contacts SET website_status = ?, website_detail = ? WHERE id = ?",
+		contact.WebsiteStatus, contact.WebsiteDetail, contact.ID)
+	return err
+}
+
+// saveOutreachLanguage keeps the language chosen for a contact's outreach
+// and why, for the contact card.
+func (h *Handlers) saveOutreachLanguage(contact types.Contact) error {
+	_, err := h.db.Exec("UPDATE contacts SET outreach_language = ?, language_reason = ? WHERE id = ?",
+		contact.OutreachLanguage, contact.LanguageReason, contact.ID)
+	return err
+}
+
+func (h *Handlers) loadSyncState(source string) (types.SyncStatus, error) {
+	status := types.SyncStatus{Source: source}
+	var lastSync, lastFull sql.NullTime
+	err := h.db.QueryRow(`SELECT last_sync_at, last_full_sync_at, records, changed, error
+		FROM sync_state WHERE source = ?`, source).
+		Scan(&lastSync, &lastFull, &status.Records, &status.Changed, &status.Error)
+	if err == sql.ErrNoRows {
+		return status, nil
+	}
+	status.LastSyncAt = lastSync.Time
+	status.LastFullSyncAt = lastFull.Time
+	return status, err
+}
+
+func (h *Handlers) saveSyncState(status types.SyncStatus) error {
+	var lastSync, lastFull interface{}
+	if !status.LastSyncAt.IsZero() {
+		lastSync = status.LastSyncAt.UTC()
+	}
+	if !status.LastFullSyncAt.IsZero() {
+		lastFull = status.LastFullSyncAt.UTC()
+	}
+	_, err := h.db.Exec(`INSERT OR REPLACE INTO sync_state
+		(source, last_sync_at, last_full_sync_at, records, changed, error) VALUES (?, ?, ?, ?, ?, ?)`,
+		status.Source, lastSync, lastFull, status.Records, status.Changed, status.Error)
+	return err
+}
+
+func (h *Handlers) countContacts(source string) (int, error) {
+	var n int
+	err := h.db.QueryRow("SELECT COUNT(*) FROM contacts WHERE source = ?", source).Scan(&n)
+	return n, err
+}
+
+// recordSend logs an attempt to email a contact.
+func (h *Handlers) recordSend(result types.SendResult) error {
+	_, err := h.db.Exec(`INSERT INTO sends (contact_id, step, sender, recipient, subject, body, message_id, response, error, sent_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		result.ContactID, result.Step, result.From, result.To, result.Subject, result.Body, result.MessageID, result.Response, result.Error, result.SentAt.UTC())
+	return err
+}
+
+// attachSendState sets the latest send attempt and incoming message,
+// whether the contact is queued, the recipient's timezone and where they
+// stand in a sequence.
+func (h *Handlers) attachSendState(contacts []types.Contact) error {
+	if err := h.attachLastSends(contacts); err != nil {
+		return err
+	}
+	if err := h.attachLastInbound(contacts); err != nil {
+		return err
+	}
+	queued, err := h.queuedContacts()
+	if err != nil {
+		return err
+	}
+	for i := range contacts {
+		contacts[i].Queued = queued[contacts[i].ID]
+		contacts[i].Timezone = recipientTimezone(contacts[i].City, contacts[i].Country)
+	}
+	return h.attachSequences(contacts)
+}
+
+// attachLastSends sets the latest send attempt on every contact that has
+// one.
+func (h *Handlers) attachLastSends(contacts []types.Contact) error {
+	if len(contacts) == 0 {
+		return nil
+	}
+	index := map[string]int{}
+	for i, c := range contacts {
+		index[c.ID] = i
+	}
+
+	rows, err := h.db.Query(`SELECT ` + sendColumns + ` FROM sends
+		WHERE id IN (SELECT MAX(id) FROM sends GROUP BY contact_id)`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanSend(rows)
+		if err != nil {
+			return err
+		}
+		if i, ok := index[r.ContactID]; ok {
+			result := r
+			contacts[i].LastSend = &result
+		}
+	}
+	return rows.Err()
+}
+
+const sendColumns = `contact_id, step, sender, recipient, subject, body, message_id, response, error, sent_at`
+
+func scanSend(row interface{ Scan(...interface{}) error }) (types.SendResult, error) {
+	var r types.SendResult
+	err := row.Scan(&r.ContactID, &r.Step, &r.From, &r.To, &r.Subject, &r.Body, &r.MessageID, &r.Response, &r.Error, &r.SentAt)
+	return r, err
+}
+
+// wasSent reports whether a step of a contact's sequence has already been
+// delivered, so a status that failed to reach the source cannot cause a
+// second email.
+func (h *Handlers) wasSent(contactID string, step int) (bool, error) {
+	var sent bool
+	err := h.db.QueryRow("SELECT COUNT(*) > 0 FROM sends WHERE contact_id = ? AND step = ? AND error = ''",
+		contactID, step).Scan(&sent)
+	return sent, err
+}
+
+// deliveredMessages returns the messages delivered to a contact, one per
+// step in step order.
+func (h *Handlers) deliveredMessages(contactID string) ([]types.SendResult, error) {
+	rows, err := h.db.Query(`SELECT `+sendColumns+` FROM sends
+		WHERE id IN (SELECT MIN(id) FROM sends WHERE contact_id = ? AND error = '' GROUP BY step)
+		ORDER BY step`, contactID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sends []types.SendResult
+	for rows.Next() {
+		r, err := scanSend(rows)
+		if err != nil {
+			return nil, err
+		}
+		sends = append(sends, r)
+	}
+	return sends, rows.Err()
+}
+
+// countSentSince counts the messages a mailbox delivered since a time.
+func (h *Handlers) countSentSince(mailbox string, since time.Time) (int, error) {
+	var n int
+	err := h.db.QueryRow("SELECT COUNT(*) FROM sends WHERE sender = ? AND error = '' AND sent_at >= ?",
+		mailbox, since.UTC()).Scan(&n)
+	return n, err
+}
+
+// queueContacts adds contacts to the send queue, keeping the queue time of
+// contacts already in it.
+func (h *Handlers) queueContacts(ids []string, now time.Time) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO send_queue (contact_id, queued_at) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		if _, err := stmt.Exec(id, now.UTC()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// queueFollowUp queues a follow-up step of a contact's sequence.
+func (h *Handlers) queueFollowUp(id string, step int, now time.Time) error {
+	_, err := h.db.Exec("INSERT OR REPLACE INTO send_queue (contact_id, step, queued_at) VALUES (?, ?, ?)",
+		id, step, now.UTC())
+	return err
+}
+
+func (h *Handlers) unqueueContact(id string) error {
+	_, err := h.db.Exec("DELETE FROM send_queue WHERE contact_id = ?", id)
+	return err
+}
+
+// queuedSend is a message waiting in the send queue.
+type queuedSend struct {
+	ContactID string
+	Step      int
+}
+
+// listSendQueue returns the queued messages, oldest first.
+func (h *Handlers) listSendQueue() ([]queuedSend, error) {
+	rows, err := h.db.Query("SELECT contact_id, step FROM send_queue ORDER BY queued_at, contact_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queue []queuedSend
+	for rows.Next() {
+		var q queuedSend
+		if err := rows.Scan(&q.ContactID, &q.Step); err != nil {
+			return nil, err
+		}
+		queue = append(queue, q)
+	}
+	return queue, rows.Err()
+}
+
+func (h *Handlers) queuedContacts() (map[string]bool, error) {
+	queue, err := h.listSendQueue()
+	queued := map[string]bool{}
+	for _, q := range queue {
+		queued[q.ContactID] = true
+	}
+	return queued, err
+}
+
+func (h *Handlers) loadMailboxState(mailbox string) (types.SendQueueStatus, error) {
+	status := types.SendQueueStatus{Mailbox: mailbox}
+	var nextSend sql.NullTime
+	err := h.db.QueryRow("SELECT paused, next_send_at, error FROM mailbox_state WHERE mailbox = ?", mailbox).
+		Scan(&status.Paused, &nextSend, &status.Error)
+	if err == sql.ErrNoRows {
+		return status, nil
+	}
+	status.NextSendAt = nextSend.Time
+	return status, err
+}
+
+func (h *Handlers) saveMailboxState(status types.SendQueueStatus) error {
+	var nextSend interface{}
+	if !status.NextSendAt.IsZero() {
+		nextSend = status.NextSendAt.UTC()
+	}
+	_, err := h.db.Exec("INSERT OR REPLACE INTO mailbox_state (mailbox, paused, next_send_at, error) VALUES (?, ?, ?, ?)",
+		status.Mailbox, status.Paused, nextSend, status.Error)
+	return err
+}
+
+// attachLastInbound sets the latest reply, auto-reply or bounce on every
+// contact that has one.
+func (h *Handlers) attachLastInbound(contacts []types.Contact) error {
+	if len(contacts) == 0 {
+		return nil
+	}
+	index := map[string]int{}
+	for i, c := range contacts {
+		index[c.ID] = i
+	}
+
+	rows, err := h.db.Query(`SELECT contact_id, kind, sender, subject, COALESCE(message_id, ''), detail, received_at
+		FROM inbound_messages WHERE id IN (SELECT MAX(id) FROM inbound_messages GROUP BY contact_id)`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m types.InboundMessage
+		if err := rows.Scan(&m.ContactID, &m.Kind, &m.From, &m.Subject, &m.MessageID, &m.Detail, &m.ReceivedAt); err != nil {
+			return err
+		}
+		if i, ok := index[m.ContactID]; ok {
+			msg := m
+			contacts[i].LastInbound = &msg
+		}
+	}
+	return rows.Err()
+}
+
+// recordInbound stores an incoming message matched to a contact. It reports
+// false when the message was already stored, so it is acted on only once.
+func (h *Handlers) recordInbound(m types.InboundMessage) (bool, error) {
+	var messageID interface{}
+	if m.MessageID != "" {
+		messageID = m.MessageID
+	}
+	res, err := h.db.Exec(`INSERT OR IGNORE INTO inbound_messages
+		(contact_id, kind, sender, subject, message_id, detail, received_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.ContactID, m.Kind, m.From, m.Subject, messageID, m.Detail, m.ReceivedAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// countInbound counts the stored replies, auto-replies and bounces.
+func (h *Handlers) countInbound(status *types.InboxStatus) error {
+	rows, err := h.db.Query("SELECT kind, COUNT(*) FROM inbound_messages GROUP BY kind")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind string
+		var n int
+		if err := rows.Scan(&kind, &n); err != nil {
+			return err
+		}
+		switch kind {
+		case types.InboundReply:
+			status.Replies = n
+		case types.InboundAutoReply:
+			status.AutoReplies = n
+		case types.InboundBounce:
+			status.Bounces = n
+		}
+	}
+	return rows.Err()
+}
+
+// contactByMessageID finds the contact a message with one of the IDs was
+// sent to, or "" when none was.
+func (h *Handlers) contactByMessageID(ids []string) (string, error) {
+	for _, id := range ids {
+		var contactID string
+		err := h.db.QueryRow("SELECT contact_id FROM sends WHERE message_id = ? AND error = '' ORDER BY id DESC LIMIT 1", id).
+			Scan(&contactID)
+		if err == nil {
+			return contactID, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// contactByRecipient finds the contact last emailed at one of the addresses
+// before a time, or "" when none was.
+func (h *Handlers) contactByRecipient(addrs []string, before time.Time) (string, error) {
+	for _, addr := range addrs {
+		var contactID string
+		err := h.db.QueryRow(`SELECT contact_id FROM sends
+			WHERE LOWER(recipient) = ? AND error = '' AND sent_at <= ? ORDER BY id DESC LIMIT 1`, addr, before.UTC()).
+			Scan(&contactID)
+		if err == nil {
+			return contactID, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// firstDelivery is when the first message was delivered, zero before any
+// was.
+func (h *Handlers) firstDelivery() (time.Time, error) {
+	var first time.Time
+	err := h.db.QueryRow("SELECT sent_at FROM sends WHERE error = '' ORDER BY sent_at LIMIT 1").Scan(&first)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return first, err
+}
+
+func (h *Handlers) loadInboxState(mailbox string) (inboxState, error) {
+	state := inboxState{InboxStatus: types.InboxStatus{Mailbox: mailbox}}
+	var checked sql.NullTime
+	err := h.db.QueryRow("SELECT uid_validity, last_uid, checked_at, error FROM inbox_state WHERE mailbox = ?", mailbox).
+		Scan(&state.UIDValidity, &state.LastUID, &checked, &state.Error)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	state.CheckedAt = checked.Time
+	return state, err
+}
+
+func (h *Handlers) saveInboxState(state inboxState) error {
+	var checked interface{}
+	if !state.CheckedAt.IsZero() {
+		checked = state.CheckedAt.UTC()
+	}
+	_, err := h.db.Exec(`INSERT OR REPLACE INTO inbox_state (mailbox, uid_validity, last_uid, checked_at, error)
+		VALUES (?, ?, ?, ?, ?)`, state.Mailbox, state.UIDValidity, state.LastUID, checked, state.Error)
+	return err
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+// subjectPrefix matches a "Subject:" label the model sometimes puts in front
+// of the subject line, in the languages we generate.
+var subjectPrefix = regexp.MustCompile(`(?i)^\s*(\*\*)?(subject|temat|betreff|asunto|objet)\s*:\s*(\*\*)?\s*`)
+
+// parseOutreach splits generated text into the subject on the first line and
+// the body after it, as the prompt asks the model to write it.
+func parseOutreach(text string) (subject, body string) {
+	text = strings.TrimSpace(text)
+	first, rest, _ := strings.Cut(text, "\n")
+	subject = strings.TrimSpace(subjectPrefix.ReplaceAllString(first, ""))
+	subject = strings.Trim(subject, "*# ")
+	return subject, strings.TrimSpace(rest)
+}
+
+// metadataEnabled reports whether a metadata item is in the configured set.
+// "none" turns all metadata off.
+func metadataEnabled(config types.Config, item string) bool {
+	for _, enabled := range splitList(config.AirtableMetadata) {
+		if strings.EqualFold(enabled, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// outreachFields maps an update to Airtable field names, leaving out the
+// metadata that is not enabled or has no field name.
+func outreachFields(config types.Config, u types.OutreachUpdate) map[string]interface{} {
+	fields := map[string]interface{}{}
+	set := func(item, name string, value interface{}) {
+		if name != "" && (item == "" || metadataEnabled(config, item)) {
+			fields[name] = value
+		}
+	}
+
+	if u.Body != "" {
+		set("", config.AirtableBodyField, u.Body)
+	}
+	if u.Subject != "" {
+		set(types.MetadataSubject, config.AirtableSubjectField, u.Subject)
+	}
+	if u.Status != "" {
+		set(types.MetadataStatus, config.AirtableStatusField, u.Status)
+		set(types.MetadataError, config.AirtableErrorField, u.Error)
+	} else if u.Error != "" {
+		set(types.MetadataError, config.AirtableErrorField, u.Error)
+	}
+	if !u.GeneratedAt.IsZero() {
+		set(types.MetadataGeneratedAt, config.AirtableGeneratedAtField, u.GeneratedAt.UTC().Format(time.RFC3339))
+	}
+	if u.Model != "" {
+		set(types.MetadataModel, config.AirtableModelField, u.Model)
+	}
+	if u.Template != "" {
+		set(types.MetadataTemplate, config.AirtableTemplateField, u.Template)
+	}
+	return fields
+}
+
+// generatedUpdate describes a successful generation.
+func generatedUpdate(recordID, model, template, text string) types.OutreachUpdate {
+	subject, _ := parseOutreach(text)
+	return types.OutreachUpdate{
+		RecordID:    recordID,
+		Body:        text,
+		Subject:     subject,
+		Status:      types.OutreachGenerated,
+		GeneratedAt: time.Now(),
+		Model:       model,
+		Template:    template,
+	}
+}
+
+// errorUpdate describes a contact's website or generation error so failures
+// are visible in the base. withStatus also sets the status to error, which
+// only generation attempts do; a website check alone should not hide that
+// outreach was generated or sent earlier.
+func errorUpdate(contact types.Contact, withStatus bool) (types.OutreachUpdate, bool) {
+	if contact.ID == "" || contact.Error == "" {
+		return types.OutreachUpdate{}, false
+	}
+
+	update := types.OutreachUpdate{RecordID: contact.ID, Error: contact.Error}
+	if withStatus {
+		update.Status = types.OutreachError
+	}
+	return update, true
+}
+
+// updateOutreach writes the generated text and the enabled metadata of a
+// single record to its source.
+func updateOutreach(source ContactSource, config types.Config, update types.OutreachUpdate) error {
+	return source.WriteOutreach(config, []types.OutreachUpdate{update})[update.RecordID]
+}
+
+// recordOutreachError writes a single contact's error back to its source. A
+// failed write is only logged.
+func recordOutreachError(source ContactSource, config types.Config, contact types.Contact, withStatus bool) {
+	update, ok := errorUpdate(contact, withStatus)
+	if !ok {
+		return
+	}
+	if err := updateOutreach(source, config, update); err != nil {
+		log.Printf("Warning: Failed to write error for %s to %s: %v", contact.ID, source.Name(), err)
+	}
+}
+
+// queueOutreachError adds a contact's error to a bulk write.
+func queueOutreachError(batch *outreachBatch, contact types.Contact, withStatus bool) {
+	if update, ok := errorUpdate(contact, withStatus); ok {
+		batch.add(update)
+	}
+}
+
+// outreachBatch queues updates during a bulk run and writes them ten at a
+// time, so a long run does not hold everything until the end.
+type outreachBatch struct {
+	source  ContactSource
+	config  types.Config
+	pending []types.OutreachUpdate
+	errs    map[string]error
+}
+
+func newOutreachBatch(source ContactSource, config types.Config) *outreachBatch {
+	return &outreachBatch{source: source, config: config, errs: map[string]error{}}
+}
+
+func (b *outreachBatch) add(update types.OutreachUpdate) {
+	b.pending = append(b.pending, update)
+	if len(b.pending) >= airtableBatchSize {
+		b.flush()
+	}
+}
+
+// flush writes the queued updates and returns the errors of every write so
+// far, by record ID.
+func (b *outreachBatch) flush() map[string]error {
+	if len(b.pending) > 0 {
+		for id, err := range b.source.WriteOutreach(b.config, b.pending) {
+			b.errs[id] = err
+		}
+		b.pending = nil
+	}
+	return b.errs
+}
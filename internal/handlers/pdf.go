@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+
+	"outreach-generator/internal/types"
+)
+
+const (
+	maxPDFDocuments = 3
+	maxPDFBytes     = 10 << 20
+	maxPDFPages     = 20
+	maxPDFExcerpt   = 1200
+	maxPDFTotal     = 3000
+)
+
+// pdfLink is a PDF document linked from a crawled page.
+type pdfLink struct {
+	URL   string
+	Title string
+}
+
+// isPDFLink reports whether an href points at a PDF by its path extension.
+func isPDFLink(href string) bool {
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(path.Ext(u.Path), ".pdf")
+}
+
+// addPDFLink records a link unless it is a duplicate or the limit is reached.
+func addPDFLink(links []pdfLink, link pdfLink) []pdfLink {
+	if len(links) >= maxPDFDocuments {
+		return links
+	}
+	for _, l := range links {
+		if l.URL == link.URL {
+			return links
+		}
+	}
+	return append(links, link)
+}
+
+// fetchPDFExcerpts downloads the linked documents and returns a bounded
+// research section with an excerpt of each, along with the number of
+// excerpts it holds. Failures are logged and skipped.
+func (h *Handlers) fetchPDFExcerpts(config types.Config, links []pdfLink) (string, int) {
+	if len(links) == 0 {
+		return "", 0
+	}
+
+	client := h.crawl.client(crawlPolicyFromConfig(config), 30*time.Second)
+
+	var sections []string
+	remaining := maxPDFTotal
+	for _, link := range links {
+		if remaining <= 0 {
+			break
+		}
+
+		data, err := downloadPDF(client, link.URL)
+		if err != nil {
+			log.Printf("Skipping PDF %s: %v", link.URL, err)
+			continue
+		}
+
+		text, err := extractPDFText(data, min(maxPDFExcerpt, remaining))
+		if err != nil {
+			log.Printf("Skipping PDF %s: %v", link.URL, err)
+			continue
+		}
+		if text == "" {
+			continue
+		}
+
+		remaining -= len(text)
+		sections = append(sections, fmt.Sprintf("[%s]\n%s", link.Title, text))
+	}
+
+	if len(sections) == 0 {
+		return "", 0
+	}
+	return "Linked documents (excerpts):\n" + strings.Join(sections, "\n\n"), len(sections)
+}
+
+func downloadPDF(client *http.Client, pdfURL string) ([]byte, error) {
+	resp, err := client.Get(pdfURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxPDFBytes {
+		return nil, fmt.Errorf("document too large: %d bytes", resp.ContentLength)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPDFBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPDFBytes {
+		return nil, fmt.Errorf("document too large")
+	}
+	return data, nil
+}
+
+// extractPDFText returns up to maxChars of cleaned text from the first pages
+// of a PDF. The parser panics on some malformed files, so that is turned into
+// an error.
+func extractPDFText(data []byte, maxChars int) (text string, err error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\x00\t\r\n "), []byte("%PDF-")) {
+		return "", fmt.Errorf("not a PDF document")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed PDF: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("error reading PDF: %w", err)
+	}
+
+	var b strings.Builder
+	for i := 1; i <= reader.NumPage() && i <= maxPDFPages; i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+
+		// Rows keep the lines apart. Font names only hold within a page,
+		// so GetTextByRow reads the fonts of each page on its own
+		rows, err := page.GetTextByRow()
+		if err != nil {
+			continue
+		}
+		for _, row := range rows {
+			for _, text := range row.Content {
+				b.WriteString(text.S)
+			}
+			b.WriteString("\n")
+		}
+
+		if b.Len() > maxChars*2 {
+			break
+		}
+	}
+
+	return truncateText(strings.Join(strings.Fields(b.String()), " "), maxChars), nil
+}
+
+// truncateText cuts text to at most limit bytes, preferring a sentence end
+// and never splitting a UTF-8 sequence.
+func truncateText(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if lastDot := strings.LastIndex(text[:cut], ". "); lastDot > cut/2 {
+		return text[:lastDot+1]
+	}
+	return text[:cut] + "..."
+}
+
+// pdfTitle picks a readable label for a linked document.
+func pdfTitle(linkText, pdfURL string) string {
+	if title := strings.Join(strings.Fields(linkText), " "); title != "" {
+		return truncateText(title, 80)
+	}
+	if u, err := url.Parse(pdfURL); err == nil {
+		if name, err := url.PathUnescape(path.Base(u.Path)); err == nil {
+			return name
+		}
+	}
+	return pdfURL
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExtractPDFText(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		maxChars int
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "text",
+			data:     readFixture(t, "brochure.pdf"),
+			maxChars: maxPDFExcerpt,
+			want:     "Acme Solar builds inverters for small farms. Founded in 2012 in Lyon.",
+		},
+		{
+			name:     "truncated at the excerpt limit",
+			data:     readFixture(t, "long.pdf"),
+			maxChars: 200,
+			want:     "Sentence number 1 describes the product range in some detail. Sentence number 2 describes the product range in some detail. Sentence number 3 describes the product range in some detail.",
+		},
+		{
+			// Both pages name their font F1, each with its own encoding
+			name:     "fonts of each page",
+			data:     readFixture(t, "pages.pdf"),
+			maxChars: maxPDFExcerpt,
+			want:     "Founded in Lyon.",
+		},
+		{
+			name:     "not a PDF",
+			data:     []byte("<!DOCTYPE html><html><body>Not found</body></html>"),
+			maxChars: maxPDFExcerpt,
+			wantErr:  "not a PDF document",
+		},
+		{
+			name:     "malformed",
+			data:     readFixture(t, "malformed.pdf"),
+			maxChars: maxPDFExcerpt,
+			wantErr:  "malformed PDF",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractPDFText(tt.data, tt.maxChars)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractPDFText() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractPDFText() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("extractPDFText() = %q, want %q", got, tt.want)
+			}
+			if len(got) > tt.maxChars+len("...") {
+				t.Errorf("extractPDFText() returned %d bytes, limit %d", len(got), tt.maxChars)
+			}
+		})
+	}
+}
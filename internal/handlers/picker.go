@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"outreach-generator/internal/components"
+)
+
+// HandleListBases renders a picker with the bases the saved token can
+// access, so the base ID never has to be copied from a URL.
+func (h *Handlers) HandleListBases() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+		if config.AirtableAccessToken == "" {
+			components.PickerError("Save an Airtable access token first.").Render(r.Context(), w)
+			return
+		}
+
+		bases, err := h.fetchAirtableBases(config)
+		if err != nil {
+			log.Printf("Error listing Airtable bases: %v", err)
+			components.PickerError(describeAPIError(err, "The token cannot list bases. It needs the schema.bases:read scope")).Render(r.Context(), w)
+			return
+		}
+		if len(bases) == 0 {
+			components.PickerError("The token has no bases. Add bases to the token's access list at airtable.com/create/tokens.").Render(r.Context(), w)
+			return
+		}
+
+		sort.Slice(bases, func(i, j int) bool {
+			return strings.ToLower(bases[i].Name) < strings.ToLower(bases[j].Name)
+		})
+		components.BasePicker(bases, config.AirtableBaseID).Render(r.Context(), w)
+	}
+}
+
+// HandleListTables renders a picker with the tables of the chosen base.
+func (h *Handlers) HandleListTables() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, err := h.loadConfig()
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+
+		baseID := r.URL.Query().Get("base_id")
+		if baseID == "" {
+			return
+		}
+		selected := ""
+		if baseID == config.AirtableBaseID {
+			selected = config.AirtableTableName
+		}
+
+		config.AirtableBaseID = baseID
+		tables, err := h.fetchAirtableTables(config)
+		if err != nil {
+			log.Printf("Error listing Airtable tables: %v", err)
+			components.PickerError(describeAPIError(err, "The token cannot read this base's tables")).Render(r.Context(), w)
+			return
+		}
+
+		components.TablePicker(tables, selected).Render(r.Context(), w)
+	}
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+// HandleProfilesPage lists the sender profiles and the knowledge base with
+// the forms to add to them.
+func (h *Handlers) HandleProfilesPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		profiles, err := h.listProfiles()
+		if err != nil {
+			http.Error(w, "Failed to load sender profiles", http.StatusInternalServerError)
+			return
+		}
+		knowledge, err := h.listKnowledge()
+		if err != nil {
+			http.Error(w, "Failed to load the knowledge base", http.StatusInternalServerError)
+			return
+		}
+		components.ProfilesPage(profiles, knowledge).Render(r.Context(), w)
+	}
+}
+
+// HandleListProfiles returns the list of sender profiles.
+func (h *Handlers) HandleListProfiles() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.renderProfileList(w, r)
+	}
+}
+
+// HandleEditProfile shows the form of an existing sender profile.
+func (h *Handlers) HandleEditProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := h.loadProfile(urlID(r))
+		if err == sql.ErrNoRows {
+			components.ProfileForm(types.SenderProfile{}, "This profile no longer exists.").Render(r.Context(), w)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading sender profile: %v", err)
+			components.ProfileForm(types.SenderProfile{}, "Failed to load the profile.").Render(r.Context(), w)
+			return
+		}
+		components.ProfileForm(p, "").Render(r.Context(), w)
+	}
+}
+
+// HandleSaveProfile creates or updates a sender profile from its form. A form
+// that is not valid comes back with the error and the values entered.
+func (h *Handlers) HandleSaveProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			components.ProfileForm(types.SenderProfile{}, "Failed to parse the profile.").Render(r.Context(), w)
+			return
+		}
+
+		p := types.SenderProfile{
+			Name:             strings.TrimSpace(r.FormValue("name")),
+			Role:             strings.TrimSpace(r.FormValue("role")),
+			Company:          strings.TrimSpace(r.FormValue("company")),
+			ValueProposition: strings.TrimSpace(r.FormValue("value_proposition")),
+			CaseStudies:      strings.TrimSpace(r.FormValue("case_studies")),
+			ProofPoints:      strings.TrimSpace(r.FormValue("proof_points")),
+			CalendarLink:     strings.TrimSpace(r.FormValue("calendar_link")),
+			Default:          r.FormValue("default") != "",
+		}
+		if id := r.FormValue("id"); id != "" {
+			var err error
+			if p.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				components.ProfileForm(types.SenderProfile{}, "Invalid profile.").Render(r.Context(), w)
+				return
+			}
+		}
+		if err := validateProfile(p); err != nil {
+			components.ProfileForm(p, err.Error()).Render(r.Context(), w)
+			return
+		}
+
+		p, err := h.saveProfile(p)
+		if err == sql.ErrNoRows {
+			components.ProfileForm(types.SenderProfile{}, "This profile no longer exists.").Render(r.Context(), w)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving sender profile %s: %v", p.Name, err)
+			components.ProfileForm(p, "Failed to save the profile.").Render(r.Context(), w)
+			return
+		}
+		log.Printf("Saved sender profile %s", p.Name)
+		components.ProfileSaved(p).Render(r.Context(), w)
+	}
+}
+
+// HandleDeleteProfile removes a sender profile and returns the updated list.
+func (h *Handlers) HandleDeleteProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := urlID(r)
+		if id == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if err := h.deleteProfile(id); err != nil {
+			http.Error(w, "Failed to delete sender profile", http.StatusInternalServerError)
+			return
+		}
+		h.renderProfileList(w, r)
+	}
+}
+
+// HandleListKnowledge returns the knowledge base.
+func (h *Handlers) HandleListKnowledge() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.renderKnowledgeList(w, r)
+	}
+}
+
+// HandleEditKnowledge shows the form of an existing knowledge base entry.
+func (h *Handlers) HandleEditKnowledge() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, err := h.loadKnowledge(urlID(r))
+		if err == sql.ErrNoRows {
+			components.KnowledgeForm(types.KnowledgeEntry{}, "This entry no longer exists.").Render(r.Context(), w)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading knowledge base entry: %v", err)
+			components.KnowledgeForm(types.KnowledgeEntry{}, "Failed to load the entry.").Render(r.Context(), w)
+			return
+		}
+		components.KnowledgeForm(entry, "").Render(r.Context(), w)
+	}
+}
+
+// HandleSaveKnowledge creates or updates a knowledge base entry from its
+// form.
+func (h *Handlers) HandleSaveKnowledge() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			components.KnowledgeForm(types.KnowledgeEntry{}, "Failed to parse the entry.").Render(r.Context(), w)
+			return
+		}
+
+		entry := types.KnowledgeEntry{
+			Title:   strings.TrimSpace(r.FormValue("title")),
+			Content: strings.TrimSpace(r.FormValue("content")),
+		}
+		if id := r.FormValue("id"); id != "" {
+			var err error
+			if entry.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				components.KnowledgeForm(types.KnowledgeEntry{}, "Invalid entry.").Render(r.Context(), w)
+				return
+			}
+		}
+		if err := h.validateKnowledge(entry); err != nil {
+			components.KnowledgeForm(entry, err.Error()).Render(r.Context(), w)
+			return
+		}
+
+		entry, err := h.saveKnowledge(entry)
+		if err == sql.ErrNoRows {
+			components.KnowledgeForm(types.KnowledgeEntry{}, "This entry no longer exists.").Render(r.Context(), w)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving knowledge base entry %s: %v", entry.Title, err)
+			components.KnowledgeForm(entry, "Failed to save the entry.").Render(r.Context(), w)
+			return
+		}
+		log.Printf("Saved knowledge base entry %s", entry.Title)
+		components.KnowledgeSaved(entry).Render(r.Context(), w)
+	}
+}
+
+// HandleDeleteKnowledge removes a knowledge base entry and returns the
+// updated list.
+func (h *Handlers) HandleDeleteKnowledge() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := urlID(r)
+		if id == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if err := h.deleteKnowledge(id); err != nil {
+			http.Error(w, "Failed to delete knowledge base entry", http.StatusInternalServerError)
+			return
+		}
+		h.renderKnowledgeList(w, r)
+	}
+}
+
+// urlID reads the numeric ID of a URL, which is zero when it is not a
+// number and so matches no row.
+func urlID(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	return id
+}
+
+func (h *Handlers) renderProfileList(w http.ResponseWriter, r *http.Request) {
+	profiles, err := h.listProfiles()
+	if err != nil {
+		http.Error(w, "Failed to load sender profiles", http.StatusInternalServerError)
+		return
+	}
+	components.ProfileList(profiles).Render(r.Context(), w)
+}
+
+func (h *Handlers) renderKnowledgeList(w http.ResponseWriter, r *http.Request) {
+	knowledge, err := h.listKnowledge()
+	if err != nil {
+		http.Error(w, "Failed to load the knowledge base", http.StatusInternalServerError)
+		return
+	}
+	components.KnowledgeList(knowledge).Render(r.Context(), w)
+}
@@ -0,0 +1,463 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+const (
+	// sendCheckInterval is how often the queue checks whether a message is due
+	sendCheckInterval = 30 * time.Second
+	// sendRetryDelay is how long the queue waits after the server or account
+	// failed, rather than the recipient
+	sendRetryDelay = 10 * time.Minute
+)
+
+var (
+	errDailyCapReached = errors.New("the daily cap of this mailbox is reached")
+	// errUnsendable marks a queued message that can never be sent as it is
+	errUnsendable = errors.New("cannot be sent")
+)
+
+// sendScheduler makes sure a contact is never emailed by the queue and a
+// manual send at the same time.
+type sendScheduler struct {
+	mu sync.Mutex
+}
+
+// sendWindow is the business hours messages may arrive in, in the
+// recipient's timezone. Hours are minutes since midnight.
+type sendWindow struct {
+	start, end int
+	days       map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseSendHours reads business hours like "09:00-17:00".
+func parseSendHours(s string) (int, int, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid hours %q, use a range like 09:00-17:00", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("hours %q end before they start", s)
+	}
+	return start, end, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", strings.TrimSpace(s))
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseSendDays reads a comma separated list of weekdays like "mon,tue".
+func parseSendDays(s string) (map[time.Weekday]bool, error) {
+	days := map[time.Weekday]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		day, ok := weekdays[name[:min(3, len(name))]]
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday %q", name)
+		}
+		days[day] = true
+	}
+	if len(days) == 0 {
+		return nil, errors.New("list at least one weekday")
+	}
+	return days, nil
+}
+
+func parseSendWindow(config types.Config) (sendWindow, error) {
+	var w sendWindow
+	var err error
+	if w.start, w.end, err = parseSendHours(config.SendHours); err != nil {
+		return w, err
+	}
+	w.days, err = parseSendDays(config.SendDays)
+	return w, err
+}
+
+// contactWindow is the business hours a contact's messages may arrive in,
+// which their campaign can change. It reports false for the contacts of a
+// paused campaign.
+func (h *Handlers) contactWindow(config types.Config, contact types.Contact) (sendWindow, bool, error) {
+	campaign, err := h.contactCampaign(contact)
+	if err != nil {
+		return sendWindow{}, false, err
+	}
+	if campaign != nil {
+		if campaign.Paused {
+			return sendWindow{}, false, nil
+		}
+		config = applyCampaign(config, *campaign)
+	}
+	window, err := parseSendWindow(config)
+	return window, err == nil, err
+}
+
+// contains reports whether t, in the recipient's timezone, is within the
+// business hours.
+func (w sendWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+}
+
+// mailboxAddress is the address messages are sent from, which the daily
+// cap and the queue state are kept for.
+func mailboxAddress(config types.Config) string {
+	from, err := mail.ParseAddress(config.SMTPFrom)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(from.Address)
+}
+
+// randomGap picks the pause before the next message, so messages do not
+// leave at a machine-like rhythm.
+func randomGap(config types.Config) time.Duration {
+	low, high := config.SendMinGapSeconds, config.SendMaxGapSeconds
+	if high < low {
+		low, high = high, low
+	}
+	return time.Duration(low+rand.Intn(high-low+1)) * time.Second
+}
+
+// startOfDay is midnight of t's day in the server's timezone; daily caps
+// reset then.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Local().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// checkDailyCap refuses to send when the mailbox has reached its cap.
+func (h *Handlers) checkDailyCap(config types.Config, mailbox string, now time.Time) error {
+	sent, err := h.countSentSince(mailbox, startOfDay(now))
+	if err != nil {
+		return err
+	}
+	if sent >= config.SendDailyCap {
+		return fmt.Errorf("%w (%d messages)", errDailyCapReached, config.SendDailyCap)
+	}
+	return nil
+}
+
+// runSendQueue sends at most one queued message: the oldest one whose
+// recipient is within business hours, once the mailbox's gap has passed and
+// while it is under its daily cap.
+func (h *Handlers) runSendQueue(now time.Time) error {
+	queue, err := h.listSendQueue()
+	if err != nil || len(queue) == 0 {
+		return err
+	}
+	config, err := h.loadConfig()
+	if err != nil {
+		return err
+	}
+	mailbox := mailboxAddress(config)
+	if mailbox == "" {
+		return nil
+	}
+	state, err := h.loadMailboxState(mailbox)
+	if err != nil || state.Paused || now.Before(state.NextSendAt) {
+		return err
+	}
+	if err := h.checkDailyCap(config, mailbox, now); err != nil {
+		if errors.Is(err, errDailyCapReached) {
+			return nil
+		}
+		return err
+	}
+
+	for _, q := range queue {
+		contact, err := h.getContact(q.ContactID)
+		if err == sql.ErrNoRows || (err == nil && contact.OutreachStatus != queuedStatus(q)) {
+			// Deleted, sent manually, no longer approved, or replied to or
+			// bounced before a follow-up went out
+			if err := h.unqueueContact(q.ContactID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		window, ok, err := h.contactWindow(config, contact)
+		if err != nil {
+			return err
+		}
+		if !ok || !window.contains(now.In(recipientLocation(contact.City, contact.Country, config.SendDefaultTimezone))) {
+			continue
+		}
+
+		err = h.sendQueued(config, contact, q.Step)
+		var rejected recipientError
+		switch {
+		case err == nil:
+			state.Error = ""
+			state.NextSendAt = now.Add(randomGap(config))
+		case errors.As(err, &rejected):
+			log.Printf("Dropping %s from the send queue: %v", q.ContactID, err)
+			if err := h.unqueueContact(q.ContactID); err != nil {
+				return err
+			}
+			state.NextSendAt = now.Add(randomGap(config))
+		case errors.Is(err, errDailyCapReached):
+			return nil
+		case errors.Is(err, errAlreadySent), errors.Is(err, errUnsendable):
+			log.Printf("Dropping %s from the send queue: %v", q.ContactID, err)
+			if err := h.unqueueContact(q.ContactID); err != nil {
+				return err
+			}
+			continue
+		default:
+			// The server or account failed; keep the contact queued
+			state.Error = err.Error()
+			state.NextSendAt = now.Add(sendRetryDelay)
+		}
+		return h.saveMailboxState(state)
+	}
+	return nil
+}
+
+// queuedStatus is the outreach status a contact must still have for a
+// queued message to go out: approved for the initial outreach, sent for
+// follow-ups.
+func queuedStatus(q queuedSend) string {
+	if q.Step == 0 {
+		return types.OutreachApproved
+	}
+	return types.OutreachSent
+}
+
+// sendQueued sends the initial outreach or a follow-up from the queue.
+func (h *Handlers) sendQueued(config types.Config, contact types.Contact, step int) error {
+	if step > 0 {
+		_, err := h.sendFollowUp(config, contact, step)
+		return err
+	}
+	source, err := h.contactSource(contact.Source)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnsendable, err)
+	}
+	_, err = h.sendOutreach(source, config, contact)
+	return err
+}
+
+// scheduleSends advances sequences and works through the send queue in the
+// background.
+func (h *Handlers) scheduleSends() {
+	ticker := time.NewTicker(sendCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := h.advanceSequences(now); err != nil {
+			log.Printf("Sequences failed: %v", err)
+		}
+		if err := h.runSendQueue(now); err != nil {
+			log.Printf("Send queue failed: %v", err)
+		}
+	}
+}
+
+// sendQueueStatus describes the queue of the configured mailbox and why it
+// is not sending, if it is not.
+func (h *Handlers) sendQueueStatus() (types.SendQueueStatus, error) {
+	config, err := h.loadConfig()
+	if err != nil {
+		return types.SendQueueStatus{}, err
+	}
+	queue, err := h.listSendQueue()
+	if err != nil {
+		return types.SendQueueStatus{}, err
+	}
+
+	mailbox := mailboxAddress(config)
+	status, err := h.loadMailboxState(mailbox)
+	if err != nil {
+		return status, err
+	}
+	status.Queued = len(queue)
+	status.DailyCap = config.SendDailyCap
+	now := time.Now()
+	if mailbox == "" {
+		status.Waiting = "Set the SMTP host and from address on /config to start sending."
+		return status, nil
+	}
+	if status.SentToday, err = h.countSentSince(mailbox, startOfDay(now)); err != nil {
+		return status, err
+	}
+
+	switch {
+	case status.Paused:
+		status.Waiting = "Sending is paused."
+	case status.Queued == 0:
+	case status.SentToday >= status.DailyCap:
+		status.Waiting = "The daily cap is reached, sending continues tomorrow."
+	case now.Before(status.NextSendAt):
+		status.Waiting = "Waiting until " + status.NextSendAt.Local().Format("15:04:05") + " before the next message."
+	default:
+		paused := 0
+		for _, q := range queue {
+			contact, err := h.getContact(q.ContactID)
+			if err != nil {
+				continue
+			}
+			window, ok, err := h.contactWindow(config, contact)
+			if err != nil {
+				status.Waiting = "Invalid business hours: " + err.Error()
+				return status, nil
+			}
+			if !ok {
+				paused++
+			} else if window.contains(now.In(recipientLocation(contact.City, contact.Country, config.SendDefaultTimezone))) {
+				return status, nil
+			}
+		}
+		if paused == len(queue) {
+			status.Waiting = "Every queued recipient is in a paused campaign."
+		} else {
+			status.Waiting = "Outside business hours for every queued recipient."
+		}
+	}
+	return status, nil
+}
+
+// HandleQueueApproved adds every approved contact of the selected source to
+// the send queue.
+func (h *Handlers) HandleQueueApproved() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		source, err := h.contactSource(r.FormValue("source"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		contacts, err := source.Contacts()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		var ids []string
+		for _, contact := range contacts {
+			if contact.OutreachStatus == types.OutreachApproved && !contact.Queued {
+				ids = append(ids, contact.ID)
+			}
+		}
+		if err := h.queueContacts(ids, time.Now()); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to queue contacts")
+			return
+		}
+		log.Printf("Queued %d contacts from %s for sending", len(ids), source.Name())
+
+		if contacts, err = source.Contacts(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("HX-Trigger", "sendQueueChanged")
+		components.ContactsList(contacts).Render(r.Context(), w)
+	}
+}
+
+// HandleUnqueueContact takes a contact out of the send queue.
+func (h *Handlers) HandleUnqueueContact() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contact, _, err := h.requestContact(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.unqueueContact(contact.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to update the send queue")
+			return
+		}
+		contact.Queued = false
+		w.Header().Set("HX-Trigger", "sendQueueChanged")
+		components.ContactCard(contact).Render(r.Context(), w)
+	}
+}
+
+// HandleSendQueueStatus returns the send queue status bar.
+func (h *Handlers) HandleSendQueueStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.renderSendQueueStatus(w, r)
+	}
+}
+
+// HandlePauseSending stops the send queue of the configured mailbox until
+// it is resumed; queued contacts stay queued.
+func (h *Handlers) HandlePauseSending() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.setSendingPaused(w, r, true)
+	}
+}
+
+// HandleResumeSending restarts the send queue of the configured mailbox.
+func (h *Handlers) HandleResumeSending() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.setSendingPaused(w, r, false)
+	}
+}
+
+func (h *Handlers) setSendingPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	config, err := h.loadConfig()
+	if err != nil {
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	if mailbox := mailboxAddress(config); mailbox != "" {
+		state, err := h.loadMailboxState(mailbox)
+		if err == nil {
+			state.Paused = paused
+			if !paused {
+				// Resuming also retries a failed server right away
+				state.Error = ""
+				state.NextSendAt = time.Time{}
+			}
+			err = h.saveMailboxState(state)
+		}
+		if err != nil {
+			http.Error(w, "Failed to update the send queue", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Sending from %s paused=%t", mailbox, paused)
+	}
+	h.renderSendQueueStatus(w, r)
+}
+
+func (h *Handlers) renderSendQueueStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := h.sendQueueStatus()
+	if err != nil {
+		http.Error(w, "Failed to load the send queue", http.StatusInternalServerError)
+		return
+	}
+	components.SendQueueStatus(status).Render(r.Context(), w)
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+var (
+	errNotApproved = errors.New("only approved outreach can be sent")
+	errAlreadySent = errors.New("this outreach was already sent")
+)
+
+// sendOutreach emails a contact's approved outreach and records the
+// attempt. After a successful send the status becomes sent, locally even
+// when the source cannot be updated, so the contact is not emailed twice.
+func (h *Handlers) sendOutreach(source ContactSource, config types.Config, contact types.Contact) (types.SendResult, error) {
+	h.sends.mu.Lock()
+	defer h.sends.mu.Unlock()
+
+	if contact.OutreachStatus != types.OutreachApproved {
+		return types.SendResult{}, errNotApproved
+	}
+	if sent, err := h.wasSent(contact.ID, 0); err != nil {
+		return types.SendResult{}, err
+	} else if sent {
+		return types.SendResult{}, errAlreadySent
+	}
+
+	msg, err := outreachMessage(config, contact)
+	if err != nil {
+		return types.SendResult{}, err
+	}
+	result, err := h.deliver(config, contact.ID, 0, msg)
+	if err != nil {
+		if !result.SentAt.IsZero() {
+			update := types.OutreachUpdate{RecordID: contact.ID, Error: fmt.Sprintf("Send error: %v", err)}
+			if writeErr := updateOutreach(source, config, update); writeErr != nil {
+				log.Printf("Warning: Failed to write send error for %s to %s: %v", contact.ID, source.Name(), writeErr)
+			}
+		}
+		return result, err
+	}
+
+	update := types.OutreachUpdate{RecordID: contact.ID, Status: types.OutreachSent}
+	if writeErr := updateOutreach(source, config, update); writeErr != nil {
+		log.Printf("Warning: Failed to mark %s as sent in %s: %v", contact.ID, source.Name(), writeErr)
+		if err := h.applyOutreachUpdate(update); err != nil {
+			log.Printf("Warning: Failed to mark %s as sent locally: %v", contact.ID, err)
+		}
+	}
+	return result, nil
+}
+
+// deliver sends one message of a contact's sequence, step 0 being the
+// initial outreach, and records the attempt. Sends count towards the
+// mailbox's daily cap, and the contact leaves the send queue unless the
+// server or account failed. The result has no SentAt when nothing was
+// attempted. Callers hold h.sends.mu.
+func (h *Handlers) deliver(config types.Config, contactID string, step int, msg outgoingMessage) (types.SendResult, error) {
+	mailbox := strings.ToLower(msg.From.Address)
+	if err := h.checkDailyCap(config, mailbox, time.Now()); err != nil {
+		return types.SendResult{}, err
+	}
+
+	result := types.SendResult{
+		ContactID: contactID,
+		Step:      step,
+		From:      mailbox,
+		To:        msg.To.Address,
+		Subject:   msg.Subject,
+		Body:      msg.Body,
+		SentAt:    time.Now(),
+	}
+	var err error
+	result.Response, err = sendMail(config, msg)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.MessageID = msg.MessageID
+	}
+	if recordErr := h.recordSend(result); recordErr != nil {
+		log.Printf("Warning: Failed to record send to %s: %v", result.To, recordErr)
+	}
+	var rejected recipientError
+	if err == nil || errors.As(err, &rejected) {
+		if queueErr := h.unqueueContact(contactID); queueErr != nil {
+			log.Printf("Warning: Failed to remove %s from the send queue: %v", contactID, queueErr)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error sending step %d to %s: %v", step, result.To, err)
+		return result, err
+	}
+	log.Printf("Sent step %d to %s: %s %s", step, result.To, result.MessageID, result.Response)
+	return result, nil
+}
+
+// requestContact loads the contact named in the URL and its source.
+func (h *Handlers) requestContact(r *http.Request) (types.Contact, ContactSource, error) {
+	contact, err := h.getContact(chi.URLParam(r, "id"))
+	if err == sql.ErrNoRows {
+		return contact, nil, errors.New("unknown contact, load the contacts again")
+	}
+	if err != nil {
+		return contact, nil, err
+	}
+	source, err := h.contactSource(contact.Source)
+	return contact, source, err
+}
+
+// HandleApproveOutreach marks a contact's generated outreach as approved
+// for sending.
+func (h *Handlers) HandleApproveOutreach() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contact, source, err := h.requestContact(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		config, err := h.loadConfig()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to load configuration")
+			return
+		}
+		if err := source.Check(config); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if contact.OutreachText == "" {
+			contact.Error = "Generate outreach before approving it"
+		} else if err := updateOutreach(source, config, types.OutreachUpdate{RecordID: contact.ID, Status: types.OutreachApproved}); err != nil {
+			contact.Error = fmt.Sprintf("Update error: %v", err)
+			contact.ErrorKind = types.ErrorKindUpdate
+		} else {
+			contact.OutreachStatus = types.OutreachApproved
+		}
+		components.ContactCard(contact).Render(r.Context(), w)
+	}
+}
+
+// HandleSendOutreach emails one contact's approved outreach.
+func (h *Handlers) HandleSendOutreach() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contact, source, err := h.requestContact(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		config, err := h.loadConfig()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to load configuration")
+			return
+		}
+
+		if _, err := h.sendOutreach(source, config, contact); err != nil {
+			contact.Error = fmt.Sprintf("Send error: %v", err)
+		}
+		if stored, err := h.getContact(contact.ID); err == nil {
+			stored.Error = contact.Error
+			contact = stored
+		}
+		w.Header().Set("HX-Trigger", "sendQueueChanged")
+		components.ContactCard(contact).Render(r.Context(), w)
+	}
+}
+
+// HandlePreviewEmail shows a contact's outreach exactly as it is sent: the
+// headers, the plain text with the signature and the HTML version.
+func (h *Handlers) HandlePreviewEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contact, _, err := h.requestContact(r)
+		if err != nil {
+			components.EmailPreview(types.EmailPreview{Error: err.Error()}).Render(r.Context(), w)
+			return
+		}
+		config, err := h.loadConfig()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to load configuration")
+			return
+		}
+
+		preview := types.EmailPreview{ContactID: contact.ID}
+		msg, err := composeOutreach(config, contact)
+		if err != nil {
+			preview.Error = err.Error()
+		} else {
+			if msg.From != nil {
+				preview.From = displayAddress(msg.From)
+			}
+			preview.To = displayAddress(msg.To)
+			preview.Subject = msg.Subject
+			preview.Text = msg.Body
+			preview.HTML = msg.HTML
+		}
+		components.EmailPreview(preview).Render(r.Context(), w)
+	}
+}
+
+// displayAddress shows an address as a reader sees it, without the MIME
+// encoding of its name.
+func displayAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return addr.Name + " <" + addr.Address + ">"
+}
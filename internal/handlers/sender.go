@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+// referencePattern finds the references of a prompt template, such as
+// {{sender.name}}, {{knowledge}} or {{knowledge:Consulting}}.
+var referencePattern = regexp.MustCompile(`\{\{\s*([^{}]*?)\s*\}\}`)
+
+// senderFields are the profile fields a prompt template can reference as
+// {{sender.<field>}}.
+var senderFields = map[string]func(types.SenderProfile) string{
+	"name":              func(p types.SenderProfile) string { return p.Name },
+	"role":              func(p types.SenderProfile) string { return p.Role },
+	"company":           func(p types.SenderProfile) string { return p.Company },
+	"value_proposition": func(p types.SenderProfile) string { return p.ValueProposition },
+	"case_studies":      func(p types.SenderProfile) string { return p.CaseStudies },
+	"proof_points":      func(p types.SenderProfile) string { return p.ProofPoints },
+	"calendar_link":     func(p types.SenderProfile) string { return p.CalendarLink },
+}
+
+// promptContext is what a prompt is told about our side: the sender profile,
+// if there is one, and the knowledge base.
+type promptContext struct {
+	Profile   *types.SenderProfile
+	Knowledge []types.KnowledgeEntry
+}
+
+// loadPromptContext loads the knowledge base and the profile with the given
+// ID, or the default profile when the ID is zero.
+func (h *Handlers) loadPromptContext(profileID int64) (promptContext, error) {
+	var pc promptContext
+	var err error
+	if profileID != 0 {
+		profile, err := h.loadProfile(profileID)
+		if err == sql.ErrNoRows {
+			return pc, errors.New("the selected sender profile no longer exists")
+		}
+		if err != nil {
+			return pc, err
+		}
+		pc.Profile = &profile
+	} else if pc.Profile, err = h.defaultProfile(); err != nil {
+		return pc, err
+	}
+	pc.Knowledge, err = h.listKnowledge()
+	return pc, err
+}
+
+// expand replaces the references of a prompt template with the profile
+// fields and knowledge base entries they name. A reference that cannot be
+// filled is an error rather than text the model would copy.
+func (pc promptContext) expand(template string) (string, error) {
+	var errs []string
+	expanded := referencePattern.ReplaceAllStringFunc(template, func(match string) string {
+		name := referencePattern.FindStringSubmatch(match)[1]
+		value, err := pc.reference(name)
+		if err != nil {
+			errs = append(errs, err.Error())
+			return match
+		}
+		return value
+	})
+	if len(errs) > 0 {
+		return "", errors.New(strings.Join(errs, "; "))
+	}
+	return expanded, nil
+}
+
+func (pc promptContext) reference(name string) (string, error) {
+	switch {
+	case strings.HasPrefix(name, "sender."):
+		field, ok := senderFields[strings.TrimPrefix(name, "sender.")]
+		if !ok {
+			return "", fmt.Errorf("unknown sender field {{%s}}", name)
+		}
+		if pc.Profile == nil {
+			return "", fmt.Errorf("{{%s}} needs a sender profile", name)
+		}
+		return field(*pc.Profile), nil
+	case name == "knowledge":
+		return knowledgeText(pc.Knowledge), nil
+	case strings.HasPrefix(name, "knowledge:"):
+		title := strings.TrimSpace(strings.TrimPrefix(name, "knowledge:"))
+		for _, entry := range pc.Knowledge {
+			if strings.EqualFold(entry.Title, title) {
+				return entry.Content, nil
+			}
+		}
+		return "", fmt.Errorf("no knowledge base entry is titled %q", title)
+	}
+	return "", fmt.Errorf("unknown reference {{%s}}", name)
+}
+
+// section describes the sender and our services for the system prompt, or
+// is empty when neither is set up.
+func (pc promptContext) section() string {
+	var b strings.Builder
+	if p := pc.Profile; p != nil {
+		b.WriteString("About the Sender (write on their behalf):\n")
+		for _, line := range [][2]string{
+			{"Name", p.Name},
+			{"Role", p.Role},
+			{"Company", p.Company},
+			{"Value Proposition", p.ValueProposition},
+			{"Case Studies", p.CaseStudies},
+			{"Proof Points", p.ProofPoints},
+			{"Calendar Link", p.CalendarLink},
+		} {
+			if line[1] != "" {
+				fmt.Fprintf(&b, "- %s: %s\n", line[0], indentLines(line[1]))
+			}
+		}
+		if p.CalendarLink != "" {
+			b.WriteString("Invite them to book a call using the calendar link.\n")
+		}
+		b.WriteString("\n")
+	}
+	if len(pc.Knowledge) > 0 {
+		b.WriteString("Our Services:\n")
+		b.WriteString(knowledgeText(pc.Knowledge))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func knowledgeText(entries []types.KnowledgeEntry) string {
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "- %s: %s\n", entry.Title, indentLines(entry.Content))
+	}
+	return b.String()
+}
+
+// indentLines indents the lines after the first so a multi-line value stays
+// under its list item.
+func indentLines(s string) string {
+	return strings.ReplaceAll(normalizeNewlines(s), "\n", "\n  ")
+}
+
+// validateProfile checks a sender profile before it is saved.
+func validateProfile(p types.SenderProfile) error {
+	if p.Name == "" {
+		return errors.New("Give the sender a name.")
+	}
+	if p.CalendarLink != "" {
+		if _, ok := safeLink(p.CalendarLink); !ok {
+			return errors.New("The calendar link must be an http or https address.")
+		}
+	}
+	return nil
+}
+
+// saveProfile creates or updates a sender profile. The first profile is the
+// default, and making a profile the default unsets the previous one.
+func (h *Handlers) saveProfile(p types.SenderProfile) (types.SenderProfile, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return p, err
+	}
+	defer tx.Rollback()
+
+	var others int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sender_profiles WHERE id != ?", p.ID).Scan(&others); err != nil {
+		return p, err
+	}
+	if others == 0 {
+		p.Default = true
+	}
+	if p.Default {
+		if _, err := tx.Exec("UPDATE sender_profiles SET is_default = 0"); err != nil {
+			return p, err
+		}
+	}
+
+	p.UpdatedAt = time.Now().UTC()
+	if p.ID == 0 {
+		res, err := tx.Exec(`INSERT INTO sender_profiles (name, role, company, value_proposition, case_studies,
+				proof_points, calendar_link, is_default, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			p.Name, p.Role, p.Company, p.ValueProposition, p.CaseStudies, p.ProofPoints, p.CalendarLink, p.Default, p.UpdatedAt)
+		if err != nil {
+			return p, err
+		}
+		if p.ID, err = res.LastInsertId(); err != nil {
+			return p, err
+		}
+	} else {
+		res, err := tx.Exec(`UPDATE sender_profiles SET name = ?, role = ?, company = ?, value_proposition = ?,
+				case_studies = ?, proof_points = ?, calendar_link = ?, is_default = ?, updated_at = ? WHERE id = ?`,
+			p.Name, p.Role, p.Company, p.ValueProposition, p.CaseStudies, p.ProofPoints, p.CalendarLink, p.Default, p.UpdatedAt, p.ID)
+		if err != nil {
+			return p, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return p, sql.ErrNoRows
+		}
+	}
+	return p, tx.Commit()
+}
+
+const profileColumns = `id, name, role, company, value_proposition, case_studies, proof_points,
+	calendar_link, is_default, updated_at`
+
+func scanProfile(row interface{ Scan(...interface{}) error }) (types.SenderProfile, error) {
+	var p types.SenderProfile
+	err := row.Scan(&p.ID, &p.Name, &p.Role, &p.Company, &p.ValueProposition, &p.CaseStudies, &p.ProofPoints,
+		&p.CalendarLink, &p.Default, &p.UpdatedAt)
+	return p, err
+}
+
+// listProfiles returns the sender profiles, the default one first.
+func (h *Handlers) listProfiles() ([]types.SenderProfile, error) {
+	rows, err := h.db.Query("SELECT " + profileColumns + " FROM sender_profiles ORDER BY is_default DESC, name, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var profiles []types.SenderProfile
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, rows.Err()
+}
+
+func (h *Handlers) loadProfile(id int64) (types.SenderProfile, error) {
+	return scanProfile(h.db.QueryRow("SELECT "+profileColumns+" FROM sender_profiles WHERE id = ?", id))
+}
+
+// defaultProfile returns the default sender profile, or nil when there are
+// no profiles.
+func (h *Handlers) defaultProfile() (*types.SenderProfile, error) {
+	p, err := scanProfile(h.db.QueryRow("SELECT " + profileColumns + " FROM sender_profiles WHERE is_default = 1"))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// deleteProfile removes a sender profile. When it was the default, the
+// first of the remaining profiles takes its place.
+func (h *Handlers) deleteProfile(id int64) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM sender_profiles WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE sender_profiles SET is_default = 1
+		WHERE id = (SELECT id FROM sender_profiles ORDER BY name, id LIMIT 1)
+		AND NOT EXISTS (SELECT 1 FROM sender_profiles WHERE is_default = 1)`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// validateKnowledge checks a knowledge base entry before it is saved.
+// Titles are unique, so {{knowledge:Title}} names one entry.
+func (h *Handlers) validateKnowledge(entry types.KnowledgeEntry) error {
+	if entry.Title == "" {
+		return errors.New("Give the entry a title.")
+	}
+	if strings.ContainsAny(entry.Title, "{}") {
+		return errors.New("The title cannot contain braces.")
+	}
+	if entry.Content == "" {
+		return errors.New("Describe the service or fact.")
+	}
+	var taken int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM knowledge_entries WHERE LOWER(title) = LOWER(?) AND id != ?",
+		entry.Title, entry.ID).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return fmt.Errorf("There is already an entry titled %s.", entry.Title)
+	}
+	return nil
+}
+
+// saveKnowledge creates or updates a knowledge base entry.
+func (h *Handlers) saveKnowledge(entry types.KnowledgeEntry) (types.KnowledgeEntry, error) {
+	entry.UpdatedAt = time.Now().UTC()
+	if entry.ID == 0 {
+		res, err := h.db.Exec("INSERT INTO knowledge_entries (title, content, updated_at) VALUES (?, ?, ?)",
+			entry.Title, entry.Content, entry.UpdatedAt)
+		if err != nil {
+			return entry, err
+		}
+		entry.ID, err = res.LastInsertId()
+		return entry, err
+	}
+
+	res, err := h.db.Exec("UPDATE knowledge_entries SET title = ?, content = ?, updated_at = ? WHERE id = ?",
+		entry.Title, entry.Content, entry.UpdatedAt, entry.ID)
+	if err != nil {
+		return entry, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return entry, sql.ErrNoRows
+	}
+	return entry, nil
+}
+
+// listKnowledge returns the knowledge base ordered by title.
+func (h *Handlers) listKnowledge() ([]types.KnowledgeEntry, error) {
+	rows, err := h.db.Query("SELECT id, title, content, updated_at FROM knowledge_entries")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []types.KnowledgeEntry
+	for rows.Next() {
+		var entry types.KnowledgeEntry
+		if err := rows.Scan(&entry.ID, &entry.Title, &entry.Content, &entry.UpdatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	// SQLite sorts text case-sensitively
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].Title) < strings.ToLower(entries[j].Title)
+	})
+	return entries, rows.Err()
+}
+
+func (h *Handlers) loadKnowledge(id int64) (types.KnowledgeEntry, error) {
+	var entry types.KnowledgeEntry
+	err := h.db.QueryRow("SELECT id, title, content, updated_at FROM knowledge_entries WHERE id = ?", id).
+		Scan(&entry.ID, &entry.Title, &entry.Content, &entry.UpdatedAt)
+	return entry, err
+}
+
+func (h *Handlers) deleteKnowledge(id int64) error {
+	_, err := h.db.Exec("DELETE FROM knowledge_entries WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+// HandleSequencesPage lists the follow-up sequences and the form to add one.
+func (h *Handlers) HandleSequencesPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sequences, err := h.listSequences()
+		if err != nil {
+			http.Error(w, "Failed to load sequences", http.StatusInternalServerError)
+			return
+		}
+		components.SequencesPage(sequences).Render(r.Context(), w)
+	}
+}
+
+// HandleListSequences returns the list of sequences.
+func (h *Handlers) HandleListSequences() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.renderSequenceList(w, r)
+	}
+}
+
+// HandleEditSequence shows the form of an existing sequence.
+func (h *Handlers) HandleEditSequence() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seq, err := h.requestSequence(r)
+		if err == sql.ErrNoRows {
+			components.SequenceForm(types.Sequence{}, "This sequence no longer exists.").Render(r.Context(), w)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading sequence: %v", err)
+			components.SequenceForm(types.Sequence{}, "Failed to load the sequence.").Render(r.Context(), w)
+			return
+		}
+		components.SequenceForm(seq, "").Render(r.Context(), w)
+	}
+}
+
+// HandleSaveSequence creates or updates a sequence from its form. A form
+// that is not valid comes back with the error and the values entered.
+func (h *Handlers) HandleSaveSequence() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			components.SequenceForm(types.Sequence{}, "Failed to parse the sequence.").Render(r.Context(), w)
+			return
+		}
+
+		seq := types.Sequence{Name: strings.TrimSpace(r.FormValue("name"))}
+		if id := r.FormValue("id"); id != "" {
+			var err error
+			if seq.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				components.SequenceForm(types.Sequence{}, "Invalid sequence.").Render(r.Context(), w)
+				return
+			}
+		}
+		delays, prompts := r.Form["delay_days"], r.Form["prompt"]
+		if len(delays) != len(prompts) {
+			components.SequenceForm(seq, "Every step needs a delay and a prompt.").Render(r.Context(), w)
+			return
+		}
+		var delayErr error
+		for i := range delays {
+			delay, err := strconv.Atoi(strings.TrimSpace(delays[i]))
+			if err != nil && delayErr == nil {
+				delayErr = fmt.Errorf("Step %d: the delay must be a number of days.", i+1)
+			}
+			seq.Steps = append(seq.Steps, types.SequenceStep{DelayDays: delay, Prompt: strings.TrimSpace(prompts[i])})
+		}
+		if delayErr != nil {
+			components.SequenceForm(seq, delayErr.Error()).Render(r.Context(), w)
+			return
+		}
+		if err := validateSequence(seq); err != nil {
+			components.SequenceForm(seq, err.Error()).Render(r.Context(), w)
+			return
+		}
+		if pc, err := h.loadPromptContext(0); err == nil {
+			for i, step := range seq.Steps {
+				if _, err := pc.expand(step.Prompt); err != nil {
+					components.SequenceForm(seq, fmt.Sprintf("Step %d: %v.", i+1, err)).Render(r.Context(), w)
+					return
+				}
+			}
+		}
+
+		seq, err := h.saveSequence(seq)
+		if err == sql.ErrNoRows {
+			components.SequenceForm(types.Sequence{}, "This sequence no longer exists.").Render(r.Context(), w)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving sequence %s: %v", seq.Name, err)
+			components.SequenceForm(seq, "Failed to save the sequence.").Render(r.Context(), w)
+			return
+		}
+		log.Printf("Saved sequence %s with %d steps", seq.Name, len(seq.Steps))
+		components.SequenceSaved(seq).Render(r.Context(), w)
+	}
+}
+
+// HandleDeleteSequence removes a sequence, stopping it for every contact in
+// it, and returns the updated list.
+func (h *Handlers) HandleDeleteSequence() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := h.deleteSequence(id); err != nil {
+			http.Error(w, "Failed to delete sequence", http.StatusInternalServerError)
+			return
+		}
+		h.renderSequenceList(w, r)
+	}
+}
+
+// HandleEnrollContacts starts a sequence for the contacts of the selected
+// source that have outreach and are not in a sequence yet. Each follow-up
+// goes out once the initial outreach was sent and its delay has passed.
+func (h *Handlers) HandleEnrollContacts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seqID, err := strconv.ParseInt(r.FormValue("sequence"), 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Choose a sequence")
+			return
+		}
+		seq, err := h.loadSequence(seqID)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusBadRequest, "This sequence no longer exists")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to load the sequence")
+			return
+		}
+		source, err := h.contactSource(r.FormValue("source"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		contacts, err := source.Contacts()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		var ids []string
+		for _, contact := range contacts {
+			if contact.Email == "" || contact.Sequence != nil {
+				continue
+			}
+			switch contact.OutreachStatus {
+			case types.OutreachGenerated, types.OutreachApproved, types.OutreachSent:
+				ids = append(ids, contact.ID)
+			}
+		}
+		enrolled, err := h.enrollContacts(seq.ID, ids, time.Now())
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to start the sequence")
+			return
+		}
+		log.Printf("Enrolled %d contacts from %s in sequence %s", enrolled, source.Name(), seq.Name)
+
+		if contacts, err = source.Contacts(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		components.ContactsList(contacts).Render(r.Context(), w)
+	}
+}
+
+// HandleStopSequence ends a contact's sequence; no further follow-ups are
+// sent to them.
+func (h *Handlers) HandleStopSequence() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contact, _, err := h.requestContact(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if contact.Sequence == nil || contact.Sequence.Status != types.SequenceActive {
+			components.ContactCard(contact).Render(r.Context(), w)
+			return
+		}
+		if err := h.finishEnrollment(contact.ID, types.SequenceStopped, "stopped manually"); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to stop the sequence")
+			return
+		}
+		if contact, err = h.getContact(contact.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("HX-Trigger", "sendQueueChanged")
+		components.ContactCard(contact).Render(r.Context(), w)
+	}
+}
+
+func (h *Handlers) requestSequence(r *http.Request) (types.Sequence, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return types.Sequence{}, sql.ErrNoRows
+	}
+	return h.loadSequence(id)
+}
+
+func (h *Handlers) renderSequenceList(w http.ResponseWriter, r *http.Request) {
+	sequences, err := h.listSequences()
+	if err != nil {
+		http.Error(w, "Failed to load sequences", http.StatusInternalServerError)
+		return
+	}
+	components.SequenceList(sequences).Render(r.Context(), w)
+}
@@ -0,0 +1,572 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"outreach-generator/internal/types"
+)
+
+const (
+	// sequenceRetryDelay is how long a contact waits after its follow-up
+	// could not be generated
+	sequenceRetryDelay = time.Hour
+	maxSequenceSteps   = 10
+)
+
+var (
+	errNotSent    = errors.New("follow-ups are only sent after the initial outreach, until the contact replies or bounces")
+	errNoFollowUp = fmt.Errorf("%w: the follow-up was not generated", errUnsendable)
+)
+
+// enrollment is a contact's membership in a sequence. Steps count every
+// message sent to the contact, so StepOffset is the last step delivered
+// before the sequence started, from a sequence since deleted.
+type enrollment struct {
+	ContactID  string
+	SequenceID int64
+	Status     string
+	StopReason string
+	Error      string
+	RetryAt    time.Time
+	StepOffset int
+}
+
+// position is the sequence's own number of a contact's step, 1 being its
+// first follow-up.
+func (e enrollment) position(step int) int {
+	return step - e.StepOffset
+}
+
+// delivery is the latest message delivered to a contact.
+type delivery struct {
+	Step   int
+	SentAt time.Time
+}
+
+// validateSequence checks a sequence before it is saved.
+func validateSequence(seq types.Sequence) error {
+	if strings.TrimSpace(seq.Name) == "" {
+		return errors.New("Give the sequence a name.")
+	}
+	if len(seq.Steps) == 0 {
+		return errors.New("Add at least one follow-up step.")
+	}
+	if len(seq.Steps) > maxSequenceSteps {
+		return fmt.Errorf("A sequence has at most %d follow-ups.", maxSequenceSteps)
+	}
+	for i, step := range seq.Steps {
+		if step.DelayDays < 1 {
+			return fmt.Errorf("Step %d: wait at least one day.", i+1)
+		}
+		if strings.TrimSpace(step.Prompt) == "" {
+			return fmt.Errorf("Step %d: describe what the follow-up should say.", i+1)
+		}
+	}
+	return nil
+}
+
+// saveSequence creates a sequence, or replaces the name and steps of an
+// existing one. Contacts already enrolled continue with the new steps.
+func (h *Handlers) saveSequence(seq types.Sequence) (types.Sequence, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return seq, err
+	}
+	defer tx.Rollback()
+
+	if seq.ID == 0 {
+		seq.CreatedAt = time.Now().UTC()
+		res, err := tx.Exec("INSERT INTO sequences (name, created_at) VALUES (?, ?)", seq.Name, seq.CreatedAt)
+		if err != nil {
+			return seq, err
+		}
+		if seq.ID, err = res.LastInsertId(); err != nil {
+			return seq, err
+		}
+	} else {
+		res, err := tx.Exec("UPDATE sequences SET name = ? WHERE id = ?", seq.Name, seq.ID)
+		if err != nil {
+			return seq, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return seq, sql.ErrNoRows
+		}
+		if _, err := tx.Exec("DELETE FROM sequence_steps WHERE sequence_id = ?", seq.ID); err != nil {
+			return seq, err
+		}
+	}
+
+	for i, step := range seq.Steps {
+		if _, err := tx.Exec("INSERT INTO sequence_steps (sequence_id, position, delay_days, prompt) VALUES (?, ?, ?, ?)",
+			seq.ID, i+1, step.DelayDays, step.Prompt); err != nil {
+			return seq, err
+		}
+	}
+	return seq, tx.Commit()
+}
+
+// listSequences returns every sequence with its steps and the number of
+// contacts going through it.
+func (h *Handlers) listSequences() ([]types.Sequence, error) {
+	rows, err := h.db.Query(`SELECT s.id, s.name, s.created_at,
+			(SELECT COUNT(*) FROM enrollments e WHERE e.sequence_id = s.id AND e.status = ?)
+		FROM sequences s ORDER BY s.name, s.id`, types.SequenceActive)
+	if err != nil {
+		return nil, err
+	}
+	var sequences []types.Sequence
+	for rows.Next() {
+		var seq types.Sequence
+		if err := rows.Scan(&seq.ID, &seq.Name, &seq.CreatedAt, &seq.Enrolled); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sequences = append(sequences, seq)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range sequences {
+		if sequences[i].Steps, err = h.loadSequenceSteps(sequences[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return sequences, nil
+}
+
+func (h *Handlers) loadSequence(id int64) (types.Sequence, error) {
+	seq := types.Sequence{ID: id}
+	err := h.db.QueryRow("SELECT name, created_at FROM sequences WHERE id = ?", id).Scan(&seq.Name, &seq.CreatedAt)
+	if err != nil {
+		return seq, err
+	}
+	seq.Steps, err = h.loadSequenceSteps(id)
+	return seq, err
+}
+
+func (h *Handlers) loadSequenceSteps(id int64) ([]types.SequenceStep, error) {
+	rows, err := h.db.Query("SELECT delay_days, prompt FROM sequence_steps WHERE sequence_id = ? ORDER BY position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var steps []types.SequenceStep
+	for rows.Next() {
+		var step types.SequenceStep
+		if err := rows.Scan(&step.DelayDays, &step.Prompt); err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, rows.Err()
+}
+
+// deleteSequence removes a sequence and its enrollments, and takes follow-ups
+// that were waiting to be sent out of the queue. Follow-ups generated for it
+// are dropped too, so a later sequence cannot send them.
+func (h *Handlers) deleteSequence(id int64) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		"DELETE FROM send_queue WHERE step > 0 AND contact_id IN (SELECT contact_id FROM enrollments WHERE sequence_id = ?)",
+		"DELETE FROM sequence_messages WHERE contact_id IN (SELECT contact_id FROM enrollments WHERE sequence_id = ?)",
+		"DELETE FROM enrollments WHERE sequence_id = ?",
+		"DELETE FROM sequence_steps WHERE sequence_id = ?",
+		"DELETE FROM sequences WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// enrollContacts starts a sequence for contacts that are not in one yet and
+// returns how many were enrolled. Its steps follow the last message already
+// delivered.
+func (h *Handlers) enrollContacts(sequenceID int64, ids []string, now time.Time) (int, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	enrolled := 0
+	for _, id := range ids {
+		res, err := tx.Exec(`INSERT OR IGNORE INTO enrollments (contact_id, sequence_id, status, step_offset, enrolled_at)
+			VALUES (?, ?, ?, COALESCE((SELECT MAX(step) FROM sends WHERE contact_id = ? AND error = ''), 0), ?)`,
+			id, sequenceID, types.SequenceActive, id, now.UTC())
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		enrolled += int(n)
+	}
+	return enrolled, tx.Commit()
+}
+
+func (h *Handlers) loadEnrollments() (map[string]enrollment, error) {
+	rows, err := h.db.Query("SELECT contact_id, sequence_id, status, stop_reason, error, retry_at, step_offset FROM enrollments")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	enrollments := map[string]enrollment{}
+	for rows.Next() {
+		var e enrollment
+		var retryAt sql.NullTime
+		if err := rows.Scan(&e.ContactID, &e.SequenceID, &e.Status, &e.StopReason, &e.Error, &retryAt, &e.StepOffset); err != nil {
+			return nil, err
+		}
+		e.RetryAt = retryAt.Time
+		enrollments[e.ContactID] = e
+	}
+	return enrollments, rows.Err()
+}
+
+// finishEnrollment ends a contact's sequence, completed or stopped with a
+// reason, and drops a follow-up that was waiting to be sent.
+func (h *Handlers) finishEnrollment(contactID, status, reason string) error {
+	if _, err := h.db.Exec("UPDATE enrollments SET status = ?, stop_reason = ?, error = '', retry_at = NULL WHERE contact_id = ?",
+		status, reason, contactID); err != nil {
+		return err
+	}
+	_, err := h.db.Exec("DELETE FROM send_queue WHERE contact_id = ? AND step > 0", contactID)
+	return err
+}
+
+func (h *Handlers) saveEnrollmentError(contactID, message string, retryAt time.Time) error {
+	var retry interface{}
+	if !retryAt.IsZero() {
+		retry = retryAt.UTC()
+	}
+	_, err := h.db.Exec("UPDATE enrollments SET error = ?, retry_at = ? WHERE contact_id = ?", message, retry, contactID)
+	return err
+}
+
+// lastDeliveries returns the latest message delivered to each contact.
+func (h *Handlers) lastDeliveries() (map[string]delivery, error) {
+	rows, err := h.db.Query(`SELECT contact_id, step, sent_at FROM sends
+		WHERE id IN (SELECT MAX(id) FROM sends WHERE error = '' GROUP BY contact_id)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := map[string]delivery{}
+	for rows.Next() {
+		var id string
+		var d delivery
+		if err := rows.Scan(&id, &d.Step, &d.SentAt); err != nil {
+			return nil, err
+		}
+		deliveries[id] = d
+	}
+	return deliveries, rows.Err()
+}
+
+func (h *Handlers) saveSequenceMessage(contactID string, step int, body string, now time.Time) error {
+	_, err := h.db.Exec("INSERT OR REPLACE INTO sequence_messages (contact_id, step, body, generated_at) VALUES (?, ?, ?, ?)",
+		contactID, step, body, now.UTC())
+	return err
+}
+
+func (h *Handlers) loadSequenceMessage(contactID string, step int) (string, error) {
+	var body string
+	err := h.db.QueryRow("SELECT body FROM sequence_messages WHERE contact_id = ? AND step = ?", contactID, step).Scan(&body)
+	return body, err
+}
+
+// stopReason is why a contact's status ends their sequence, if it does.
+func stopReason(status string) string {
+	switch status {
+	case types.OutreachReplied:
+		return "replied"
+	case types.OutreachBounced:
+		return "bounced"
+	}
+	return ""
+}
+
+// advanceSequences moves enrolled contacts along their sequence. Contacts
+// who replied or bounced are stopped; for the others, the next follow-up is
+// generated and queued once its delay after the previous message has
+// passed. The send queue then sends it within the mailbox's limits.
+func (h *Handlers) advanceSequences(now time.Time) error {
+	enrollments, err := h.loadEnrollments()
+	if err != nil {
+		return err
+	}
+	active := 0
+	for _, e := range enrollments {
+		if e.Status == types.SequenceActive {
+			active++
+		}
+	}
+	if active == 0 {
+		return nil
+	}
+
+	deliveries, err := h.lastDeliveries()
+	if err != nil {
+		return err
+	}
+	queued, err := h.queuedContacts()
+	if err != nil {
+		return err
+	}
+	sequences := map[int64]types.Sequence{}
+	// The configuration is only needed to generate follow-ups
+	var config *types.Config
+
+	for id, e := range enrollments {
+		if e.Status != types.SequenceActive || now.Before(e.RetryAt) {
+			continue
+		}
+		// Only the stored fields are needed, not the send state
+		contact, err := scanContact(h.db.QueryRow(`SELECT `+contactColumns+` FROM contacts WHERE id = ?`, id))
+		if err == sql.ErrNoRows {
+			if err := h.finishEnrollment(id, types.SequenceStopped, "contact deleted"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if reason := stopReason(contact.OutreachStatus); reason != "" {
+			log.Printf("Stopping the sequence of %s: %s", id, reason)
+			if err := h.finishEnrollment(id, types.SequenceStopped, reason); err != nil {
+				return err
+			}
+			continue
+		}
+
+		last, ok := deliveries[id]
+		if !ok || queued[id] || contact.OutreachStatus != types.OutreachSent {
+			// Waiting for the initial outreach or a queued follow-up
+			continue
+		}
+		seq, ok := sequences[e.SequenceID]
+		if !ok {
+			if seq, err = h.loadSequence(e.SequenceID); err != nil {
+				return err
+			}
+			sequences[e.SequenceID] = seq
+		}
+		next := last.Step + 1
+		position := e.position(next)
+		if position > len(seq.Steps) {
+			if err := h.finishEnrollment(id, types.SequenceCompleted, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		if now.Before(dueAt(seq, e, last)) {
+			continue
+		}
+
+		if _, err := h.loadSequenceMessage(id, next); err == sql.ErrNoRows {
+			if config == nil {
+				loaded, err := h.loadConfig()
+				if err != nil {
+					return err
+				}
+				config = &loaded
+			}
+			body, err := h.generateFollowUp(*config, contact, seq, position)
+			if err != nil {
+				log.Printf("Error generating follow-up %d for %s: %v", position, id, err)
+				if err := h.saveEnrollmentError(id, fmt.Sprintf("Generation error: %v", err), now.Add(sequenceRetryDelay)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := h.saveSequenceMessage(id, next, body, now); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if err := h.queueFollowUp(id, next, now); err != nil {
+			return err
+		}
+		if err := h.saveEnrollmentError(id, "", time.Time{}); err != nil {
+			return err
+		}
+		log.Printf("Queued follow-up %d of %d for %s", position, len(seq.Steps), id)
+	}
+	return nil
+}
+
+// dueAt is when the follow-up after the last delivered message is due.
+func dueAt(seq types.Sequence, e enrollment, last delivery) time.Time {
+	step := seq.Steps[e.position(last.Step)]
+	return last.SentAt.Add(time.Duration(step.DelayDays) * 24 * time.Hour)
+}
+
+// generateFollowUp writes the follow-up at a position of the sequence with
+// the messages sent so far as context.
+func (h *Handlers) generateFollowUp(config types.Config, contact types.Contact, seq types.Sequence, step int) (string, error) {
+	if config.AnthropicAPIKey == "" {
+		return "", types.ErrMissingConfig
+	}
+	history, err := h.deliveredMessages(contact.ID)
+	if err != nil {
+		return "", err
+	}
+	// Follow-ups in a campaign are written like its initial outreach
+	var profileID int64
+	campaign, err := h.contactCampaign(contact)
+	if err != nil {
+		return "", err
+	}
+	if campaign != nil {
+		config = applyCampaign(config, *campaign)
+		profileID = campaign.ProfileID
+	}
+	pc, err := h.loadPromptContext(profileID)
+	if err != nil {
+		return "", err
+	}
+	instructions, err := pc.expand(seq.Steps[step-1].Prompt)
+	if err != nil {
+		return "", fmt.Errorf("step %d prompt: %w", step, err)
+	}
+	// Follow-ups stay in the language the outreach was written in
+	language := config.DefaultLanguage
+	if contact.OutreachLanguage != "" {
+		language = contact.OutreachLanguage
+	}
+	return h.completePrompt(config, buildFollowUpPrompt(contact, language, seq, step, history, pc, instructions))
+}
+
+func buildFollowUpPrompt(contact types.Contact, language string, seq types.Sequence, step int, history []types.SendResult, pc promptContext, instructions string) string {
+	var earlier strings.Builder
+	for i, msg := range history {
+		fmt.Fprintf(&earlier, "--- Message %d, sent %s ---\nSubject: %s\n\n%s\n\n",
+			i+1, msg.SentAt.Format("2006-01-02"), msg.Subject, msg.Body)
+	}
+
+	return fmt.Sprintf(`You are a professional outreach specialist. Write follow-up %d of %d in %s to %s from %s, who has not replied to the earlier messages below.
+
+Earlier messages, oldest first:
+%s
+Contact Information:
+- Name: %s
+- Company: %s
+- Business Segment: %s
+
+%sInstructions for this follow-up:
+%s
+
+Important formatting rules:
+1. Write only the email body; it is sent as a reply in the same thread, so do not write a subject line
+2. Do not repeat the earlier messages; add something new or give a short, polite nudge
+3. Use the actual person's name and company from the contact info
+4. Do not use placeholders like [Name] or [Company] - use the actual values
+5. Do not include any explanatory text or metadata - just the email body
+6. Keep it short - no more than 2 short paragraphs`,
+		step, len(seq.Steps), language, contact.Fullname, contact.CompanyName,
+		earlier.String(),
+		contact.Fullname,
+		contact.CompanyName,
+		contact.BusinessSegment,
+		pc.section(),
+		instructions)
+}
+
+// sendFollowUp emails a generated follow-up as a reply to the initial
+// outreach.
+func (h *Handlers) sendFollowUp(config types.Config, contact types.Contact, step int) (types.SendResult, error) {
+	h.sends.mu.Lock()
+	defer h.sends.mu.Unlock()
+
+	if contact.OutreachStatus != types.OutreachSent {
+		return types.SendResult{}, fmt.Errorf("%w: %v", errUnsendable, errNotSent)
+	}
+	if sent, err := h.wasSent(contact.ID, step); err != nil {
+		return types.SendResult{}, err
+	} else if sent {
+		return types.SendResult{}, errAlreadySent
+	}
+	history, err := h.deliveredMessages(contact.ID)
+	if err != nil {
+		return types.SendResult{}, err
+	}
+	if len(history) == 0 || history[0].Step != 0 {
+		return types.SendResult{}, fmt.Errorf("%w: %v", errUnsendable, errNotSent)
+	}
+	body, err := h.loadSequenceMessage(contact.ID, step)
+	if err == sql.ErrNoRows {
+		return types.SendResult{}, errNoFollowUp
+	}
+	if err != nil {
+		return types.SendResult{}, err
+	}
+
+	msg, err := followUpMessage(config, contact, history[0], body)
+	if err != nil {
+		return types.SendResult{}, err
+	}
+	return h.deliver(config, contact.ID, step, msg)
+}
+
+// attachSequences sets where each enrolled contact stands in their
+// sequence.
+func (h *Handlers) attachSequences(contacts []types.Contact) error {
+	enrollments, err := h.loadEnrollments()
+	if err != nil || len(enrollments) == 0 {
+		return err
+	}
+	deliveries, err := h.lastDeliveries()
+	if err != nil {
+		return err
+	}
+	sequences := map[int64]types.Sequence{}
+
+	for i, c := range contacts {
+		e, ok := enrollments[c.ID]
+		if !ok {
+			continue
+		}
+		seq, ok := sequences[e.SequenceID]
+		if !ok {
+			if seq, err = h.loadSequence(e.SequenceID); err != nil {
+				return err
+			}
+			sequences[e.SequenceID] = seq
+		}
+
+		progress := types.SequenceProgress{
+			SequenceID: seq.ID,
+			Name:       seq.Name,
+			Steps:      len(seq.Steps),
+			Status:     e.Status,
+			StopReason: e.StopReason,
+			Error:      e.Error,
+		}
+		if last, ok := deliveries[c.ID]; ok {
+			progress.Sent = min(e.position(last.Step), len(seq.Steps))
+			if e.Status == types.SequenceActive && e.position(last.Step) < len(seq.Steps) {
+				progress.NextDueAt = dueAt(seq, e, last)
+			}
+		}
+		contacts[i].Sequence = &progress
+	}
+	return nil
+}
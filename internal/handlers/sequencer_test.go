@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"outreach-generator/internal/settings"
+	"outreach-generator/internal/types"
+)
+
+func addDelivery(t *testing.T, h *Handlers, contactID string, step int, sentAt time.Time) {
+	t.Helper()
+	if _, err := h.db.Exec(`INSERT INTO sends (contact_id, step, recipient, subject, sent_at)
+		VALUES (?, ?, 'anna@example.com', 'Hello', ?)`, contactID, step, sentAt.UTC()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSequenceAfterDeletedSequence(t *testing.T) {
+	// Generation must fail rather than reach the API
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	h := newTestHandlers(t)
+	layers, err := settings.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.settings = layers
+
+	now := time.Now()
+	if _, err := h.db.Exec(`INSERT INTO contacts (id, source, email, outreach_status, synced_at)
+		VALUES ('anna', 'test', 'anna@example.com', ?, ?)`, types.OutreachSent, now); err != nil {
+		t.Fatal(err)
+	}
+	addDelivery(t, h, "anna", 0, now.AddDate(0, 0, -10))
+
+	old, err := h.saveSequence(types.Sequence{Name: "Old", Steps: []types.SequenceStep{
+		{DelayDays: 1, Prompt: "Old nudge"}, {DelayDays: 1, Prompt: "Old case study"}, {DelayDays: 1, Prompt: "Old breakup"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.enrollContacts(old.ID, []string{"anna"}, now); err != nil {
+		t.Fatal(err)
+	}
+	// The first follow-up went out and the second was generated and queued
+	addDelivery(t, h, "anna", 1, now.AddDate(0, 0, -5))
+	if err := h.saveSequenceMessage("anna", 2, "Old case study body", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.queueFollowUp("anna", 2, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.deleteSequence(old.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.loadSequenceMessage("anna", 2); err != sql.ErrNoRows {
+		t.Fatalf("follow-up of the deleted sequence kept: %v", err)
+	}
+
+	seq, err := h.saveSequence(types.Sequence{Name: "New", Steps: []types.SequenceStep{
+		{DelayDays: 7, Prompt: "New nudge"}, {DelayDays: 2, Prompt: "New breakup"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.enrollContacts(seq.ID, []string{"anna"}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new sequence's first step waits 7 days after the last delivery
+	if err := h.advanceSequences(now); err != nil {
+		t.Fatal(err)
+	}
+	enrollments, err := h.loadEnrollments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := enrollments["anna"]; e.StepOffset != 1 || e.Error != "" {
+		t.Fatalf("enrollment = %+v, want step offset 1 and no error", e)
+	}
+
+	// When it is due, its own follow-up is generated rather than the old one sent
+	if err := h.advanceSequences(now.AddDate(0, 0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	queued, err := h.queuedContacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued["anna"] {
+		t.Error("a follow-up was queued without being generated")
+	}
+	if enrollments, err = h.loadEnrollments(); err != nil {
+		t.Fatal(err)
+	}
+	if e := enrollments["anna"]; !strings.HasPrefix(e.Error, "Generation error") {
+		t.Errorf("enrollment error = %q, want a generation error", e.Error)
+	}
+
+	// Both of its follow-ups delivered complete the sequence
+	addDelivery(t, h, "anna", 2, now.AddDate(0, 0, 3))
+	addDelivery(t, h, "anna", 3, now.AddDate(0, 0, 5))
+	if err := h.advanceSequences(now.AddDate(0, 0, 6)); err != nil {
+		t.Fatal(err)
+	}
+	if enrollments, err = h.loadEnrollments(); err != nil {
+		t.Fatal(err)
+	}
+	if e := enrollments["anna"]; e.Status != types.SequenceCompleted {
+		t.Errorf("enrollment status = %q, want %q", e.Status, types.SequenceCompleted)
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,136 +18,140 @@ import (
 	"github.com/gocolly/colly/v2"
 )
 
-func (h *Handlers) fetchAirtableContacts(config types.Config) ([]types.Contact, error) {
-	baseURL := fmt.Sprintf("https://api.airtable.com/v0/%s/%s?view=Grid%%20view",
-		config.AirtableBaseID,
-		url.PathEscape(config.AirtableTableName))
-
-	req, err := http.NewRequest("GET", baseURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.AirtableAccessToken))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("airtable API error: %s - %s", resp.Status, string(body))
-	}
+const (
+	airtableAPI  = "https://api.airtable.com/v0"
+	anthropicAPI = "https://api.anthropic.com/v1"
+)
 
-	var result struct {
-		Records []struct {
-			ID          string `json:"id"`
-			CreatedTime string `json:"createdTime"`
-			Fields      struct {
-				Email           string `json:"email"`
-				Fullname        string `json:"fullname"`
-				Country         string `json:"country"`
-				BusinessSegment string `json:"business segment"`
-				City            string `json:"city"`
-				CompanyName     string `json:"company name"`
-				Phone           string `json:"phone"`
-				Website         string `json:"website"`
-				OutreachText    string `json:"outreach_text,omitempty"`
-			} `json:"fields"`
-		} `json:"records"`
-		Offset string `json:"offset,omitempty"`
-	}
+// apiClient is used for Airtable and Anthropic calls.
+var apiClient = &http.Client{Timeout: 60 * time.Second}
+
+// fetchAirtableContacts reads every record of the table's grid view,
+// following pagination. A non-zero modifiedSince only returns records changed
+// after it, using a LAST_MODIFIED_TIME() formula.
+func (h *Handlers) fetchAirtableContacts(config types.Config, modifiedSince time.Time) ([]types.Contact, error) {
+	query := url.Values{}
+	query.Set("view", "Grid view")
+	query.Set("pageSize", "100")
+	if !modifiedSince.IsZero() {
+		query.Set("filterByFormula", fmt.Sprintf("IS_AFTER(LAST_MODIFIED_TIME(), DATETIME_PARSE('%s'))",
+			modifiedSince.UTC().Format(time.RFC3339)))
+	}
+
+	var contacts []types.Contact
+	for {
+		baseURL := fmt.Sprintf("%s/%s/%s?%s", airtableAPI,
+			config.AirtableBaseID,
+			url.PathEscape(config.AirtableTableName),
+			query.Encode())
+
+		var result struct {
+			Records []airtableRecord `json:"records"`
+			Offset  string           `json:"offset,omitempty"`
+		}
+		if err := airtableRequest(config, "GET", baseURL, nil, &result); err != nil {
+			return nil, err
+		}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("error decoding response: %w", err)
-	}
+		for _, record := range result.Records {
+			contact, err := contactFromRecord(config, record)
+			if err != nil {
+				return nil, err
+			}
+			contacts = append(contacts, contact)
+		}
 
-	contacts := make([]types.Contact, len(result.Records))
-	for i, record := range result.Records {
-		contacts[i] = types.Contact{
-			ID:              record.ID,
-			Fullname:        record.Fields.Fullname,
-			CompanyName:     record.Fields.CompanyName,
-			BusinessSegment: record.Fields.BusinessSegment,
-			Website:         record.Fields.Website,
-			Phone:           record.Fields.Phone,
-			City:            record.Fields.City,
-			Country:         record.Fields.Country,
-			Email:           record.Fields.Email,
-			OutreachText:    record.Fields.OutreachText,
+		if result.Offset == "" {
+			return contacts, nil
 		}
+		query.Set("offset", result.Offset)
 	}
-
-	return contacts, nil
 }
 
-func (h *Handlers) updateAirtableOutreach(config types.Config, recordID, outreachText string) error {
-	baseURL := fmt.Sprintf("https://api.airtable.com/v0/%s/%s/%s",
+// fetchAirtableContact reads a single record with the get-record endpoint.
+func (h *Handlers) fetchAirtableContact(config types.Config, recordID string) (types.Contact, error) {
+	recordURL := fmt.Sprintf("%s/%s/%s/%s", airtableAPI,
 		config.AirtableBaseID,
 		url.PathEscape(config.AirtableTableName),
-		recordID)
-
-	payload := struct {
-		Fields struct {
-			OutreachText string `json:"outreach_text"`
-		} `json:"fields"`
-	}{}
-	payload.Fields.OutreachText = outreachText
+		url.PathEscape(recordID))
 
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return err
+	var record airtableRecord
+	if err := airtableRequest(config, "GET", recordURL, nil, &record); err != nil {
+		return types.Contact{}, err
 	}
+	return contactFromRecord(config, record)
+}
 
-	req, err := http.NewRequest("PATCH", baseURL, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+config.AirtableAccessToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("airtable API error: %s - %s", resp.Status, string(body))
-	}
+type airtableRecord struct {
+	ID          string          `json:"id"`
+	CreatedTime string          `json:"createdTime"`
+	Fields      json.RawMessage `json:"fields"`
+}
 
-	return nil
+func contactFromRecord(config types.Config, record airtableRecord) (types.Contact, error) {
+	var fields struct {
+		Email           string `json:"email"`
+		Fullname        string `json:"fullname"`
+		Country         string `json:"country"`
+		BusinessSegment string `json:"business segment"`
+		City            string `json:"city"`
+		CompanyName     string `json:"company name"`
+		Phone           string `json:"phone"`
+		Website         string `json:"website"`
+	}
+	// The output fields are configurable, so they are read by name
+	var named map[string]interface{}
+	if err := json.Unmarshal(record.Fields, &fields); err != nil {
+		return types.Contact{}, fmt.Errorf("error decoding record %s: %w", record.ID, err)
+	}
+	if err := json.Unmarshal(record.Fields, &named); err != nil {
+		return types.Contact{}, fmt.Errorf("error decoding record %s: %w", record.ID, err)
+	}
+
+	return types.Contact{
+		ID:              record.ID,
+		Fullname:        fields.Fullname,
+		CompanyName:     fields.CompanyName,
+		BusinessSegment: fields.BusinessSegment,
+		Website:         fields.Website,
+		Phone:           fields.Phone,
+		City:            fields.City,
+		Country:         fields.Country,
+		Email:           fields.Email,
+		Language:        stringField(named, config.AirtableLanguageField),
+		OutreachText:    stringField(named, config.AirtableBodyField),
+		OutreachStatus:  stringField(named, config.AirtableStatusField),
+		OutreachModel:   stringField(named, config.AirtableModelField),
+		GeneratedAt:     stringField(named, config.AirtableGeneratedAtField),
+		CreatedTime:     record.CreatedTime,
+	}, nil
 }
 
-func (h *Handlers) generateOutreachText(config types.Config, req struct {
-	Website     string `json:"website"`
-	Prompt      string `json:"prompt"`
-	RecordID    string `json:"recordId"`
-	Language    string `json:"language"`
-	ContactInfo struct {
-		Name    string `json:"name"`
-		Company string `json:"company"`
-		Segment string `json:"segment"`
-	} `json:"contactInfo"`
-}, websiteContent string) (string, error) {
+func (h *Handlers) generateOutreachText(config types.Config, req outreachRequest, pc promptContext, websiteContent string) (string, error) {
 	log.Printf("Generating outreach with data:")
 	log.Printf("- Website: %s", req.Website)
 	log.Printf("- Prompt template: %s", req.Prompt)
 	log.Printf("- Contact: %s from %s (%s)", req.ContactInfo.Name, req.ContactInfo.Company, req.ContactInfo.Segment)
 
+	prompt, err := pc.expand(req.Prompt)
+	if err != nil {
+		return "", err
+	}
+	req.Prompt = prompt
+
 	// Build the system prompt
-	systemPrompt := h.buildSystemPrompt(req, websiteContent)
+	return h.completePrompt(config, h.buildSystemPrompt(req, pc, websiteContent))
+}
+
+// completePrompt sends a prompt to Anthropic and returns the reply text.
+func (h *Handlers) completePrompt(config types.Config, systemPrompt string) (string, error) {
 	log.Printf("Sending prompt to Anthropic:\n%s", systemPrompt)
 
 	// Prepare the request to Anthropic's API
-	anthropicURL := "https://api.anthropic.com/v1/messages"
+	anthropicURL := anthropicAPI + "/messages"
 	requestBody := map[string]interface{}{
-		"model":      "claude-3-sonnet-20240229",
-		"max_tokens": 1000,
+		"model":      config.AnthropicModel,
+		"max_tokens": config.MaxTokens,
 		"messages": []map[string]string{
 			{
 				"role":    "user",
@@ -169,7 +174,7 @@ func (h *Handlers) generateOutreachText(config types.Config, req struct {
 	req2.Header.Set("anthropic-version", "2023-06-01")
 	req2.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req2)
+	resp, err := apiClient.Do(req2)
 	if err != nil {
 		return "", err
 	}
@@ -200,8 +205,22 @@ func (h *Handlers) generateOutreachText(config types.Config, req struct {
 }
 
 func (h *Handlers) fetchAirtableSchema(config types.Config) (*types.TableSchema, error) {
-	baseURL := fmt.Sprintf("https://api.airtable.com/v0/meta/bases/%s/tables",
-		config.AirtableBaseID)
+	tables, err := h.fetchAirtableTables(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find our table
+	if table := findTable(tables, config.AirtableTableName); table != nil {
+		return table, nil
+	}
+	return nil, fmt.Errorf("table %s not found", config.AirtableTableName)
+}
+
+// fetchAirtableTables lists the tables of the configured base with their
+// fields, using the Meta API.
+func (h *Handlers) fetchAirtableTables(config types.Config) ([]types.TableSchema, error) {
+	baseURL := fmt.Sprintf("%s/meta/bases/%s/tables", airtableAPI, url.PathEscape(config.AirtableBaseID))
 
 	log.Printf("Fetching Airtable schema from: %s", baseURL)
 
@@ -211,112 +230,148 @@ func (h *Handlers) fetchAirtableSchema(config types.Config) (*types.TableSchema,
 	}
 
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.AirtableAccessToken))
-	log.Printf("Using Authorization header: Bearer %s...", config.AirtableAccessToken[:10])
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := apiClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error making request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
 	log.Printf("Response status: %s", resp.Status)
-	log.Printf("Response body: %s", string(body))
-
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("airtable API error: %s - %s", resp.Status, string(body))
+		return nil, parseAPIError(resp)
 	}
 
 	var result struct {
-		Tables []struct {
-			ID     string `json:"id"`
-			Name   string `json:"name"`
-			Fields []struct {
-				ID          string `json:"id"`
-				Name        string `json:"name"`
-				Type        string `json:"type"`
-				Description string `json:"description"`
-			} `json:"fields"`
-		} `json:"tables"`
+		Tables []types.TableSchema `json:"tables"`
 	}
-
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error decoding response: %w", err)
 	}
+	return result.Tables, nil
+}
 
-	// Find our table
-	var tableSchema *types.TableSchema
-	for _, table := range result.Tables {
-		if table.Name == config.AirtableTableName {
-			tableSchema = &types.TableSchema{
-				Fields: make([]types.AirtableField, len(table.Fields)),
-			}
-			for i, field := range table.Fields {
-				tableSchema.Fields[i] = types.AirtableField{
-					ID:          field.ID,
-					Name:        field.Name,
-					Type:        field.Type,
-					Description: field.Description,
-				}
-			}
-			break
+// stringField returns a text field from a record's fields, or "" when the
+// field is empty or not text.
+func stringField(fields map[string]interface{}, name string) string {
+	s, _ := fields[name].(string)
+	return s
+}
+
+// fetchAirtableBases lists every base the access token can access, following
+// the Meta API's pagination.
+func (h *Handlers) fetchAirtableBases(config types.Config) ([]types.AirtableBase, error) {
+	var bases []types.AirtableBase
+	offset := ""
+	for {
+		endpoint := airtableAPI + "/meta/bases"
+		if offset != "" {
+			endpoint += "?offset=" + url.QueryEscape(offset)
 		}
-	}
 
-	if tableSchema == nil {
-		return nil, fmt.Errorf("table %s not found", config.AirtableTableName)
-	}
+		var page struct {
+			Bases  []types.AirtableBase `json:"bases"`
+			Offset string               `json:"offset"`
+		}
+		if err := airtableRequest(config, "GET", endpoint, nil, &page); err != nil {
+			return nil, err
+		}
+		bases = append(bases, page.Bases...)
 
-	return tableSchema, nil
+		if page.Offset == "" {
+			return bases, nil
+		}
+		offset = page.Offset
+	}
 }
 
-func checkWebsite(url string) error {
-	// Dodaj http:// jeśli nie ma protokołu
-	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
-		url = "http://" + url
-	}
+// parseAPIError turns an error response into an error with the service's own
+// message. Airtable and Anthropic both send {"error": {"type", "message"}};
+// Airtable sometimes sends just {"error": "TYPE"}.
+func parseAPIError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if len(via) >= 10 {
-				return fmt.Errorf("too many redirects")
-			}
-			return nil
-		},
+	var parsed struct {
+		Error json.RawMessage `json:"error"`
 	}
-
-	resp, err := client.Get(url)
-	if err != nil {
-		return fmt.Errorf("website unavailable: %w", err)
+	if json.Unmarshal(body, &parsed) == nil && len(parsed.Error) > 0 {
+		var detail struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(parsed.Error, &detail) == nil && detail.Type != "" {
+			return &apiError{Status: resp.StatusCode, Type: detail.Type, Message: detail.Message}
+		}
+		var kind string
+		if json.Unmarshal(parsed.Error, &kind) == nil {
+			return &apiError{Status: resp.StatusCode, Type: kind}
+		}
 	}
-	defer resp.Body.Close()
+	return &apiError{Status: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("website returned status code: %d", resp.StatusCode)
-	}
+// apiError is a non-2xx response from Airtable or Anthropic.
+type apiError struct {
+	Status  int
+	Type    string
+	Message string
+}
 
-	return nil
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("API error: %d %s", e.Status, http.StatusText(e.Status))
+	if e.Type != "" {
+		msg += " - " + e.Type
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
 }
 
-func (h *Handlers) fetchWebsiteContent(websiteURL string) (string, error) {
-	// Add http:// if no protocol specified
-	if !strings.HasPrefix(websiteURL, "http://") && !strings.HasPrefix(websiteURL, "https://") {
-		websiteURL = "http://" + websiteURL
+func (h *Handlers) fetchWebsiteContent(config types.Config, websiteURL string) (string, error) {
+	websiteURL, err := h.fetch.normalizeWebsiteURL(websiteURL)
+	if err != nil {
+		return "", err
 	}
 
 	log.Printf("Fetching content from: %s", websiteURL)
 
+	policy := crawlPolicyFromConfig(config)
+
 	c := colly.NewCollector(
 		colly.MaxDepth(1),
-		colly.UserAgent("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"),
+		colly.UserAgent(policy.UserAgent),
 		colly.Async(true),
 	)
 
 	// Ustaw timeout dla requestów
 	c.SetRequestTimeout(10 * time.Second)
 
+	// Every request, including redirects, goes through the fetch policy.
+	// robots.txt and per-host limits are enforced by the crawl transport.
+	c.WithTransport(h.crawl.transport(policy))
+	c.SetRedirectHandler(h.fetch.checkRedirect)
+
+	var fetchErr error
+	c.OnError(func(_ *colly.Response, err error) {
+		fetchErr = err
+	})
+
 	var texts []string
+	var pdfLinks []pdfLink
+
+	// Zapamiętaj linki do dokumentów PDF (broszury, katalogi, case studies)
+	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
+		href := e.Attr("href")
+		if !isPDFLink(href) {
+			return
+		}
+		link := e.Request.AbsoluteURL(href)
+		if link == "" {
+			return
+		}
+		pdfLinks = addPDFLink(pdfLinks, pdfLink{URL: link, Title: pdfTitle(e.Text, link)})
+	})
 
 	// Zbierz tekst z najważniejszych elementów
 	c.OnHTML("body", func(e *colly.HTMLElement) {
@@ -337,7 +392,7 @@ func (h *Handlers) fetchWebsiteContent(websiteURL string) (string, error) {
 		}
 	})
 
-	err := c.Visit(websiteURL)
+	err = c.Visit(websiteURL)
 	if err != nil {
 		return "", fmt.Errorf("error visiting website: %w", err)
 	}
@@ -345,6 +400,15 @@ func (h *Handlers) fetchWebsiteContent(websiteURL string) (string, error) {
 	// Poczekaj na zakończenie wszystkich requestów
 	c.Wait()
 
+	if fetchErr != nil {
+		if errors.Is(fetchErr, ErrRobotsDisallowed) {
+			return "", ErrRobotsDisallowed
+		}
+		if len(texts) == 0 {
+			return "", fmt.Errorf("error visiting website: %w", fetchErr)
+		}
+	}
+
 	// Połącz wszystkie znalezione teksty
 	content := strings.Join(texts, "\n")
 	content = cleanWebsiteContent(content)
@@ -356,24 +420,19 @@ func (h *Handlers) fetchWebsiteContent(websiteURL string) (string, error) {
 		log.Printf("Content: %s", content)
 	}
 
+	if documents, n := h.fetchPDFExcerpts(config, pdfLinks); n > 0 {
+		log.Printf("Added excerpts from %d of %d linked PDF documents", n, len(pdfLinks))
+		content = strings.TrimSpace(content + "\n\n" + documents)
+	}
+
 	if content == "" {
-		return "", fmt.Errorf("no content found on the website")
+		return "", ErrNoContent
 	}
 
 	return content, nil
 }
 
-func (h *Handlers) buildSystemPrompt(req struct {
-	Website     string `json:"website"`
-	Prompt      string `json:"prompt"`
-	RecordID    string `json:"recordId"`
-	Language    string `json:"language"`
-	ContactInfo struct {
-		Name    string `json:"name"`
-		Company string `json:"company"`
-		Segment string `json:"segment"`
-	} `json:"contactInfo"`
-}, websiteContent string) string {
+func (h *Handlers) buildSystemPrompt(req outreachRequest, pc promptContext, websiteContent string) string {
 	return fmt.Sprintf(`You are a professional outreach specialist. Generate the outreach email in %s based on this website content about %s:
 
 Website Content:
@@ -384,7 +443,7 @@ Contact Information:
 - Company: %s
 - Business Segment: %s
 
-Additional Context:
+%sAdditional Context:
 %s
 
 Important formatting rules:
@@ -397,13 +456,15 @@ Important formatting rules:
 7. Reference specific details from their website to show personalization
 8. Keep the tone professional but friendly
 9. Focus on how we can help them, not just what we do
-10. Keep it concise - no more than 3-4 paragraphs`,
+10. Keep it concise - no more than 3-4 paragraphs
+11. Only claim services, clients and results given above - do not invent any`,
 		req.Language,
 		req.ContactInfo.Company,
 		websiteContent,
 		req.ContactInfo.Name,
 		req.ContactInfo.Company,
 		req.ContactInfo.Segment,
+		pc.section(),
 		req.Prompt)
 }
 
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"outreach-generator/internal/types"
+)
+
+// ContactSource is where a list of contacts comes from and where generated
+// outreach is written back to. Contacts of every source are read from the
+// local mirror.
+type ContactSource interface {
+	// Key identifies the source in the contacts mirror
+	Key() string
+	Name() string
+	// Check reports configuration the source needs but is missing
+	Check(config types.Config) error
+	// Contacts returns the source's contacts from the mirror
+	Contacts() ([]types.Contact, error)
+	// WriteOutreach stores updates and returns an error for every record
+	// that could not be written
+	WriteOutreach(config types.Config, updates []types.OutreachUpdate) map[string]error
+	// Refresh re-reads one contact after a write, where the source can
+	// change what was written
+	Refresh(config types.Config, id string) error
+}
+
+// airtableSource reads contacts from the configured Airtable table through
+// the sync and writes outreach to its output fields.
+type airtableSource struct {
+	h *Handlers
+}
+
+func (s airtableSource) Key() string  { return sourceAirtable }
+func (s airtableSource) Name() string { return "Airtable" }
+
+func (s airtableSource) Check(config types.Config) error {
+	if config.AirtableAccessToken == "" || config.AirtableBaseID == "" || config.AirtableTableName == "" {
+		return types.ErrMissingConfig
+	}
+	return nil
+}
+
+func (s airtableSource) Contacts() ([]types.Contact, error) {
+	return s.h.mirroredContacts()
+}
+
+func (s airtableSource) WriteOutreach(config types.Config, updates []types.OutreachUpdate) map[string]error {
+	return s.h.writeOutreach(config, updates)
+}
+
+func (s airtableSource) Refresh(config types.Config, id string) error {
+	return s.h.refreshContact(config, id)
+}
+
+// fileSource is an imported CSV or XLSX list. Outreach is only stored
+// locally and leaves through the export.
+type fileSource struct {
+	h   *Handlers
+	imp types.Import
+}
+
+func (s fileSource) Key() string                     { return s.imp.ID }
+func (s fileSource) Name() string                    { return s.imp.Name }
+func (s fileSource) Check(config types.Config) error { return nil }
+
+func (s fileSource) Contacts() ([]types.Contact, error) {
+	return s.h.listContacts(s.imp.ID)
+}
+
+func (s fileSource) WriteOutreach(config types.Config, updates []types.OutreachUpdate) map[string]error {
+	return s.h.writeLocalOutreach(updates)
+}
+
+func (s fileSource) Refresh(config types.Config, id string) error { return nil }
+
+var errUnknownSource = errors.New("unknown contact source")
+
+// writeLocalOutreach stores updates of a source whose outreach only lives in
+// the mirror.
+func (h *Handlers) writeLocalOutreach(updates []types.OutreachUpdate) map[string]error {
+	errs := map[string]error{}
+	for _, u := range updates {
+		if err := h.applyOutreachUpdate(u); err != nil {
+			errs[u.RecordID] = err
+		}
+	}
+	return errs
+}
+
+// contactSource looks up a source by its key. An empty key is Airtable, the
+// source used before imports existed.
+func (h *Handlers) contactSource(key string) (ContactSource, error) {
+	if key == "" || key == sourceAirtable {
+		return airtableSource{h: h}, nil
+	}
+	if id, ok := campaignID(key); ok {
+		c, err := h.loadCampaign(id)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %s", errUnknownSource, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return campaignSource{h: h, campaign: c}, nil
+	}
+
+	imp, err := h.loadImport(key)
+	if err == sql.ErrNoRows || (err == nil && imp.Status != types.ImportImported) {
+		return nil, fmt.Errorf("%w: %s", errUnknownSource, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fileSource{h: h, imp: imp}, nil
+}
+
+// contactSources lists Airtable, every finished import and every campaign
+// for the source picker on the home page.
+func (h *Handlers) contactSources() []types.ContactSourceInfo {
+	sources := h.listSources()
+	campaigns, err := h.listCampaigns()
+	if err != nil {
+		log.Printf("Warning: Failed to list campaigns: %v", err)
+		return sources
+	}
+	for _, c := range campaigns {
+		sources = append(sources, types.ContactSourceInfo{
+			Key:  campaignKey(c.ID),
+			Name: fmt.Sprintf("Campaign: %s (%d contacts)", c.Name, c.Counts.Contacts),
+		})
+	}
+	return sources
+}
+
+// listSources lists Airtable and every finished import, the sources a
+// campaign can copy its contacts from.
+func (h *Handlers) listSources() []types.ContactSourceInfo {
+	sources := []types.ContactSourceInfo{{Key: sourceAirtable, Name: "Airtable"}}
+
+	imports, err := h.listImports()
+	if err != nil {
+		log.Printf("Warning: Failed to list imports: %v", err)
+		return sources
+	}
+	for _, imp := range imports {
+		if imp.Status == types.ImportImported {
+			sources = append(sources, types.ContactSourceInfo{
+				Key:  imp.ID,
+				Name: fmt.Sprintf("%s (%d contacts)", imp.Name, imp.Imported),
+			})
+		}
+	}
+	return sources
+}
+
+// sourceConfig loads the configuration for generating outreach for a source:
+// the Anthropic key plus whatever the source itself needs, with the
+// settings of a campaign applied.
+func (h *Handlers) sourceConfig(source ContactSource) (types.Config, error) {
+	config, err := h.loadConfig()
+	if err != nil {
+		return config, err
+	}
+	if c, ok := source.(campaignSource); ok {
+		config = applyCampaign(config, c.campaign)
+	}
+	if config.AnthropicAPIKey == "" {
+		return config, types.ErrMissingConfig
+	}
+	return config, source.Check(config)
+}
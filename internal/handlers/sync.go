@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"outreach-generator/internal/components"
+	"outreach-generator/internal/types"
+)
+
+const (
+	// fullSyncEvery bounds how long records deleted in Airtable can linger
+	// in the mirror, since incremental syncs cannot see deletions
+	fullSyncEvery = 24 * time.Hour
+	// syncOverlap re-reads records changed shortly before the previous sync
+	// started, to cover clock differences with Airtable
+	syncOverlap = time.Minute
+	// syncCheckInterval is how often the schedule checks whether a sync is due
+	syncCheckInterval = time.Minute
+)
+
+var errSyncRunning = errors.New("a sync is already running")
+
+// contactSyncer makes sure only one sync runs at a time.
+type contactSyncer struct {
+	mu      sync.Mutex
+	running bool
+}
+
+func (s *contactSyncer) start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return false
+	}
+	s.running = true
+	return true
+}
+
+func (s *contactSyncer) finish() {
+	s.mu.Lock()
+	s.running = false
+	s.mu.Unlock()
+}
+
+func (s *contactSyncer) isRunning() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// syncContacts refreshes the contacts mirror from Airtable. Incremental syncs
+// only read records modified since the previous sync; a full sync reads all
+// of them and drops records that no longer exist. A full sync also runs when
+// the last one is older than fullSyncEvery.
+func (h *Handlers) syncContacts(full bool) error {
+	if !h.sync.start() {
+		return errSyncRunning
+	}
+	defer h.sync.finish()
+
+	state, err := h.loadSyncState(sourceAirtable)
+	if err != nil {
+		return err
+	}
+
+	config, err := h.getRequiredConfig()
+	if err != nil {
+		h.recordSyncError(state, err)
+		return err
+	}
+
+	if state.LastFullSyncAt.IsZero() || time.Since(state.LastFullSyncAt) > fullSyncEvery {
+		full = true
+	}
+
+	start := time.Now().UTC()
+	var since time.Time
+	if !full {
+		since = state.LastSyncAt.Add(-syncOverlap)
+	}
+
+	contacts, err := h.fetchAirtableContacts(config, since)
+	if err == nil {
+		err = h.storeSyncedContacts(contacts, full, start)
+	}
+	if err != nil {
+		log.Printf("Error syncing contacts: %v", err)
+		h.recordSyncError(state, err)
+		return err
+	}
+
+	state.LastSyncAt = start
+	if full {
+		state.LastFullSyncAt = start
+	}
+	state.Changed = len(contacts)
+	state.Error = ""
+	if state.Records, err = h.countContacts(sourceAirtable); err != nil {
+		return err
+	}
+	log.Printf("Synced contacts (full=%t): %d changed, %d in mirror", full, state.Changed, state.Records)
+	return h.saveSyncState(state)
+}
+
+// recordSyncError keeps the last error for the status bar; the mirror keeps
+// the contacts of the last successful sync.
+func (h *Handlers) recordSyncError(state types.SyncStatus, err error) {
+	state.Error = err.Error()
+	if saveErr := h.saveSyncState(state); saveErr != nil {
+		log.Printf("Error saving sync state: %v", saveErr)
+	}
+}
+
+func (h *Handlers) storeSyncedContacts(contacts []types.Contact, full bool, start time.Time) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := upsertContacts(tx, sourceAirtable, contacts, start); err != nil {
+		return err
+	}
+	if full {
+		deleted, err := deleteContactsNotSynced(tx, sourceAirtable, start)
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			log.Printf("Removed %d contacts deleted in Airtable", deleted)
+		}
+	}
+	return tx.Commit()
+}
+
+// refreshContact re-reads one record with the get-record endpoint and stores
+// it in the mirror.
+func (h *Handlers) refreshContact(config types.Config, id string) error {
+	contact, err := h.fetchAirtableContact(config, id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := upsertContacts(tx, sourceAirtable, []types.Contact{contact}, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scheduleSync runs incremental syncs every sync_interval_minutes. The
+// interval is re-read each time, so changes on /config apply without a
+// restart.
+func (h *Handlers) scheduleSync() {
+	ticker := time.NewTicker(syncCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		config, err := h.loadConfig()
+		if err != nil || config.SyncIntervalMinutes <= 0 {
+			continue
+		}
+		state, err := h.loadSyncState(sourceAirtable)
+		if err != nil {
+			continue
+		}
+		interval := time.Duration(config.SyncIntervalMinutes) * time.Minute
+		if time.Since(state.LastSyncAt) < interval {
+			continue
+		}
+
+		if err := h.syncContacts(false); err != nil && !errors.Is(err, errSyncRunning) && !errors.Is(err, types.ErrMissingConfig) {
+			log.Printf("Scheduled sync failed: %v", err)
+		}
+	}
+}
+
+// mirroredContacts returns the contacts from the mirror, syncing first when
+// the mirror has never been filled.
+func (h *Handlers) mirroredContacts() ([]types.Contact, error) {
+	state, err := h.loadSyncState(sourceAirtable)
+	if err != nil {
+		return nil, err
+	}
+	if state.LastSyncAt.IsZero() {
+		if err := h.syncContacts(false); err != nil && !errors.Is(err, errSyncRunning) {
+			return nil, err
+		}
+	}
+	return h.listContacts(sourceAirtable)
+}
+
+// syncStatus combines the stored sync state with whether a sync is running.
+func (h *Handlers) syncStatus() (types.SyncStatus, error) {
+	status, err := h.loadSyncState(sourceAirtable)
+	status.Running = h.sync.isRunning()
+	return status, err
+}
+
+// HandleSync starts a sync in the background and returns the status bar,
+// which polls until the sync is done.
+func (h *Handlers) HandleSync() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		full := r.URL.Query().Get("full") == "1"
+		go func() {
+			if err := h.syncContacts(full); err != nil && !errors.Is(err, errSyncRunning) {
+				log.Printf("Manual sync failed: %v", err)
+			}
+		}()
+
+		// Give the sync a moment to mark itself as running
+		time.Sleep(50 * time.Millisecond)
+		h.renderSyncStatus(w, r)
+	}
+}
+
+// HandleSyncStatus returns the sync status bar. When a sync the page was
+// waiting for has finished, it also tells the contacts list to reload.
+func (h *Handlers) HandleSyncStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.renderSyncStatus(w, r)
+	}
+}
+
+func (h *Handlers) renderSyncStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := h.syncStatus()
+	if err != nil {
+		http.Error(w, "Failed to load sync status", http.StatusInternalServerError)
+		return
+	}
+	// A sync started by the page may already be done when the first
+	// response is rendered
+	waiting := r.Method == http.MethodPost || r.URL.Query().Get("waiting") == "1"
+	if waiting && !status.Running {
+		w.Header().Set("HX-Trigger", "contactsSynced")
+	}
+	components.SyncStatus(status).Render(r.Context(), w)
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"strings"
+	"time"
+)
+
+// countryTimezones maps country names and ISO codes to the timezone most of
+// the country's businesses work in. Countries spanning several zones list
+// their larger cities in cityTimezones.
+var countryTimezones = map[string]string{
+	"ar": "America/Argentina/Buenos_Aires", "argentina": "America/Argentina/Buenos_Aires",
+	"at": "Europe/Vienna", "austria": "Europe/Vienna", "österreich": "Europe/Vienna",
+	"au": "Australia/Sydney", "australia": "Australia/Sydney",
+	"ba": "Europe/Sarajevo", "bosnia and herzegovina": "Europe/Sarajevo",
+	"be": "Europe/Brussels", "belgium": "Europe/Brussels", "belgië": "Europe/Brussels", "belgique": "Europe/Brussels",
+	"bg": "Europe/Sofia", "bulgaria": "Europe/Sofia",
+	"br": "America/Sao_Paulo", "brazil": "America/Sao_Paulo", "brasil": "America/Sao_Paulo",
+	"by": "Europe/Minsk", "belarus": "Europe/Minsk",
+	"ca": "America/Toronto", "canada": "America/Toronto",
+	"ch": "Europe/Zurich", "switzerland": "Europe/Zurich", "schweiz": "Europe/Zurich", "suisse": "Europe/Zurich",
+	"cl": "America/Santiago", "chile": "America/Santiago",
+	"cn": "Asia/Shanghai", "china": "Asia/Shanghai",
+	"co": "America/Bogota", "colombia": "America/Bogota",
+	"cy": "Asia/Nicosia", "cyprus": "Asia/Nicosia",
+	"cz": "Europe/Prague", "czechia": "Europe/Prague", "czech republic": "Europe/Prague", "česko": "Europe/Prague",
+	"de": "Europe/Berlin", "germany": "Europe/Berlin", "deutschland": "Europe/Berlin", "niemcy": "Europe/Berlin",
+	"dk": "Europe/Copenhagen", "denmark": "Europe/Copenhagen", "danmark": "Europe/Copenhagen",
+	"ee": "Europe/Tallinn", "estonia": "Europe/Tallinn", "eesti": "Europe/Tallinn",
+	"eg": "Africa/Cairo", "egypt": "Africa/Cairo",
+	"es": "Europe/Madrid", "spain": "Europe/Madrid", "españa": "Europe/Madrid", "hiszpania": "Europe/Madrid",
+	"fi": "Europe/Helsinki", "finland": "Europe/Helsinki", "suomi": "Europe/Helsinki",
+	"fr": "Europe/Paris", "france": "Europe/Paris", "francja": "Europe/Paris",
+	"gb": "Europe/London", "uk": "Europe/London", "united kingdom": "Europe/London", "great britain": "Europe/London",
+	"england": "Europe/London", "scotland": "Europe/London", "wales": "Europe/London", "wielka brytania": "Europe/London",
+	"gr": "Europe/Athens", "greece": "Europe/Athens",
+	"hk": "Asia/Hong_Kong", "hong kong": "Asia/Hong_Kong",
+	"hr": "Europe/Zagreb", "croatia": "Europe/Zagreb", "hrvatska": "Europe/Zagreb",
+	"hu": "Europe/Budapest", "hungary": "Europe/Budapest", "magyarország": "Europe/Budapest",
+	"id": "Asia/Jakarta", "indonesia": "Asia/Jakarta",
+	"ie": "Europe/Dublin", "ireland": "Europe/Dublin",
+	"il": "Asia/Jerusalem", "israel": "Asia/Jerusalem",
+	"in": "Asia/Kolkata", "india": "Asia/Kolkata",
+	"is": "Atlantic/Reykjavik", "iceland": "Atlantic/Reykjavik",
+	"it": "Europe/Rome", "italy": "Europe/Rome", "italia": "Europe/Rome", "włochy": "Europe/Rome",
+	"jp": "Asia/Tokyo", "japan": "Asia/Tokyo",
+	"ke": "Africa/Nairobi", "kenya": "Africa/Nairobi",
+	"kr": "Asia/Seoul", "south korea": "Asia/Seoul", "korea": "Asia/Seoul",
+	"lt": "Europe/Vilnius", "lithuania": "Europe/Vilnius", "lietuva": "Europe/Vilnius", "litwa": "Europe/Vilnius",
+	"lu": "Europe/Luxembourg", "luxembourg": "Europe/Luxembourg",
+	"lv": "Europe/Riga", "latvia": "Europe/Riga", "latvija": "Europe/Riga", "łotwa": "Europe/Riga",
+	"ma": "Africa/Casablanca", "morocco": "Africa/Casablanca",
+	"md": "Europe/Chisinau", "moldova": "Europe/Chisinau",
+	"me": "Europe/Podgorica", "montenegro": "Europe/Podgorica",
+	"mk": "Europe/Skopje", "north macedonia": "Europe/Skopje",
+	"mt": "Europe/Malta", "malta": "Europe/Malta",
+	"mx": "America/Mexico_City", "mexico": "America/Mexico_City", "méxico": "America/Mexico_City",
+	"my": "Asia/Kuala_Lumpur", "malaysia": "Asia/Kuala_Lumpur",
+	"ng": "Africa/Lagos", "nigeria": "Africa/Lagos",
+	"nl": "Europe/Amsterdam", "netherlands": "Europe/Amsterdam", "the netherlands": "Europe/Amsterdam",
+	"nederland": "Europe/Amsterdam", "holland": "Europe/Amsterdam", "holandia": "Europe/Amsterdam",
+	"no": "Europe/Oslo", "norway": "Europe/Oslo", "norge": "Europe/Oslo", "norwegia": "Europe/Oslo",
+	"nz": "Pacific/Auckland", "new zealand": "Pacific/Auckland",
+	"pe": "America/Lima", "peru": "America/Lima",
+	"ph": "Asia/Manila", "philippines": "Asia/Manila",
+	"pl": "Europe/Warsaw", "poland": "Europe/Warsaw", "polska": "Europe/Warsaw",
+	"pt": "Europe/Lisbon", "portugal": "Europe/Lisbon",
+	"ro": "Europe/Bucharest", "romania": "Europe/Bucharest", "românia": "Europe/Bucharest", "rumunia": "Europe/Bucharest",
+	"rs": "Europe/Belgrade", "serbia": "Europe/Belgrade", "srbija": "Europe/Belgrade",
+	"ru": "Europe/Moscow", "russia": "Europe/Moscow", "rosja": "Europe/Moscow",
+	"sa": "Asia/Riyadh", "saudi arabia": "Asia/Riyadh",
+	"se": "Europe/Stockholm", "sweden": "Europe/Stockholm", "sverige": "Europe/Stockholm", "szwecja": "Europe/Stockholm",
+	"sg": "Asia/Singapore", "singapore": "Asia/Singapore",
+	"si": "Europe/Ljubljana", "slovenia": "Europe/Ljubljana", "slovenija": "Europe/Ljubljana",
+	"sk": "Europe/Bratislava", "slovakia": "Europe/Bratislava", "slovensko": "Europe/Bratislava", "słowacja": "Europe/Bratislava",
+	"th": "Asia/Bangkok", "thailand": "Asia/Bangkok",
+	"tr": "Europe/Istanbul", "turkey": "Europe/Istanbul", "türkiye": "Europe/Istanbul",
+	"tw": "Asia/Taipei", "taiwan": "Asia/Taipei",
+	"ua": "Europe/Kyiv", "ukraine": "Europe/Kyiv", "україна": "Europe/Kyiv", "ukraina": "Europe/Kyiv",
+	"ae": "Asia/Dubai", "uae": "Asia/Dubai", "united arab emirates": "Asia/Dubai",
+	"us": "America/New_York", "usa": "America/New_York", "united states": "America/New_York",
+	"united states of america": "America/New_York", "stany zjednoczone": "America/New_York",
+	"vn": "Asia/Ho_Chi_Minh", "vietnam": "Asia/Ho_Chi_Minh",
+	"za": "Africa/Johannesburg", "south africa": "Africa/Johannesburg",
+}
+
+// cityTimezones covers the larger cities of countries with several zones.
+// A city is only used when the country is missing or spans several zones.
+var cityTimezones = map[string]string{
+	// United States
+	"new york": "America/New_York", "boston": "America/New_York", "philadelphia": "America/New_York",
+	"washington": "America/New_York", "miami": "America/New_York", "atlanta": "America/New_York",
+	"detroit": "America/Detroit", "chicago": "America/Chicago", "houston": "America/Chicago",
+	"dallas": "America/Chicago", "austin": "America/Chicago", "minneapolis": "America/Chicago",
+	"denver": "America/Denver", "salt lake city": "America/Denver", "phoenix": "America/Phoenix",
+	"los angeles": "America/Los_Angeles", "san francisco": "America/Los_Angeles", "san diego": "America/Los_Angeles",
+	"san jose": "America/Los_Angeles", "seattle": "America/Los_Angeles", "portland": "America/Los_Angeles",
+	"las vegas": "America/Los_Angeles", "anchorage": "America/Anchorage", "honolulu": "Pacific/Honolulu",
+	// Canada
+	"toronto": "America/Toronto", "montreal": "America/Toronto", "montréal": "America/Toronto", "ottawa": "America/Toronto",
+	"vancouver": "America/Vancouver", "calgary": "America/Edmonton", "edmonton": "America/Edmonton",
+	"winnipeg": "America/Winnipeg", "halifax": "America/Halifax",
+	// Australia
+	"sydney": "Australia/Sydney", "melbourne": "Australia/Melbourne", "brisbane": "Australia/Brisbane",
+	"perth": "Australia/Perth", "adelaide": "Australia/Adelaide",
+	// Brazil, Mexico and Russia
+	"são paulo": "America/Sao_Paulo", "sao paulo": "America/Sao_Paulo", "rio de janeiro": "America/Sao_Paulo",
+	"manaus": "America/Manaus", "tijuana": "America/Tijuana", "cancún": "America/Cancun", "cancun": "America/Cancun",
+	"moscow": "Europe/Moscow", "saint petersburg": "Europe/Moscow", "yekaterinburg": "Asia/Yekaterinburg",
+	"novosibirsk": "Asia/Novosibirsk", "vladivostok": "Asia/Vladivostok",
+}
+
+// multiZoneCountries holds the main timezones of the countries spanning
+// several, for which the city decides when it is known.
+var multiZoneCountries = map[string]bool{
+	"America/New_York": true, "America/Toronto": true, "Australia/Sydney": true,
+	"America/Sao_Paulo": true, "America/Mexico_City": true, "Europe/Moscow": true,
+}
+
+// recipientTimezone derives a contact's timezone from their city and
+// country. It returns "" when neither is recognised.
+func recipientTimezone(city, country string) string {
+	zone := countryTimezones[normalizePlace(country)]
+	if zone != "" && !multiZoneCountries[zone] {
+		return zone
+	}
+	if cityZone := cityTimezones[normalizePlace(city)]; cityZone != "" {
+		return cityZone
+	}
+	return zone
+}
+
+func normalizePlace(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// recipientLocation loads the contact's timezone, falling back to the
+// configured default and then to the server's local time.
+func recipientLocation(city, country, fallback string) *time.Location {
+	for _, name := range []string{recipientTimezone(city, country), fallback} {
+		if name == "" {
+			continue
+		}
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
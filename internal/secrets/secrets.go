@@ -0,0 +1,331 @@
+// Package secrets encrypts configuration secrets at rest with AES-256-GCM.
+//
+// The master key is given directly (base64, usually OUTREACH_MASTER_KEY) or
+// read from a keyfile. Previous keys given alongside it or listed after the
+// first line of the keyfile are only used for decryption, which is what
+// makes rotation possible.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	prefix         = "enc:v1:"
+	keySize        = 32
+	DefaultKeyFile = "master.key"
+)
+
+var (
+	ErrUnknownKey   = errors.New("secret was encrypted with an unknown master key")
+	ErrEnvKey       = errors.New("master key is not stored in a key file; rotate it where it is configured")
+	ErrInvalidValue = errors.New("invalid encrypted value")
+)
+
+type key struct {
+	id   string
+	raw  []byte
+	aead cipher.AEAD
+}
+
+// Keyring holds the current master key and any previous ones. It is safe
+// for concurrent use.
+type Keyring struct {
+	mu       sync.RWMutex
+	current  key
+	previous []key
+	// file is the keyfile the keys were loaded from, empty for env keys
+	file string
+}
+
+// Load uses the given base64 master key and comma separated previous keys,
+// falling back to the keyfile when no key is given. A missing keyfile is
+// created with a fresh random key.
+func Load(encoded, previous, path string) (*Keyring, error) {
+	if encoded = strings.TrimSpace(encoded); encoded != "" {
+		keys := append([]string{encoded}, splitKeys(previous)...)
+		return newKeyring(keys, "")
+	}
+
+	if path == "" {
+		path = DefaultKeyFile
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		raw, err := generateKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeKeyFile(path, [][]byte{raw}); err != nil {
+			return nil, err
+		}
+		return newKeyringFromRaw([][]byte{raw}, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+
+	return newKeyring(splitKeys(string(data)), path)
+}
+
+func newKeyring(encoded []string, file string) (*Keyring, error) {
+	raws := make([][]byte, 0, len(encoded))
+	for _, e := range encoded {
+		raw, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key encoding: %w", err)
+		}
+		raws = append(raws, raw)
+	}
+	return newKeyringFromRaw(raws, file)
+}
+
+func newKeyringFromRaw(raws [][]byte, file string) (*Keyring, error) {
+	if len(raws) == 0 {
+		return nil, errors.New("no master key configured")
+	}
+
+	k := &Keyring{file: file}
+	for i, raw := range raws {
+		parsed, err := parseKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.current = parsed
+		} else {
+			k.previous = append(k.previous, parsed)
+		}
+	}
+	return k, nil
+}
+
+func parseKey(raw []byte) (key, error) {
+	if len(raw) != keySize {
+		return key{}, fmt.Errorf("master key must be %d bytes, got %d", keySize, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return key{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return key{}, err
+	}
+	sum := sha256.Sum256(raw)
+	return key{id: hex.EncodeToString(sum[:4]), raw: raw, aead: aead}, nil
+}
+
+// Encrypt seals a secret with the current key. Empty secrets stay empty.
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	nonce := make([]byte, k.current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.current.aead.Seal(nonce, nonce, []byte(plaintext), []byte(k.current.id))
+	return prefix + k.current.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt. Values without the prefix are
+// legacy plaintext and are returned unchanged.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	id, payload, ok := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	if !ok {
+		return "", ErrInvalidValue
+	}
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrInvalidValue
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, candidate := range k.keys() {
+		if candidate.id != id {
+			continue
+		}
+		size := candidate.aead.NonceSize()
+		if len(sealed) < size {
+			return "", ErrInvalidValue
+		}
+		plain, err := candidate.aead.Open(nil, sealed[:size], sealed[size:], []byte(id))
+		if err != nil {
+			return "", fmt.Errorf("error decrypting secret: %w", err)
+		}
+		return string(plain), nil
+	}
+	return "", ErrUnknownKey
+}
+
+// NeedsReencrypt reports whether a stored value is plaintext or sealed with
+// a key other than the current one.
+func (k *Keyring) NeedsReencrypt(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return !strings.HasPrefix(value, prefix+k.current.id+":")
+}
+
+// CurrentKeyID identifies the current key without revealing it.
+func (k *Keyring) CurrentKeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current.id
+}
+
+// BeginRotation generates a new current key and persists it to the keyfile
+// together with the old keys, so values sealed with either can be read if
+// the process stops half way. Call FinishRotation once every secret has been
+// re-encrypted.
+func (k *Keyring) BeginRotation() error {
+	if k.file == "" {
+		return ErrEnvKey
+	}
+
+	raw, err := generateKey()
+	if err != nil {
+		return err
+	}
+	next, err := parseKey(raw)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	raws := [][]byte{next.raw}
+	for _, old := range k.keys() {
+		raws = append(raws, old.raw)
+	}
+	if err := writeKeyFile(k.file, raws); err != nil {
+		return err
+	}
+
+	k.previous = k.keys()
+	k.current = next
+	return nil
+}
+
+// FinishRotation drops the previous keys from the keyfile.
+func (k *Keyring) FinishRotation() error {
+	if k.file == "" {
+		return ErrEnvKey
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := writeKeyFile(k.file, [][]byte{k.current.raw}); err != nil {
+		return err
+	}
+	k.previous = nil
+	return nil
+}
+
+// keys returns the current key first; callers must hold the lock.
+func (k *Keyring) keys() []key {
+	return append([]key{k.current}, k.previous...)
+}
+
+// IsEncrypted reports whether a value was produced by Encrypt.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Mask hides a secret for display, keeping only the last four characters of
+// long values so users can tell keys apart.
+func Mask(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	n := utf8.RuneCountInString(secret)
+	if n <= 8 {
+		return strings.Repeat("•", 8)
+	}
+	runes := []rune(secret)
+	return strings.Repeat("•", 8) + string(runes[n-4:])
+}
+
+// IsMasked reports whether a submitted value is a mask echoed back by a form
+// rather than a new secret.
+func IsMasked(value string) bool {
+	return strings.HasPrefix(value, "••••")
+}
+
+func generateKey() ([]byte, error) {
+	raw := make([]byte, keySize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("error generating master key: %w", err)
+	}
+	return raw, nil
+}
+
+// writeKeyFile replaces the keyfile atomically, one base64 key per line with
+// the current key first.
+func writeKeyFile(path string, raws [][]byte) error {
+	lines := make([]string, len(raws))
+	for i, raw := range raws {
+		lines[i] = base64.StdEncoding.EncodeToString(raw)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".master-key-*")
+	if err != nil {
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		tmp.Close()
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	return nil
+}
+
+func splitKeys(s string) []string {
+	var keys []string
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 
 	"outreach-generator/internal/handlers"
+	"outreach-generator/internal/secrets"
+	"outreach-generator/internal/settings"
 )
 
 type Server struct {
@@ -15,8 +17,8 @@ type Server struct {
 	handlers *handlers.Handlers
 }
 
-func New(db *sql.DB) *Server {
-	h := handlers.New(db)
+func New(db *sql.DB, keys *secrets.Keyring, layers *settings.Layers) *Server {
+	h := handlers.New(db, keys, layers)
 	return &Server{
 		db:       db,
 		handlers: h,
@@ -37,14 +39,74 @@ func (s *Server) Routes() http.Handler {
 	// Pages
 	r.Get("/", s.handlers.HandleHome())
 	r.Get("/config", s.handlers.HandleConfig())
+	r.Get("/import", s.handlers.HandleImportPage())
+	r.Get("/sequences", s.handlers.HandleSequencesPage())
+	r.Get("/profiles", s.handlers.HandleProfilesPage())
+	r.Get("/campaigns", s.handlers.HandleCampaignsPage())
+	r.Get("/campaigns/{id}", s.handlers.HandleCampaignPage())
 
 	// API routes
 	r.Route("/api", func(r chi.Router) {
 		r.Get("/companies", s.handlers.HandleGetCompanies())
+		r.Get("/outreach-settings", s.handlers.HandleOutreachSettings())
+		r.Post("/set-language", s.handlers.HandleSetLanguage())
+		r.Post("/set-prompt", s.handlers.HandleSetPrompt())
 		r.Post("/generate-outreach", s.handlers.HandleGenerateOutreach())
 		r.Post("/generate-all", s.handlers.HandleGenerateAll())
+		r.Post("/check-websites", s.handlers.HandleCheckWebsites())
+		r.Get("/export", s.handlers.HandleExport())
+		r.Post("/contacts/{id}/approve", s.handlers.HandleApproveOutreach())
+		r.Post("/contacts/{id}/send", s.handlers.HandleSendOutreach())
+		r.Get("/contacts/{id}/eml", s.handlers.HandleDownloadDraft())
+		r.Get("/contacts/{id}/preview", s.handlers.HandlePreviewEmail())
+		r.Delete("/contacts/{id}/queue", s.handlers.HandleUnqueueContact())
+		r.Post("/send-queue", s.handlers.HandleQueueApproved())
+		r.Get("/send-queue/status", s.handlers.HandleSendQueueStatus())
+		r.Post("/send-queue/pause", s.handlers.HandlePauseSending())
+		r.Post("/send-queue/resume", s.handlers.HandleResumeSending())
+		r.Get("/sequences", s.handlers.HandleListSequences())
+		r.Post("/sequences", s.handlers.HandleSaveSequence())
+		r.Get("/sequences/{id}", s.handlers.HandleEditSequence())
+		r.Delete("/sequences/{id}", s.handlers.HandleDeleteSequence())
+		r.Post("/enroll", s.handlers.HandleEnrollContacts())
+		r.Post("/contacts/{id}/sequence/stop", s.handlers.HandleStopSequence())
+		r.Get("/profiles", s.handlers.HandleListProfiles())
+		r.Post("/profiles", s.handlers.HandleSaveProfile())
+		r.Get("/profiles/{id}", s.handlers.HandleEditProfile())
+		r.Delete("/profiles/{id}", s.handlers.HandleDeleteProfile())
+		r.Get("/campaigns", s.handlers.HandleListCampaigns())
+		r.Post("/campaigns", s.handlers.HandleSaveCampaign())
+		r.Delete("/campaigns/{id}", s.handlers.HandleDeleteCampaign())
+		r.Get("/campaigns/{id}/edit", s.handlers.HandleEditCampaign())
+		r.Get("/campaigns/{id}/summary", s.handlers.HandleCampaignSummary())
+		r.Post("/campaigns/{id}/contacts", s.handlers.HandleAddCampaignContacts())
+		r.Post("/campaigns/{id}/pause", s.handlers.HandlePauseCampaign())
+		r.Post("/campaigns/{id}/resume", s.handlers.HandleResumeCampaign())
+		r.Get("/knowledge", s.handlers.HandleListKnowledge())
+		r.Post("/knowledge", s.handlers.HandleSaveKnowledge())
+		r.Get("/knowledge/{id}", s.handlers.HandleEditKnowledge())
+		r.Delete("/knowledge/{id}", s.handlers.HandleDeleteKnowledge())
+		r.Post("/sync", s.handlers.HandleSync())
+		r.Get("/sync/status", s.handlers.HandleSyncStatus())
+		r.Post("/inbox/check", s.handlers.HandleCheckInbox())
+		r.Get("/inbox/status", s.handlers.HandleInboxStatus())
+		r.Get("/imports", s.handlers.HandleListImports())
+		r.Post("/imports", s.handlers.HandleUploadImport())
+		r.Get("/imports/{id}", s.handlers.HandleImport())
+		r.Post("/imports/{id}", s.handlers.HandleApplyImport())
+		r.Delete("/imports/{id}", s.handlers.HandleDeleteImport())
+		r.Get("/imports/{id}/export", s.handlers.HandleExportImport())
 		r.Get("/config", s.handlers.HandleGetConfig())
 		r.Post("/config", s.handlers.HandleSaveConfig())
+		r.Post("/config/rotate-key", s.handlers.HandleRotateKey())
+		r.Post("/config/test/anthropic", s.handlers.HandleTestAnthropic())
+		r.Post("/config/test/airtable", s.handlers.HandleTestAirtable())
+		r.Post("/config/test/smtp", s.handlers.HandleTestSMTP())
+		r.Post("/config/test/imap", s.handlers.HandleTestIMAP())
+		r.Get("/airtable/bases", s.handlers.HandleListBases())
+		r.Get("/airtable/tables", s.handlers.HandleListTables())
+		r.Get("/airtable/output-fields", s.handlers.HandleOutputFields())
+		r.Post("/airtable/output-fields", s.handlers.HandleCreateOutputFields())
 	})
 
 	return r
@@ -0,0 +1,241 @@
+// Package settings resolves configuration from layered sources: built-in
+// defaults, then a YAML or TOML config file, then environment variables,
+// then overrides saved in the database from the /config page.
+package settings
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type Source string
+
+const (
+	SourceDefault  Source = "default"
+	SourceFile     Source = "file"
+	SourceEnv      Source = "env"
+	SourceDatabase Source = "database"
+)
+
+// DefaultFiles are tried in order when no config file is given explicitly.
+var DefaultFiles = []string{"config.yaml", "config.yml", "config.toml"}
+
+// Setting describes one configuration key. Runtime settings are read at
+// startup only and can never be overridden from the database.
+type Setting struct {
+	Key     string
+	Label   string
+	Env     string
+	Default string
+	Secret  bool
+	Runtime bool
+}
+
+// All lists every known setting in display order.
+var All = []Setting{
+	{Key: "anthropic_api_key", Label: "Anthropic API Key", Env: "ANTHROPIC_API_KEY", Secret: true},
+	{Key: "anthropic_model", Label: "Model", Env: "ANTHROPIC_MODEL", Default: "claude-3-sonnet-20240229"},
+	{Key: "max_tokens", Label: "Max Tokens", Env: "MAX_TOKENS", Default: "1000"},
+	{Key: "airtable_access_token", Label: "Airtable Access Token", Env: "AIRTABLE_ACCESS_TOKEN", Secret: true},
+	{Key: "airtable_base_id", Label: "Airtable Base ID", Env: "AIRTABLE_BASE_ID"},
+	{Key: "airtable_table_name", Label: "Airtable Table Name", Env: "AIRTABLE_TABLE_NAME"},
+	{Key: "airtable_language_field", Label: "Language Field", Env: "AIRTABLE_LANGUAGE_FIELD", Default: "language"},
+	{Key: "default_language", Label: "Default Language", Env: "DEFAULT_LANGUAGE", Default: "en"},
+	{Key: "outreach_prompt", Label: "Prompt Template", Env: "OUTREACH_PROMPT"},
+	{Key: "crawl_contact", Label: "Crawler Contact", Env: "CRAWL_CONTACT"},
+	{Key: "crawl_delay_ms", Label: "Crawl Delay (ms)", Env: "CRAWL_DELAY_MS", Default: "2000"},
+	{Key: "crawl_concurrency", Label: "Crawl Concurrency per Host", Env: "CRAWL_CONCURRENCY", Default: "1"},
+	{Key: "fallback_mode", Label: "Fallback Mode", Env: "FALLBACK_MODE", Default: "off"},
+	{Key: "sync_interval_minutes", Label: "Sync Interval (minutes)", Env: "SYNC_INTERVAL_MINUTES", Default: "15"},
+	{Key: "export_columns", Label: "Export Columns", Env: "EXPORT_COLUMNS", Default: "company_name,fullname,email,website,subject,body,status,model,generated_at,created_time"},
+	{Key: "smtp_host", Label: "SMTP Host", Env: "SMTP_HOST"},
+	{Key: "smtp_port", Label: "SMTP Port", Env: "SMTP_PORT", Default: "587"},
+	{Key: "smtp_security", Label: "SMTP Security", Env: "SMTP_SECURITY", Default: "starttls"},
+	{Key: "smtp_username", Label: "SMTP Username", Env: "SMTP_USERNAME"},
+	{Key: "smtp_password", Label: "SMTP Password", Env: "SMTP_PASSWORD", Secret: true},
+	{Key: "smtp_from", Label: "From Address", Env: "SMTP_FROM"},
+	{Key: "email_format", Label: "Email Format", Env: "EMAIL_FORMAT", Default: "html"},
+	{Key: "email_signature", Label: "Signature", Env: "EMAIL_SIGNATURE"},
+	{Key: "send_daily_cap", Label: "Daily Cap per Mailbox", Env: "SEND_DAILY_CAP", Default: "50"},
+	{Key: "send_min_gap_seconds", Label: "Minimum Gap (seconds)", Env: "SEND_MIN_GAP_SECONDS", Default: "120"},
+	{Key: "send_max_gap_seconds", Label: "Maximum Gap (seconds)", Env: "SEND_MAX_GAP_SECONDS", Default: "480"},
+	{Key: "send_hours", Label: "Business Hours", Env: "SEND_HOURS", Default: "09:00-17:00"},
+	{Key: "send_days", Label: "Business Days", Env: "SEND_DAYS", Default: "mon,tue,wed,thu,fri"},
+	{Key: "send_default_timezone", Label: "Default Recipient Timezone", Env: "SEND_DEFAULT_TIMEZONE"},
+	{Key: "imap_host", Label: "IMAP Host", Env: "IMAP_HOST"},
+	{Key: "imap_port", Label: "IMAP Port", Env: "IMAP_PORT", Default: "993"},
+	{Key: "imap_security", Label: "IMAP Security", Env: "IMAP_SECURITY", Default: "tls"},
+	{Key: "imap_username", Label: "IMAP Username", Env: "IMAP_USERNAME"},
+	{Key: "imap_password", Label: "IMAP Password", Env: "IMAP_PASSWORD", Secret: true},
+	{Key: "imap_mailbox", Label: "Mailbox", Env: "IMAP_MAILBOX", Default: "INBOX"},
+	{Key: "imap_poll_minutes", Label: "Check Interval (minutes)", Env: "IMAP_POLL_MINUTES", Default: "5"},
+	{Key: "airtable_body_field", Label: "Body Field", Env: "AIRTABLE_BODY_FIELD", Default: "outreach_text"},
+	{Key: "airtable_subject_field", Label: "Subject Field", Env: "AIRTABLE_SUBJECT_FIELD", Default: "outreach_subject"},
+	{Key: "airtable_status_field", Label: "Status Field", Env: "AIRTABLE_STATUS_FIELD", Default: "outreach_status"},
+	{Key: "airtable_generated_at_field", Label: "Generated At Field", Env: "AIRTABLE_GENERATED_AT_FIELD", Default: "outreach_generated_at"},
+	{Key: "airtable_model_field", Label: "Model Field", Env: "AIRTABLE_MODEL_FIELD", Default: "outreach_model"},
+	{Key: "airtable_template_field", Label: "Template Field", Env: "AIRTABLE_TEMPLATE_FIELD", Default: "outreach_template"},
+	{Key: "airtable_error_field", Label: "Error Field", Env: "AIRTABLE_ERROR_FIELD", Default: "outreach_error"},
+	{Key: "airtable_metadata", Label: "Metadata Written to Airtable", Env: "AIRTABLE_METADATA", Default: "subject,status,generated_at,model,template,error"},
+
+	{Key: "listen_addr", Label: "Listen Address", Env: "LISTEN_ADDR", Default: ":8080", Runtime: true},
+	{Key: "db_path", Label: "Database Path", Env: "DB_PATH", Default: "local.db", Runtime: true},
+	{Key: "master_key_file", Label: "Master Key File", Env: "OUTREACH_MASTER_KEY_FILE", Default: "master.key", Runtime: true},
+	{Key: "master_key", Label: "Master Key", Env: "OUTREACH_MASTER_KEY", Secret: true, Runtime: true},
+	{Key: "master_key_previous", Label: "Previous Master Keys", Env: "OUTREACH_MASTER_KEY_PREVIOUS", Secret: true, Runtime: true},
+	{Key: "fetch_allowlist", Label: "Fetch Allowlist", Env: "FETCH_ALLOWLIST", Runtime: true},
+	{Key: "fetch_allowed_ports", Label: "Fetch Allowed Ports", Env: "FETCH_ALLOWED_PORTS", Runtime: true},
+}
+
+// Lookup returns the setting with the given key.
+func Lookup(key string) (Setting, bool) {
+	for _, s := range All {
+		if s.Key == key {
+			return s, true
+		}
+	}
+	return Setting{}, false
+}
+
+// Value is the effective value of a setting and where it came from. Origin
+// names the file or environment variable for display.
+type Value struct {
+	Setting
+	Value  string
+	Source Source
+	Origin string
+}
+
+// Layers holds the values resolved from defaults, the config file and the
+// environment. Database overrides are applied on top with Merge.
+type Layers struct {
+	File   string
+	values map[string]Value
+}
+
+// Load resolves defaults, the config file and the environment. An empty path
+// falls back to the first of DefaultFiles that exists.
+func Load(path string) (*Layers, error) {
+	l := &Layers{values: map[string]Value{}}
+	for _, s := range All {
+		l.values[s.Key] = Value{Setting: s, Value: s.Default, Source: SourceDefault}
+	}
+
+	if path == "" {
+		for _, candidate := range DefaultFiles {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+	}
+
+	if path != "" {
+		fileValues, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fileValues {
+			s, ok := Lookup(key)
+			if !ok {
+				return nil, fmt.Errorf("unknown setting %q in %s", key, path)
+			}
+			l.values[key] = Value{Setting: s, Value: value, Source: SourceFile, Origin: path}
+		}
+		l.File = path
+	}
+
+	for _, s := range All {
+		if value, ok := os.LookupEnv(s.Env); ok && value != "" {
+			l.values[s.Key] = Value{Setting: s, Value: value, Source: SourceEnv, Origin: s.Env}
+		}
+	}
+
+	// PORT predates LISTEN_ADDR and is still honoured when it is the only one set
+	if v := l.values["listen_addr"]; v.Source != SourceEnv {
+		if port := os.Getenv("PORT"); port != "" {
+			l.values["listen_addr"] = Value{Setting: v.Setting, Value: ":" + port, Source: SourceEnv, Origin: "PORT"}
+		}
+	}
+
+	return l, nil
+}
+
+// Get returns the resolved value of a setting without database overrides.
+func (l *Layers) Get(key string) string {
+	return l.values[key].Value
+}
+
+// Merge applies database overrides on top of the layers. Empty overrides and
+// overrides of runtime settings are ignored.
+func (l *Layers) Merge(overrides map[string]string) map[string]Value {
+	merged := make(map[string]Value, len(l.values))
+	for key, v := range l.values {
+		merged[key] = v
+	}
+	for key, value := range overrides {
+		v, ok := merged[key]
+		if !ok || v.Runtime || value == "" {
+			continue
+		}
+		merged[key] = Value{Setting: v.Setting, Value: value, Source: SourceDatabase}
+	}
+	return merged
+}
+
+// Values returns the merged values in display order.
+func Values(merged map[string]Value) []Value {
+	values := make([]Value, 0, len(merged))
+	for _, s := range All {
+		if v, ok := merged[s.Key]; ok {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// readFile parses a flat YAML or TOML file into string values. Lists are
+// joined with commas so they read like the environment variables.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file format: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case nil:
+			continue
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("setting %q in %s must be a plain value", key, path)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
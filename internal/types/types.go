@@ -1,21 +1,134 @@
 package types
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"outreach-generator/internal/secrets"
+)
 
 var ErrMissingConfig = errors.New("missing required configuration")
 
 type Config struct {
 	AnthropicAPIKey     string `json:"anthropic_api_key"`
+	AnthropicModel      string `json:"anthropic_model"`
+	MaxTokens           int    `json:"max_tokens"`
 	AirtableAccessToken string `json:"airtable_access_token"`
 	AirtableBaseID      string `json:"airtable_base_id"`
 	AirtableTableName   string `json:"airtable_table_name"`
 	DefaultLanguage     string `json:"default_language"`
+	OutreachPrompt      string `json:"outreach_prompt"`
+	CrawlContact        string `json:"crawl_contact"`
+	CrawlDelayMs        int    `json:"crawl_delay_ms"`
+	CrawlConcurrency    int    `json:"crawl_concurrency"`
+	FallbackMode        string `json:"fallback_mode"`
+	// Airtable fields the generated outreach is written to
+	AirtableBodyField        string `json:"airtable_body_field"`
+	AirtableSubjectField     string `json:"airtable_subject_field"`
+	AirtableStatusField      string `json:"airtable_status_field"`
+	AirtableGeneratedAtField string `json:"airtable_generated_at_field"`
+	AirtableModelField       string `json:"airtable_model_field"`
+	AirtableTemplateField    string `json:"airtable_template_field"`
+	AirtableErrorField       string `json:"airtable_error_field"`
+	// AirtableMetadata lists the metadata written next to the body, comma
+	// separated: subject, status, generated_at, model, template, error
+	AirtableMetadata string `json:"airtable_metadata"`
+	// AirtableLanguageField is the field with a contact's language, read to
+	// choose the language of their outreach
+	AirtableLanguageField string `json:"airtable_language_field"`
+	// SyncIntervalMinutes is how often the contacts mirror is refreshed, 0
+	// for manual syncs only
+	SyncIntervalMinutes int `json:"sync_interval_minutes"`
+	// ExportColumns lists the columns of contact exports, comma separated
+	ExportColumns string `json:"export_columns"`
+	// SMTP server approved outreach is sent through
+	SMTPHost string `json:"smtp_host"`
+	SMTPPort int    `json:"smtp_port"`
+	// SMTPSecurity is starttls, tls (implicit TLS) or none
+	SMTPSecurity string `json:"smtp_security"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+	// SMTPFrom is the sender, an address or "Name <address>"
+	SMTPFrom string `json:"smtp_from"`
+	// EmailFormat is html (HTML with a plain text alternative) or text
+	EmailFormat string `json:"email_format"`
+	// EmailSignature is plain text appended to every message
+	EmailSignature string `json:"email_signature"`
+	// Send schedule: at most SendDailyCap emails per mailbox and day, spaced
+	// by a random gap between the minimum and maximum, within SendHours
+	// (e.g. 09:00-17:00) on SendDays in the recipient's timezone
+	SendDailyCap      int    `json:"send_daily_cap"`
+	SendMinGapSeconds int    `json:"send_min_gap_seconds"`
+	SendMaxGapSeconds int    `json:"send_max_gap_seconds"`
+	SendHours         string `json:"send_hours"`
+	SendDays          string `json:"send_days"`
+	// SendDefaultTimezone is used for recipients whose timezone cannot be
+	// derived from their country and city; empty means the server's
+	SendDefaultTimezone string `json:"send_default_timezone"`
+	// IMAP mailbox checked for replies and bounces every IMAPPollMinutes;
+	// zero turns the checks off
+	IMAPHost string `json:"imap_host"`
+	IMAPPort int    `json:"imap_port"`
+	// IMAPSecurity is tls (implicit TLS), starttls or none
+	IMAPSecurity    string `json:"imap_security"`
+	IMAPUsername    string `json:"imap_username"`
+	IMAPPassword    string `json:"imap_password"`
+	IMAPMailbox     string `json:"imap_mailbox"`
+	IMAPPollMinutes int    `json:"imap_poll_minutes"`
+}
+
+// Masked returns a copy with every secret replaced by its mask, safe to show
+// in the UI and the JSON API.
+func (c Config) Masked() Config {
+	c.AnthropicAPIKey = secrets.Mask(c.AnthropicAPIKey)
+	c.AirtableAccessToken = secrets.Mask(c.AirtableAccessToken)
+	c.SMTPPassword = secrets.Mask(c.SMTPPassword)
+	c.IMAPPassword = secrets.Mask(c.IMAPPassword)
+	return c
+}
+
+// String redacts secrets so a Config can be logged with %v or %+v.
+func (c Config) String() string {
+	type plain Config
+	return fmt.Sprintf("%+v", plain(c.Masked()))
+}
+
+// GoString redacts secrets for %#v as well.
+func (c Config) GoString() string {
+	return c.String()
+}
+
+// Fallback modes control what happens when a contact's website is unusable.
+const (
+	FallbackOff         = "off"
+	FallbackCached      = "cached"
+	FallbackContactData = "contact_data"
+)
+
+// AirtableBase is a base the access token can see.
+type AirtableBase struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	PermissionLevel string `json:"permissionLevel"`
 }
 
 type TableSchema struct {
+	ID     string          `json:"id"`
+	Name   string          `json:"name"`
 	Fields []AirtableField `json:"fields"`
 }
 
+// Field returns the field with the given name, if the table has one.
+func (s *TableSchema) Field(name string) (AirtableField, bool) {
+	for _, f := range s.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return AirtableField{}, false
+}
+
 type AirtableField struct {
 	ID          string `json:"id"`
 	Name        string `json:"name"`
@@ -23,6 +136,73 @@ type AirtableField struct {
 	Description string `json:"description"`
 }
 
+// ConnectionCheck is the outcome of one step of a connection test.
+type ConnectionCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+const (
+	CheckPass = "pass"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// Outreach statuses, offered as the choices of the Airtable status field.
+const (
+	OutreachGenerated = "generated"
+	OutreachApproved  = "approved"
+	OutreachSent      = "sent"
+	OutreachReplied   = "replied"
+	OutreachBounced   = "bounced"
+	OutreachError     = "error"
+)
+
+var OutreachStatuses = []string{
+	OutreachGenerated,
+	OutreachApproved,
+	OutreachSent,
+	OutreachReplied,
+	OutreachBounced,
+	OutreachError,
+}
+
+// Metadata written to Airtable next to the outreach body.
+const (
+	MetadataSubject     = "subject"
+	MetadataStatus      = "status"
+	MetadataGeneratedAt = "generated_at"
+	MetadataModel       = "model"
+	MetadataTemplate    = "template"
+	MetadataError       = "error"
+)
+
+// OutreachUpdate is what gets written back to an Airtable record. Empty
+// fields are left untouched, except Error, which is cleared whenever Status
+// is set.
+type OutreachUpdate struct {
+	RecordID    string
+	Body        string
+	Subject     string
+	Status      string
+	GeneratedAt time.Time
+	Model       string
+	Template    string
+	Error       string
+}
+
+// OutputField describes one Airtable output field and whether the table has
+// it with a usable type.
+type OutputField struct {
+	Label      string `json:"label"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	ActualType string `json:"actual_type,omitempty"`
+	Exists     bool   `json:"exists"`
+	Compatible bool   `json:"compatible"`
+}
+
 type Contact struct {
 	ID              string `json:"id"`
 	Fullname        string `json:"fullname"`
@@ -33,8 +213,350 @@ type Contact struct {
 	City            string `json:"city"`
 	Country         string `json:"country"`
 	Email           string `json:"email"`
+	Language        string `json:"language,omitempty"`
 	OutreachText    string `json:"outreach_text"`
-	Error           string `json:"error,omitempty"`
+	OutreachStatus  string `json:"outreach_status,omitempty"`
+	OutreachModel   string `json:"outreach_model,omitempty"`
+	// GeneratedAt is when the outreach was generated, in RFC 3339
+	GeneratedAt   string `json:"generated_at,omitempty"`
+	Error         string `json:"error,omitempty"`
+	ErrorKind     string `json:"error_kind,omitempty"`
+	WebsiteStatus string `json:"website_status,omitempty"`
+	WebsiteDetail string `json:"website_detail,omitempty"`
+	// LowConfidence marks outreach generated without the live website.
+	LowConfidence     bool   `json:"low_confidence,omitempty"`
+	FallbackSource    string `json:"fallback_source,omitempty"`
+	FallbackAvailable bool   `json:"fallback_available,omitempty"`
+	CreatedTime       string `json:"created_time,omitempty"`
+	Source            string `json:"source,omitempty"`
+	// LastSend is the latest attempt to email the outreach
+	LastSend *SendResult `json:"last_send,omitempty"`
+	// Queued is set while the outreach waits in the send queue
+	Queued bool `json:"queued,omitempty"`
+	// Timezone is derived from the country and city, empty if unknown
+	Timezone string `json:"timezone,omitempty"`
+	// Sequence is the follow-up sequence the contact is enrolled in
+	Sequence *SequenceProgress `json:"sequence,omitempty"`
+	// LastInbound is the latest reply, auto-reply or bounce received
+	LastInbound *InboundMessage `json:"last_inbound,omitempty"`
+	// OutreachLanguage is the language the outreach was written in, and
+	// LanguageReason which rule chose it
+	OutreachLanguage string `json:"outreach_language,omitempty"`
+	LanguageReason   string `json:"language_reason,omitempty"`
+}
+
+// ContactSourceInfo names a source on the home page.
+type ContactSourceInfo struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+}
+
+// Import formats
+const (
+	ImportCSV  = "csv"
+	ImportXLSX = "xlsx"
+)
+
+// Import statuses: an upload waits for its column mapping before any
+// contact is created
+const (
+	ImportPending  = "pending"
+	ImportImported = "imported"
+)
+
+// De-duplication modes for imports
+const (
+	DedupeEmail  = "email"
+	DedupeDomain = "domain"
+	DedupeNone   = "none"
+)
+
+// Import is a contact list uploaded as a CSV or XLSX file. The original rows
+// are kept so outreach can be exported back in the same layout.
+type Import struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Format    string   `json:"format"`
+	Delimiter string   `json:"delimiter,omitempty"`
+	Sheet     string   `json:"sheet,omitempty"`
+	Header    []string `json:"header"`
+	// Mapping maps contact fields to column indexes in Header
+	Mapping   map[string]int `json:"mapping"`
+	Dedupe    string         `json:"dedupe"`
+	Status    string         `json:"status"`
+	Rows      int            `json:"rows"`
+	Imported  int            `json:"imported"`
+	Skipped   int            `json:"skipped"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// ImportField is a contact field a file column can be mapped to.
+type ImportField struct {
+	Key   string
+	Label string
+}
+
+// ImportFields lists the mappable contact fields in form order.
+var ImportFields = []ImportField{
+	{Key: "fullname", Label: "Full Name"},
+	{Key: "company_name", Label: "Company Name"},
+	{Key: "business_segment", Label: "Business Segment"},
+	{Key: "website", Label: "Website"},
+	{Key: "email", Label: "Email"},
+	{Key: "phone", Label: "Phone"},
+	{Key: "city", Label: "City"},
+	{Key: "country", Label: "Country"},
+	{Key: "language", Label: "Language"},
+}
+
+// ImportRowError explains why a row of an import was not imported.
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// SyncStatus describes the local mirror of a contact source.
+type SyncStatus struct {
+	Source         string    `json:"source"`
+	Running        bool      `json:"running"`
+	LastSyncAt     time.Time `json:"last_sync_at"`
+	LastFullSyncAt time.Time `json:"last_full_sync_at"`
+	Records        int       `json:"records"`
+	Changed        int       `json:"changed"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Connection security modes of the SMTP and IMAP servers
+const (
+	SMTPStartTLS = "starttls"
+	SMTPTLS      = "tls"
+	SMTPNone     = "none"
+)
+
+// Formats outgoing email is sent in
+const (
+	EmailHTML = "html"
+	EmailText = "text"
+)
+
+// EmailPreview is a contact's email exactly as it would be sent.
+type EmailPreview struct {
+	ContactID string `json:"contact_id"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Text      string `json:"text"`
+	HTML      string `json:"html,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SendResult records one attempt to send a contact's outreach by email.
+type SendResult struct {
+	ContactID string `json:"contact_id"`
+	// Step is the position in the contact's sequence, 0 for the initial
+	// outreach
+	Step int `json:"step"`
+	// From is the mailbox the message was sent from
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	// Response is the server's reply to the end of the message data
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// SendQueueStatus describes the send queue of a mailbox.
+type SendQueueStatus struct {
+	Mailbox    string    `json:"mailbox"`
+	Paused     bool      `json:"paused"`
+	Queued     int       `json:"queued"`
+	SentToday  int       `json:"sent_today"`
+	DailyCap   int       `json:"daily_cap"`
+	NextSendAt time.Time `json:"next_send_at"`
+	// Waiting explains why nothing is being sent right now
+	Waiting string `json:"waiting,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Sequence is a series of follow-ups sent after the initial outreach.
+type Sequence struct {
+	ID        int64          `json:"id"`
+	Name      string         `json:"name"`
+	Steps     []SequenceStep `json:"steps"`
+	CreatedAt time.Time      `json:"created_at"`
+	// Enrolled counts the contacts going through the sequence
+	Enrolled int `json:"enrolled"`
+}
+
+// SequenceStep is one follow-up, sent DelayDays after the previous message
+// and generated from its own prompt template.
+type SequenceStep struct {
+	DelayDays int    `json:"delay_days"`
+	Prompt    string `json:"prompt"`
+}
+
+// Enrollment statuses
+const (
+	SequenceActive    = "active"
+	SequenceCompleted = "completed"
+	SequenceStopped   = "stopped"
+)
+
+// SequenceProgress is where a contact stands in their sequence.
+type SequenceProgress struct {
+	SequenceID int64  `json:"sequence_id"`
+	Name       string `json:"name"`
+	// Sent counts the follow-ups sent so far, out of Steps
+	Sent       int       `json:"sent"`
+	Steps      int       `json:"steps"`
+	Status     string    `json:"status"`
+	StopReason string    `json:"stop_reason,omitempty"`
+	NextDueAt  time.Time `json:"next_due_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Kinds of incoming messages matched to sent outreach
+const (
+	InboundReply     = "reply"
+	InboundAutoReply = "auto_reply"
+	InboundBounce    = "bounce"
+)
+
+// InboundMessage is an incoming message matched to a contact's outreach.
+type InboundMessage struct {
+	ContactID  string    `json:"contact_id"`
+	Kind       string    `json:"kind"`
+	From       string    `json:"from"`
+	Subject    string    `json:"subject"`
+	MessageID  string    `json:"message_id,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+	// Detail is the bounce's status and diagnostic, or how the message was
+	// matched
+	Detail string `json:"detail,omitempty"`
+}
+
+// InboxStatus describes the checks of the IMAP mailbox.
+type InboxStatus struct {
+	Mailbox     string    `json:"mailbox"`
+	Running     bool      `json:"running"`
+	CheckedAt   time.Time `json:"checked_at"`
+	Replies     int       `json:"replies"`
+	AutoReplies int       `json:"auto_replies"`
+	Bounces     int       `json:"bounces"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// SenderProfile is who outreach is written on behalf of. The default
+// profile is used when no other is selected.
+type SenderProfile struct {
+	ID               int64     `json:"id"`
+	Name             string    `json:"name"`
+	Role             string    `json:"role"`
+	Company          string    `json:"company"`
+	ValueProposition string    `json:"value_proposition"`
+	CaseStudies      string    `json:"case_studies"`
+	ProofPoints      string    `json:"proof_points"`
+	CalendarLink     string    `json:"calendar_link"`
+	Default          bool      `json:"default"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// KnowledgeEntry is one service or fact of the company knowledge base,
+// given to the model with every prompt.
+type KnowledgeEntry struct {
+	ID        int64     `json:"id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Campaign bundles a list of contacts copied from a source with how their
+// outreach is written and sent. Empty settings fall back to the
+// configuration.
+type Campaign struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// Key is the source key of the campaign's own contact list
+	Key string `json:"key"`
+	// Source is the contact source the campaign's contacts come from, and
+	// View the comma separated terms a contact's segment, city or country
+	// must contain one of to be added; empty adds every contact
+	Source    string `json:"source"`
+	View      string `json:"view"`
+	Prompt    string `json:"prompt"`
+	ProfileID int64  `json:"profile_id,omitempty"`
+	Language  string `json:"language,omitempty"`
+	Model     string `json:"model,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+	SendHours string `json:"send_hours,omitempty"`
+	SendDays  string `json:"send_days,omitempty"`
+	// Paused campaigns keep their queued messages but send none
+	Paused    bool           `json:"paused"`
+	CreatedAt time.Time      `json:"created_at"`
+	Counts    CampaignCounts `json:"counts"`
+}
+
+// CampaignCounts counts a campaign's contacts by outreach status.
+type CampaignCounts struct {
+	Contacts  int `json:"contacts"`
+	Generated int `json:"generated"`
+	Approved  int `json:"approved"`
+	Queued    int `json:"queued"`
+	Sent      int `json:"sent"`
+	Replied   int `json:"replied"`
+	Bounced   int `json:"bounced"`
+	Errors    int `json:"errors"`
+}
+
+// Rules that choose the language of a contact's outreach, in order.
+const (
+	LanguageFromField   = "field"
+	LanguageFromWebsite = "website"
+	LanguageFromCountry = "country"
+	LanguageFromDefault = "default"
+)
+
+// Error kinds let the UI tell apart why a contact was skipped or failed.
+const (
+	ErrorKindWebsite    = "website"
+	ErrorKindRobots     = "robots_disallowed"
+	ErrorKindGeneration = "generation"
+	ErrorKindUpdate     = "update"
+)
+
+// Website health categories produced by the website diagnostics.
+const (
+	WebsiteOK            = "ok"
+	WebsiteRedirected    = "redirect_other_domain"
+	WebsiteDNSFailure    = "dns_failure"
+	WebsiteTLSError      = "tls_error"
+	WebsiteTimeout       = "timeout"
+	WebsiteBotProtection = "bot_protection"
+	WebsiteParked        = "parked_domain"
+	WebsiteEmpty         = "empty_content"
+	WebsiteHTTPError     = "http_error"
+	WebsiteUnreachable   = "unreachable"
+	WebsiteRobots        = "robots_disallowed"
+	WebsiteBlocked       = "blocked_destination"
+)
+
+// WebsiteStatuses lists the categories in the order they are offered as filters.
+var WebsiteStatuses = []string{
+	WebsiteOK,
+	WebsiteRedirected,
+	WebsiteDNSFailure,
+	WebsiteTLSError,
+	WebsiteTimeout,
+	WebsiteBotProtection,
+	WebsiteParked,
+	WebsiteEmpty,
+	WebsiteHTTPError,
+	WebsiteUnreachable,
+	WebsiteRobots,
+	WebsiteBlocked,
 }
 
 type Language struct {